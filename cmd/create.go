@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/hasher"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/tracker"
+	"github.com/spf13/cobra"
+)
+
+var (
+	CreateAnnounce    []string // tracker地址，第一个作为announce
+	CreateOutput      string
+	CreatePieceLength int64
+	CreateComment     string
+	CreatePrivate     bool
+	CreatePasskey     string // 私有tracker的passkey
+	CreateUser        string // 从账户文件中查找passkey
+)
+
+var createCmd = &cobra.Command{
+	Use:   "create <path>",
+	Short: "Create torrent file",
+	Long:  `Hash a local file or directory and write a torrent file`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		CreateTorrent(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(createCmd)
+
+	flags := createCmd.Flags()
+	flags.StringSliceVarP(&CreateAnnounce, "announce", "a", nil, "tracker announce url, may be repeated")
+	flags.StringVarP(&CreateOutput, "output", "o", "", "output file (default is <name>.torrent)")
+	flags.Int64Var(&CreatePieceLength, "piece-length", 0, "piece length in bytes (default is automatic)")
+	flags.StringVar(&CreateComment, "comment", "", "torrent comment")
+	flags.BoolVar(&CreatePrivate, "private", false, "set private flag, disables DHT and PEX")
+	flags.StringVar(&CreatePasskey, "passkey", "", "embed passkey into announce urls")
+	flags.StringVar(&CreateUser, "user", "", "embed passkey of this tracker account")
+	flags.StringVar(&AccountsFile, "accounts", AccountsFile, "tracker accounts file for --user")
+}
+
+func CreateTorrent(path string) {
+	h := hasher.New(hasher.SHA1)
+	h.Progress = func(done, total int, bytes int64) {
+		fmt.Printf("\rHashing: %d/%d pieces, %s   ", done, total, formatBytes(float64(bytes)))
+	}
+	t, err := torrent.CreateWith(h, path, CreatePieceLength)
+	fmt.Println()
+	utils.CheckError(err)
+
+	passkey := CreatePasskey
+	if CreateUser != "" {
+		accounts, err := tracker.LoadAccounts(AccountsFile)
+		utils.CheckError(err)
+		a := accounts.Get(CreateUser)
+		if a == nil {
+			utils.CheckError(fmt.Errorf("unknown account: %s", CreateUser))
+		}
+		passkey = a.Passkey
+	}
+	if passkey != "" && !CreatePrivate {
+		LOG.Warn("Passkey given without --private, setting private flag")
+		CreatePrivate = true
+	}
+
+	var tier []string
+	for _, u := range CreateAnnounce {
+		if passkey != "" {
+			u, err = tracker.PasskeyURL(u, passkey)
+			utils.CheckError(err)
+		}
+		tier = append(tier, u)
+	}
+	if len(tier) > 0 {
+		t.Announce = tier[0]
+	}
+	if len(tier) > 1 {
+		for _, u := range tier {
+			t.AnnounceList = append(t.AnnounceList, []string{u})
+		}
+	}
+
+	if CreatePrivate {
+		private := 1
+		t.Info.Private = &private
+	}
+	if CreateComment != "" {
+		t.Comment = &CreateComment
+	}
+	createdBy := "whonet/" + AppVersion
+	t.CreatedBy = &createdBy
+
+	if CreateOutput == "" {
+		CreateOutput = t.Info.Name + ".torrent"
+	}
+	s := bencode.NewEncoder().Encode(t.ToMap())
+	utils.CheckError(ioutil.WriteFile(CreateOutput, []byte(s), 0644))
+	fmt.Printf("%s: %d pieces, info hash %X\n", CreateOutput, t.Info.NumPieces(), t.InfoHash())
+}
@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/choker"
+	"github.com/openqt/whonet/utils/client"
+	"github.com/openqt/whonet/utils/connmgr"
+	"github.com/openqt/whonet/utils/mse"
+	"github.com/openqt/whonet/utils/network"
+	"github.com/openqt/whonet/utils/picker"
+	"github.com/openqt/whonet/utils/storage"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/utp"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var (
+	DownloadOut         string
+	DownloadPeers       []string // 额外的peer地址
+	DownloadMetaTimeout time.Duration
+	DownloadAllocate    string
+	DownloadFiles       string   // 下载的文件序号，如0,3-5
+	DownloadExclude     []string // 不下载的文件名模式
+	DownloadPriority    []string // 如high=0,2
+	DownloadList        bool
+
+	// download和seed共用
+	ListenPort  int
+	MaxPeers    int
+	MaxConns    int
+	MaxHalfOpen int
+	UploadSlots int
+	ChokerAlgo  string
+	Limits      client.Limits // 速度以KiB/s为单位设置
+)
+
+var downloadCmd = &cobra.Command{
+	Use:   "download <torrent|magnet>",
+	Short: "Download torrent data",
+	Long:  `Download the data of a torrent file or magnet link into a directory, exit when all pieces are verified`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		Download(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(downloadCmd)
+
+	flags := downloadCmd.Flags()
+	flags.StringVarP(&DownloadOut, "out", "o", ".", "output directory")
+	flags.StringSliceVar(&DownloadPeers, "peer", nil, "peer address host:port, may be repeated")
+	flags.DurationVar(&DownloadMetaTimeout, "meta-timeout", 5*time.Minute, "time to fetch metadata of a magnet link")
+	flags.StringVar(&DownloadAllocate, "allocate", "none", "space allocation of new files: none, sparse or full")
+	flags.StringVar(&DownloadFiles, "files", "", "download only these file indexes, e.g. 0,3-5")
+	flags.StringSliceVar(&DownloadExclude, "exclude", nil, "skip files matching this pattern, e.g. '*.txt', may be repeated")
+	flags.StringArrayVar(&DownloadPriority, "priority", nil, "file priority as level=indexes, e.g. high=0,2; levels are skip, low, normal and high")
+	flags.BoolVar(&DownloadList, "list", false, "list files with their indexes and exit")
+	peerFlags(downloadCmd)
+}
+
+func peerFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.IntVar(&ListenPort, "port", 6881, "listen port for tcp and utp")
+	flags.IntVar(&MaxPeers, "max-peers", client.DefaultMaxPeers, "maximum connections per torrent")
+	flags.IntVar(&MaxConns, "max-conns", connmgr.DefaultMaxConns, "maximum connections of all torrents")
+	flags.IntVar(&MaxHalfOpen, "max-half-open", connmgr.DefaultMaxHalfOpen, "maximum outgoing connections in progress")
+	flags.IntVar(&UploadSlots, "upload-slots", choker.DefaultSlots, "unchoked peers including the optimistic one")
+	flags.StringVar(&ChokerAlgo, "choker", "fastest-upload", "seeding choker: fastest-upload, anti-leech or round-robin")
+	flags.Int64Var(&Limits.Upload, "max-upload", 0, "upload limit in KiB/s, 0 is unlimited")
+	flags.Int64Var(&Limits.Download, "max-download", 0, "download limit in KiB/s, 0 is unlimited")
+	flags.Int64Var(&Limits.LocalUpload, "local-upload", 0, "upload limit for local network peers in KiB/s, replaces --max-upload for them")
+	flags.Int64Var(&Limits.LocalDownload, "local-download", 0, "download limit for local network peers in KiB/s, replaces --max-download for them")
+	flags.Int64Var(&Limits.PeerUpload, "peer-upload", 0, "upload limit per peer in KiB/s")
+	flags.Int64Var(&Limits.PeerDownload, "peer-download", 0, "download limit per peer in KiB/s")
+	flags.BoolVar(&Limits.CountOverhead, "count-overhead", false, "count protocol messages against the limits, not only piece data")
+}
+
+// 按网络设置创建客户端，fs为nil时使用本地文件
+func newClient(fs afero.Fs) *client.Client {
+	policy, err := mse.ParsePolicy(network.Default.Encryption)
+	utils.CheckError(err)
+	pref, err := utp.ParsePreference(network.Default.Transport)
+	utils.CheckError(err)
+	if network.Default.ProxyPeers {
+		pref = utp.OnlyTCP
+	}
+	tcp, err := network.Default.PeerDialer()
+	utils.CheckError(err)
+	alloc, err := storage.ParseAllocation(DownloadAllocate)
+	utils.CheckError(err)
+	limits := Limits
+	for _, v := range []*int64{&limits.Upload, &limits.Download, &limits.LocalUpload,
+		&limits.LocalDownload, &limits.PeerUpload, &limits.PeerDownload} {
+		*v *= 1024
+	}
+
+	c, err := client.New(client.Config{
+		Listen:      fmt.Sprintf(":%d", ListenPort),
+		TCP:         tcp,
+		Transport:   pref,
+		Encryption:  policy,
+		MaxPeers:    MaxPeers,
+		MaxConns:    MaxConns,
+		MaxHalfOpen: MaxHalfOpen,
+		Allocation:  alloc,
+		Fs:          fs,
+		Limits:      limits,
+	})
+	utils.CheckError(err)
+	return c
+}
+
+// 按命令行设置种子的choker
+func setChoker(t *client.Torrent) {
+	algo, err := choker.ParseAlgorithm(ChokerAlgo)
+	utils.CheckError(err)
+	t.SetChoker(UploadSlots, algo)
+}
+
+// 读取torrent文件，或者下载magnet的元数据
+func loadTorrent(arg string) (*torrent.TorrentStruct, []string) {
+	if strings.HasPrefix(arg, "magnet:") {
+		m, err := torrent.ParseMagnet(arg)
+		utils.CheckError(err)
+		t, err := fetchMetadata(m, DownloadPeers, DownloadMetaTimeout, time.Minute, 8)
+		utils.CheckError(err)
+		return t, m.Peers
+	}
+	data, err := ioutil.ReadFile(arg)
+	utils.CheckError(err)
+	return torrent.NewTorrent(data), nil
+}
+
+func Download(arg string) {
+	meta, peers := loadTorrent(arg)
+	if DownloadList {
+		listFiles(meta.Info)
+		return
+	}
+	c := newClient(nil)
+	defer c.Close()
+
+	t, err := c.Add(meta, DownloadOut)
+	utils.CheckError(err)
+	setChoker(t)
+	resumed, err := t.Resume(context.Background())
+	utils.CheckError(err)
+	selectFiles(t, meta.Info) // 命令行的选择优先于恢复数据
+	if !resumed {
+		t.Verify()
+	}
+	t.AddPeers(append(peers, DownloadPeers...))
+	t.Start()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.Done():
+			printProgress(meta, t.Stats())
+			fmt.Println()
+			t.Stop()
+			return
+		case <-interrupt:
+			fmt.Println()
+			c.Close()
+			os.Exit(1)
+		case <-ticker.C:
+			printProgress(meta, t.Stats())
+		}
+	}
+}
+
+// 进度只计算选择下载的文件
+func printProgress(meta *torrent.TorrentStruct, s client.Stats) {
+	percent := 100.0
+	if s.Selected > 0 {
+		percent = float64(s.Completed) * 100 / float64(s.Selected)
+	}
+	fmt.Printf("\r%s: %5.1f%% of %s, %d/%d pieces, %d peers, down %s/s, up %s/s   ",
+		meta.Info.Name, percent, formatBytes(float64(s.Selected)), s.Have, s.Pieces, s.Peers,
+		formatBytes(s.DownRate), formatBytes(s.UpRate))
+}
+
+// 第f个文件在种子中的路径
+func fileName(info torrent.InfoStruct, f int) string {
+	if info.Length != nil {
+		return info.Name
+	}
+	return strings.Join(info.Files[f].Path, "/")
+}
+
+func numFiles(info torrent.InfoStruct) int {
+	if info.Length != nil {
+		return 1
+	}
+	return len(info.Files)
+}
+
+func listFiles(info torrent.InfoStruct) {
+	for f := 0; f < numFiles(info); f++ {
+		length := info.TotalLength()
+		if info.Length == nil {
+			length = info.Files[f].Length
+		}
+		fmt.Printf("%4d %10s  %s\n", f, formatBytes(float64(length)), fileName(info, f))
+	}
+}
+
+// 解析0,3-5形式的序号列表，序号必须小于n
+func parseIndexes(s string, n int) ([]int, error) {
+	var list []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if k := strings.Index(part, "-"); k > 0 {
+			from, to = part[:k], part[k+1:]
+		}
+		a, err1 := strconv.Atoi(from)
+		b, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || a < 0 || a > b || b >= n {
+			return nil, fmt.Errorf("invalid file index %q, torrent has %d files", part, n)
+		}
+		for i := a; i <= b; i++ {
+			list = append(list, i)
+		}
+	}
+	return list, nil
+}
+
+// 按--files、--exclude和--priority设置文件优先级，都没有指定时不修改
+func selectFiles(t *client.Torrent, info torrent.InfoStruct) {
+	if DownloadFiles == "" && len(DownloadExclude) == 0 && len(DownloadPriority) == 0 {
+		return
+	}
+	n := numFiles(info)
+	prio := make([]picker.Priority, n)
+	for f := range prio {
+		prio[f] = picker.Normal
+	}
+	if DownloadFiles != "" {
+		list, err := parseIndexes(DownloadFiles, n)
+		utils.CheckError(err)
+		for f := range prio {
+			prio[f] = picker.Skip
+		}
+		for _, f := range list {
+			prio[f] = picker.Normal
+		}
+	}
+	for f := range prio {
+		name := fileName(info, f)
+		for _, pattern := range DownloadExclude {
+			m1, err := path.Match(pattern, name)
+			utils.CheckError(err)
+			m2, _ := path.Match(pattern, path.Base(name))
+			if m1 || m2 {
+				prio[f] = picker.Skip
+			}
+		}
+	}
+	for _, v := range DownloadPriority {
+		k := strings.Index(v, "=")
+		if k < 0 {
+			utils.CheckError(fmt.Errorf("invalid priority %q, expected level=indexes", v))
+		}
+		p, err := picker.ParsePriority(v[:k])
+		utils.CheckError(err)
+		list, err := parseIndexes(v[k+1:], n)
+		utils.CheckError(err)
+		for _, f := range list {
+			prio[f] = p
+		}
+	}
+
+	selected := 0
+	for f, p := range prio {
+		utils.CheckError(t.SetFilePriority(f, p))
+		if p != picker.Skip {
+			selected++
+		}
+	}
+	LOG.Infof("Selected %d of %d files", selected, n)
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
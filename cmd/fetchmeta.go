@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/mse"
+	"github.com/openqt/whonet/utils/network"
+	"github.com/openqt/whonet/utils/peer"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/tracker"
+	"github.com/openqt/whonet/utils/utp"
+	"github.com/spf13/cobra"
+)
+
+var (
+	FetchMetaOutput      string
+	FetchMetaPeers       []string // 额外的peer地址
+	FetchMetaTimeout     time.Duration
+	FetchMetaPeerTimeout time.Duration
+	FetchMetaConns       int
+)
+
+var fetchMetaCmd = &cobra.Command{
+	Use:   "fetch-meta <magnet>",
+	Short: "Download torrent file of a magnet link",
+	Long:  `Find peers through the trackers of a magnet link, download the info dictionary from them and save it as a torrent file`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		FetchMeta(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fetchMetaCmd)
+
+	flags := fetchMetaCmd.Flags()
+	flags.StringVarP(&FetchMetaOutput, "output", "o", "", "output file (default is <name>.torrent)")
+	flags.StringSliceVar(&FetchMetaPeers, "peer", nil, "peer address host:port, may be repeated")
+	flags.DurationVar(&FetchMetaTimeout, "timeout", 5*time.Minute, "give up after this time")
+	flags.DurationVar(&FetchMetaPeerTimeout, "peer-timeout", time.Minute, "time spent on each peer")
+	flags.IntVar(&FetchMetaConns, "connections", 8, "peers connected at the same time")
+}
+
+func FetchMeta(uri string) {
+	m, err := torrent.ParseMagnet(uri)
+	utils.CheckError(err)
+
+	t, err := fetchMetadata(m, FetchMetaPeers, FetchMetaTimeout, FetchMetaPeerTimeout, FetchMetaConns)
+	utils.CheckError(err)
+	if FetchMetaOutput == "" {
+		FetchMetaOutput = t.Info.Name + ".torrent"
+	}
+	s := bencode.NewEncoder().Encode(t.ToMap())
+	utils.CheckError(ioutil.WriteFile(FetchMetaOutput, []byte(s), 0644))
+	fmt.Printf("%s: %d pieces, info hash %X\n", FetchMetaOutput, t.Info.NumPieces(), t.InfoHash())
+}
+
+// 从magnet中的peer和tracker找到的peer下载元数据
+func fetchMetadata(m *torrent.Magnet, extra []string, timeout, peerTimeout time.Duration, conns int) (*torrent.TorrentStruct, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	peerId := utils.NewPeerId()
+	addrs := append(append([]string(nil), m.Peers...), extra...)
+	addrs = append(addrs, announcePeers(ctx, m, peerId)...)
+	if len(addrs) == 0 {
+		return nil, errors.New("no peers found")
+	}
+	LOG.Infof("Fetching metadata from %d peers", len(addrs))
+
+	dialer, err := peerDialer(m.InfoHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	var hash, id [20]byte
+	copy(hash[:], m.InfoHash)
+	copy(id[:], peerId)
+	info, err := peer.NewMetadata(hash).Fetch(ctx, dialer, addrs, id, conns, peerTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return torrent.FromMetadata(info, m.Trackers)
+}
+
+// 向magnet中的所有tracker查询peer
+func announcePeers(ctx context.Context, m *torrent.Magnet, peerId string) []string {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		addrs []string
+		seen  = make(map[string]bool)
+	)
+	for _, u := range m.Trackers {
+		if !tracker.Supported(u) {
+			continue
+		}
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			resp, err := tracker.DefaultClient.Announce(ctx, u, &torrent.GetStruct{
+				InfoHash: m.InfoHash,
+				PeerId:   peerId,
+				Port:     6881,
+				Left:     1, // 大小未知，不能声明为做种
+				Compact:  1,
+				NumWant:  tracker.DefaultNumWant,
+			})
+			if err != nil {
+				LOG.Warnf("Tracker %s: %v", u, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, p := range resp.Peers {
+				if addr := p.String(); !seen[addr] {
+					seen[addr] = true
+					addrs = append(addrs, addr)
+				}
+			}
+		}(u)
+	}
+	wg.Wait()
+	return addrs
+}
+
+// 连接peer使用的Dialer，按设置使用代理、uTP和加密；
+// socket为nil时使用临时端口，代理peer连接时只能用TCP
+func peerDialer(infoHash string, socket *utp.Socket) (network.Dialer, error) {
+	forward, err := network.Default.PeerDialer()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := mse.ParsePolicy(network.Default.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	pref, err := utp.ParsePreference(network.Default.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if network.Default.ProxyPeers {
+		pref = utp.OnlyTCP
+	}
+	if socket == nil && pref != utp.OnlyTCP {
+		if socket, err = utp.Listen(":0"); err != nil {
+			return nil, err
+		}
+	}
+	transport := &utp.Dialer{Socket: socket, TCP: forward, Preference: pref}
+	return &mse.Dialer{Forward: transport, SKey: []byte(infoHash), Policy: policy}, nil
+}
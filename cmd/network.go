@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/mse"
+	"github.com/openqt/whonet/utils/network"
+	"github.com/openqt/whonet/utils/tracker"
+	"github.com/openqt/whonet/utils/utp"
+	"github.com/spf13/viper"
+)
+
+//
+// 网络设置，配置文件示例：
+//
+// 设置proxy后udp tracker不可用，UDP请求无法经过代理。
+// header和cookie写成name=value的列表，保留名字的大小写
+//
+//   network:
+//     proxy: socks5://127.0.0.1:1080
+//     proxy_peers: true
+//     ca_file: /etc/ssl/private-ca.pem
+//     user_agent: whonet/0.1.0
+//     encryption: preferred
+//     transport: prefer-utp
+//     trackers:
+//       tracker.example.com:
+//         headers:
+//           - Authorization=Basic dXNlcjpwYXNz
+//         cookies:
+//           - UID=1234
+//           - pass=secret
+//
+
+func init() {
+	flags := rootCmd.PersistentFlags()
+	flags.String("proxy", "", "http or socks5 proxy for trackers, disables udp trackers (default from HTTPS_PROXY)")
+	flags.Bool("proxy-peers", false, "connect to peers through the socks5 proxy")
+	flags.String("user-agent", "", "User-Agent of tracker requests")
+	flags.Bool("insecure", false, "skip TLS certificate verification")
+	flags.String("encryption", "enabled", "peer encryption: disabled, enabled, preferred or required")
+	flags.String("transport", "prefer-utp", "peer transport: prefer-utp, prefer-tcp, utp or tcp")
+	viper.BindPFlag("network.proxy", flags.Lookup("proxy"))
+	viper.BindPFlag("network.proxy_peers", flags.Lookup("proxy-peers"))
+	viper.BindPFlag("network.user_agent", flags.Lookup("user-agent"))
+	viper.BindPFlag("network.insecure", flags.Lookup("insecure"))
+	viper.BindPFlag("network.encryption", flags.Lookup("encryption"))
+	viper.BindPFlag("network.transport", flags.Lookup("transport"))
+}
+
+// 根据配置设置tracker使用的HTTP客户端
+func initNetwork() {
+	conf := &network.Config{}
+	utils.CheckError(viper.UnmarshalKey("network", conf))
+	if conf.UserAgent == "" {
+		conf.UserAgent = "whonet/" + AppVersion
+	}
+
+	_, err := mse.ParsePolicy(conf.Encryption)
+	utils.CheckError(err)
+	_, err = utp.ParsePreference(conf.Transport)
+	utils.CheckError(err)
+
+	client, err := network.NewHTTPClient(conf)
+	utils.CheckError(err)
+	network.Default = conf
+	tracker.DefaultClient.HTTP = client
+	tracker.DefaultClient.NoUDP = conf.Proxied()
+}
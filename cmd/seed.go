@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/client"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var (
+	SeedData  string
+	SeedTrust bool // 不校验数据
+	SeedRatio float64
+	SeedTime  time.Duration
+	SeedPeers []string
+)
+
+var seedCmd = &cobra.Command{
+	Use:   "seed <torrent>",
+	Short: "Seed local data",
+	Long:  `Verify local data of a torrent and upload it to other peers until interrupted or a seeding limit is reached`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		Seed(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(seedCmd)
+
+	flags := seedCmd.Flags()
+	flags.StringVarP(&SeedData, "data", "d", ".", "directory containing the data")
+	flags.BoolVar(&SeedTrust, "trust", false, "skip hash check, only compare file sizes")
+	flags.Float64Var(&SeedRatio, "ratio", 0, "stop when uploaded bytes reach this multiple of the data size")
+	flags.DurationVar(&SeedTime, "time", 0, "stop after seeding for this time")
+	flags.StringSliceVar(&SeedPeers, "peer", nil, "peer address host:port, may be repeated")
+	peerFlags(seedCmd)
+}
+
+func Seed(file string) {
+	data, err := ioutil.ReadFile(file)
+	utils.CheckError(err)
+	meta := torrent.NewTorrent(data)
+
+	// 做种只读取数据，可以用于只读挂载的介质
+	c := newClient(afero.NewReadOnlyFs(afero.NewOsFs()))
+	defer c.Close()
+	t, err := c.Add(meta, SeedData)
+	utils.CheckError(err)
+	setChoker(t)
+	if SeedTrust {
+		utils.CheckError(t.Trust())
+	} else if resumed, err := t.Resume(context.Background()); err != nil || !resumed {
+		utils.CheckError(err)
+		LOG.Infof("Verifying %s", meta.Info.Name)
+		t.Verify()
+	}
+	t.ResumePath = "" // 数据是只读的，不保存恢复数据
+	select {
+	case <-t.Done():
+	default:
+		s := t.Stats()
+		utils.CheckError(fmt.Errorf("%s: data incomplete, %d/%d pieces", meta.Info.Name, s.Have, s.Pieces))
+	}
+
+	t.AddPeers(SeedPeers)
+	t.Start()
+	LOG.Infof("Seeding %s on port %d", meta.Info.Name, c.Port())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	var deadline <-chan time.Time
+	if SeedTime > 0 {
+		deadline = time.After(SeedTime)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-interrupt:
+			fmt.Println()
+			t.Stop() // 发送stopped
+			return
+		case <-deadline:
+			fmt.Println()
+			LOG.Infof("Seed time %v reached", SeedTime)
+			t.Stop()
+			return
+		case <-ticker.C:
+			s := t.Stats()
+			printSeeding(meta, s)
+			total := meta.Info.TotalLength()
+			if SeedRatio > 0 && total > 0 && float64(s.Uploaded)/float64(total) >= SeedRatio {
+				fmt.Println()
+				LOG.Infof("Seed ratio %.2f reached", SeedRatio)
+				t.Stop()
+				return
+			}
+		}
+	}
+}
+
+func printSeeding(meta *torrent.TorrentStruct, s client.Stats) {
+	ratio := 0.0
+	if total := meta.Info.TotalLength(); total > 0 {
+		ratio = float64(s.Uploaded) / float64(total)
+	}
+	fmt.Printf("\r%s: %d peers, uploaded %s, ratio %.2f, up %s/s   ",
+		meta.Info.Name, s.Peers, formatBytes(float64(s.Uploaded)), ratio, formatBytes(s.UpRate))
+}
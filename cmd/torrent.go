@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"github.com/openqt/whonet/utils"
 	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/resume"
+	"github.com/openqt/whonet/utils/storage"
 	"github.com/openqt/whonet/utils/torrent"
 	"github.com/satori/go.uuid"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"io/ioutil"
 	"net/url"
@@ -16,6 +19,7 @@ import (
 
 var (
 	Filename string // Torrent文件路径
+	ShowData string // 数据目录，显示下载进度
 	LOG      = utils.GetLogger()
 )
 
@@ -33,6 +37,7 @@ var showCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(showCmd)
+	showCmd.Flags().StringVarP(&ShowData, "data", "d", "", "data directory, show downloaded pieces from its resume data")
 }
 
 func ShowTorrent(file string) {
@@ -45,21 +50,7 @@ func ShowTorrent(file string) {
 	b, err := json.MarshalIndent(torrent, "", "  ")
 	fmt.Println(string(b))
 
-	f, err := os.Open("/data/Go/src/github.com/openqt/whonet/tests/ubuntu-18.10-desktop-amd64.iso")
-	utils.CheckError(err)
-	bytes = make([]byte, torrent.Info.PieceLength)
-
 	h := sha1.New()
-	for i := 0; i < 10; i++ {
-		_, err := f.Read(bytes)
-		utils.CheckError(err)
-
-		h.Write(bytes)
-		hs := h.Sum(nil)
-		fmt.Printf("%02d: %X\n", i+1, hs)
-		h.Reset()
-	}
-
 	s := ""
 	enc := bencode.NewEncoder()
 
@@ -76,4 +67,29 @@ func ShowTorrent(file string) {
 	s = enc.Encode(torrent.ToMap())
 	err = ioutil.WriteFile("t.to", []byte(s), 0644)
 	utils.CheckError(err)
+
+	if ShowData != "" {
+		showPieces(torrent)
+	}
+}
+
+// 从恢复数据显示已经下载的piece
+func showPieces(t *torrent.TorrentStruct) {
+	fs := afero.NewReadOnlyFs(afero.NewOsFs())
+	path := storage.NewFs(fs, t.Info, ShowData).StatePath("resume")
+	d, err := resume.Load(fs, path)
+	if os.IsNotExist(err) {
+		fmt.Println("Pieces: no resume data")
+		return
+	}
+	utils.CheckError(err)
+	if d.InfoHash != t.InfoHash() {
+		fmt.Println("Pieces: resume data of another torrent")
+		return
+	}
+	fmt.Printf("Pieces: %s\n", d.Have)
+	fmt.Printf("Bitfield: %s\n", d.Have.Hex())
+	for _, u := range d.Unfinished {
+		fmt.Printf("  piece %d blocks: %s\n", u.Piece, u.Blocks.Ranges())
+	}
 }
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/tracker"
+	"github.com/spf13/cobra"
+)
+
+var (
+	TrackerHTTP        string        // HTTP监听地址
+	TrackerUDP         string        // UDP监听地址
+	TrackerInterval    time.Duration // announce间隔
+	TrackerMinInterval time.Duration
+	TrackerAllowDir    string // 允许的torrent目录
+	TrackerPrivate     bool
+	TrackerClients     []string // 允许的客户端peer_id前缀
+	TrackerTrustIP     bool     // 接受announce中的ip参数
+	TrackerGrace       int64    // 下载量低于这个值(MiB)时不检查分享率
+
+	UserMinRatio float64 // 新用户的最低分享率
+
+	AccountsFile = ".whonet-accounts.json" // 私有tracker的账户文件
+)
+
+const accountsReload = 5 * time.Second // 检查账户文件是否被修改的间隔
+
+var trackerCmd = &cobra.Command{
+	Use:   "tracker",
+	Short: "BitTorrent tracker",
+	Long:  `Built-in BitTorrent tracker for private swarms`,
+}
+
+var trackerServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run HTTP and UDP tracker server",
+	Long:  `Run an in-memory HTTP and UDP tracker, optionally restricted to the torrents in a directory`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ServeTracker()
+	},
+}
+
+var trackerUserCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage private tracker accounts",
+}
+
+var trackerUserAddCmd = &cobra.Command{
+	Use:   "add <name>...",
+	Short: "Add accounts and print their passkeys",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		accounts := loadAccounts()
+		for _, name := range args {
+			a, err := accounts.Add(name)
+			utils.CheckError(err)
+			utils.CheckError(accounts.SetMinRatio(a.Passkey, UserMinRatio))
+			fmt.Printf("%s\t%s\n", a.Name, a.Passkey)
+		}
+		utils.CheckError(accounts.Save())
+	},
+}
+
+var trackerUserRatioCmd = &cobra.Command{
+	Use:   "ratio <name|passkey> <ratio>",
+	Short: "Set the minimum share ratio of an account, 0 to disable",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ratio, err := strconv.ParseFloat(args[1], 64)
+		utils.CheckError(err)
+		accounts := loadAccounts()
+		utils.CheckError(accounts.SetMinRatio(args[0], ratio))
+		utils.CheckError(accounts.Save())
+	},
+}
+
+var trackerUserBanCmd = &cobra.Command{
+	Use:   "ban <name|passkey>...",
+	Short: "Ban accounts",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setBanned(args, true)
+	},
+}
+
+var trackerUserUnbanCmd = &cobra.Command{
+	Use:   "unban <name|passkey>...",
+	Short: "Unban accounts",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setBanned(args, false)
+	},
+}
+
+var trackerUserListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List accounts with transfer statistics",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		accounts := loadAccounts()
+		for _, a := range accounts.List() {
+			up, down := a.Totals()
+			ratio := "-"
+			if r := a.Ratio(); r >= 0 {
+				ratio = fmt.Sprintf("%.2f", r)
+			}
+			if a.MinRatio > 0 {
+				ratio += fmt.Sprintf("/%.2f", a.MinRatio)
+			}
+			banned := ""
+			if a.Banned {
+				banned = "banned"
+			}
+			fmt.Printf("%-16s %s  up %-12d down %-12d ratio %-6s torrents %-4d %s\n",
+				a.Name, a.Passkey, up, down, ratio, len(a.Torrents), banned)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(trackerCmd)
+	trackerCmd.AddCommand(trackerServeCmd)
+	trackerCmd.AddCommand(trackerUserCmd)
+	trackerUserCmd.AddCommand(trackerUserAddCmd, trackerUserBanCmd, trackerUserUnbanCmd, trackerUserRatioCmd, trackerUserListCmd)
+	trackerUserAddCmd.Flags().Float64Var(&UserMinRatio, "min-ratio", 0, "minimum share ratio, downloading is refused below it")
+	trackerUserCmd.PersistentFlags().StringVar(&AccountsFile, "accounts", AccountsFile, "tracker accounts file")
+
+	flags := trackerServeCmd.Flags()
+	flags.StringVar(&TrackerHTTP, "http", ":6969", "HTTP listen address, empty to disable")
+	flags.StringVar(&TrackerUDP, "udp", ":6969", "UDP listen address, empty to disable")
+	flags.DurationVar(&TrackerInterval, "interval", 30*time.Minute, "announce interval")
+	flags.DurationVar(&TrackerMinInterval, "min-interval", time.Minute, "minimum announce interval")
+	flags.StringVar(&TrackerAllowDir, "allow", "", "only track torrents found in this directory")
+	flags.BoolVar(&TrackerPrivate, "private", false, "require passkey in announce url and account transfers")
+	flags.StringVar(&AccountsFile, "accounts", AccountsFile, "tracker accounts file for --private")
+	flags.BoolVar(&TrackerTrustIP, "trust-ip", false, "use the ip parameter of announces, e.g. behind a reverse proxy (always trusted from loopback)")
+	flags.Int64Var(&TrackerGrace, "ratio-grace", 1024, "MiB an account may download before its minimum ratio applies")
+	flags.StringSliceVar(&TrackerClients, "clients", nil, "allowed client peer_id prefixes for --private, e.g. -WN,-qB")
+}
+
+func loadAccounts() *tracker.Accounts {
+	accounts, err := tracker.LoadAccounts(AccountsFile)
+	utils.CheckError(err)
+	return accounts
+}
+
+func setBanned(keys []string, banned bool) {
+	accounts := loadAccounts()
+	for _, key := range keys {
+		utils.CheckError(accounts.SetBanned(key, banned))
+	}
+	utils.CheckError(accounts.Save())
+}
+
+func ServeTracker() {
+	// 间隔用于过期清理的定时器，不能为0
+	if TrackerInterval < time.Second {
+		utils.CheckError(fmt.Errorf("invalid interval %v, at least 1s", TrackerInterval))
+	}
+	if TrackerMinInterval < 0 || TrackerMinInterval > TrackerInterval {
+		utils.CheckError(fmt.Errorf("invalid min interval %v, expected 0 to %v", TrackerMinInterval, TrackerInterval))
+	}
+
+	server := tracker.NewServer(TrackerInterval, TrackerMinInterval)
+	server.TrustIP = TrackerTrustIP
+	if TrackerAllowDir != "" {
+		allow, err := tracker.LoadAllowList(TrackerAllowDir)
+		utils.CheckError(err)
+		server.Swarms.SetAllowList(allow)
+		LOG.Infof("Allowed torrents: %d", len(allow))
+	}
+
+	if TrackerPrivate {
+		server.Accounts = loadAccounts()
+		server.Accounts.Clients = TrackerClients
+		server.Accounts.Grace = TrackerGrace << 20
+		LOG.Infof("Private mode, accounts in %s", AccountsFile)
+	}
+
+	quit := make(chan struct{})
+	go server.ExpireLoop(quit)
+	if server.Accounts != nil {
+		go func() {
+			// 运行时tracker user命令修改的账户文件要尽快生效，保存时也会先合并
+			reload := time.NewTicker(accountsReload)
+			defer reload.Stop()
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-quit:
+					return
+				case <-reload.C:
+					if err := server.Accounts.Reload(); err != nil {
+						LOG.Error(err)
+					}
+				case <-ticker.C:
+					if err := server.Accounts.SaveIfDirty(); err != nil {
+						LOG.Error(err)
+					}
+				}
+			}
+		}()
+	}
+
+	if TrackerUDP != "" {
+		conn, err := net.ListenPacket("udp", TrackerUDP)
+		utils.CheckError(err)
+		LOG.Infof("UDP tracker listening on %s", conn.LocalAddr())
+		go func() {
+			LOG.Error(server.ServeUDP(conn))
+		}()
+	}
+	if TrackerHTTP != "" {
+		l, err := net.Listen("tcp", TrackerHTTP)
+		utils.CheckError(err)
+		LOG.Infof("HTTP tracker listening on %s", l.Addr())
+		go func() {
+			LOG.Error(http.Serve(l, server))
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	close(quit)
+	if server.Accounts != nil {
+		utils.CheckError(server.Accounts.Save())
+	}
+}
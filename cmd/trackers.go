@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/tracker"
+	"github.com/spf13/cobra"
+)
+
+var (
+	TrackersMode        string
+	TrackersTimeout     time.Duration
+	TrackersConcurrency int
+	TrackersOutput      string
+)
+
+var trackersCmd = &cobra.Command{
+	Use:   "trackers",
+	Short: "Tracker health tools",
+}
+
+var trackersTestCmd = &cobra.Command{
+	Use:   "test <torrent>...",
+	Short: "Test reachability of all trackers in torrents",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, file := range args {
+			fmt.Println(">>>", file)
+			_, health := probeTrackers(file)
+			for _, h := range health {
+				printHealth(h)
+			}
+		}
+	},
+}
+
+var trackersPruneCmd = &cobra.Command{
+	Use:   "prune <torrent>",
+	Short: "Write a new torrent without dead trackers",
+	Long:  `Test all trackers and write a new torrent with the dead ones removed, info hash is kept unchanged`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		PruneTrackers(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(trackersCmd)
+	trackersCmd.AddCommand(trackersTestCmd, trackersPruneCmd)
+
+	flags := trackersCmd.PersistentFlags()
+	flags.StringVar(&TrackersMode, "mode", tracker.ProbeAuto, "probe method: auto, scrape or announce")
+	flags.DurationVar(&TrackersTimeout, "timeout", 15*time.Second, "timeout of each tracker")
+	flags.IntVar(&TrackersConcurrency, "concurrency", 16, "trackers tested at the same time")
+	trackersPruneCmd.Flags().StringVarP(&TrackersOutput, "output", "o", "", "output file (default overwrites input)")
+}
+
+func probeTrackers(file string) (*torrent.TorrentStruct, []*tracker.Health) {
+	data, err := ioutil.ReadFile(file)
+	utils.CheckError(err)
+	t := torrent.NewTorrent(data)
+
+	client := *tracker.DefaultClient
+	client.Timeout = TrackersTimeout
+	health := client.ProbeAll(context.Background(), t, utils.NewPeerId(), TrackersMode, TrackersConcurrency)
+	return t, health
+}
+
+func printHealth(h *tracker.Health) {
+	switch {
+	case !h.Supported:
+		fmt.Printf("  [%d] %-8s %s\n", h.Tier, "SKIP", h.URL)
+	case h.Err != nil:
+		fmt.Printf("  [%d] %-8s %s (%v) %v\n", h.Tier, "DEAD", h.URL, h.Latency.Round(time.Millisecond), h.Err)
+	default:
+		fmt.Printf("  [%d] %-8s %s (%v) %s seeders %d leechers %d downloaded %d peers %d\n",
+			h.Tier, "OK", h.URL, h.Latency.Round(time.Millisecond), h.Method,
+			h.Seeders, h.Leechers, h.Downloaded, h.Peers)
+	}
+}
+
+func PruneTrackers(file string) {
+	t, health := probeTrackers(file)
+	hash := t.InfoHash()
+	for _, h := range health {
+		printHealth(h)
+	}
+
+	removed := tracker.Prune(t, health)
+	if removed == 0 {
+		fmt.Println("No dead tracker")
+		return
+	}
+
+	s := bencode.NewEncoder().Encode(t.ToMap())
+	if torrent.NewTorrent([]byte(s)).InfoHash() != hash {
+		utils.CheckError(fmt.Errorf("info hash changed, torrent not written"))
+	}
+	out := TrackersOutput
+	if out == "" {
+		out = file
+	}
+	utils.CheckError(ioutil.WriteFile(out, []byte(s), 0644))
+	fmt.Printf("%s: %d dead trackers removed\n", out, removed)
+}
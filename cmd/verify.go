@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/hasher"
+	"github.com/openqt/whonet/utils/storage"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var (
+	VerifyData    string
+	VerifyWorkers int
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <torrent>",
+	Short: "Verify local data of a torrent",
+	Long:  `Hash local data against the pieces of a torrent and list incomplete files, exit with 1 if any piece fails`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		Verify(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	flags := verifyCmd.Flags()
+	flags.StringVarP(&VerifyData, "data", "d", ".", "directory containing the data")
+	flags.IntVar(&VerifyWorkers, "workers", 0, "hashing goroutines (default is CPU count)")
+}
+
+func Verify(file string) {
+	data, err := ioutil.ReadFile(file)
+	utils.CheckError(err)
+	meta := torrent.NewTorrent(data)
+	s := storage.NewFs(afero.NewReadOnlyFs(afero.NewOsFs()), meta.Info, VerifyData)
+	defer s.Close()
+
+	n := meta.Info.NumPieces()
+	good := make([]bool, n)
+	start := time.Now()
+	h := hasher.New(hasher.SHA1)
+	h.Workers = VerifyWorkers
+	h.Progress = func(done, total int, bytes int64) {
+		fmt.Printf("\rVerifying %s: %d/%d pieces, %s/s   ", meta.Info.Name, done, total,
+			formatBytes(float64(bytes)/time.Since(start).Seconds()))
+	}
+	h.All(context.Background(), s, n, func(r hasher.Result) {
+		good[r.Index] = r.Err == nil && string(r.Sum) == meta.Info.PieceHash(r.Index)
+	})
+	fmt.Println()
+
+	count := 0
+	for _, ok := range good {
+		if ok {
+			count++
+		}
+	}
+	// 有任何一个piece不对的文件
+	for _, f := range s.Files {
+		if f.Length == 0 || f.Padding {
+			continue
+		}
+		first := int(f.Offset / meta.Info.PieceLength)
+		last := int((f.Offset + f.Length - 1) / meta.Info.PieceLength)
+		bad := 0
+		for i := first; i <= last; i++ {
+			if !good[i] {
+				bad++
+			}
+		}
+		if bad > 0 {
+			fmt.Printf("  %s: %d/%d pieces failed\n", f.Path, bad, last-first+1)
+		}
+	}
+	fmt.Printf("%s: %d/%d pieces ok\n", meta.Info.Name, count, n)
+	if count < n {
+		os.Exit(1)
+	}
+}
@@ -52,6 +52,9 @@ type Decoder struct {
 
 	// 特殊处理二进制内容
 	Pieces string
+	// 顶层info字段的原始编码，用于保持info_hash不变
+	Info  string
+	depth int
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////
@@ -68,9 +71,24 @@ func NewDecoder() *Decoder {
 func (dec *Decoder) Decode(buf []byte) interface{} {
 	dec.buf = buf
 	dec.idx = 0
+	dec.depth = 0
+	dec.Info = ""
 	return dec.decode()
 }
 
+// 解码网络数据，解码失败时返回错误而不是panic
+func (dec *Decoder) TryDecode(buf []byte) (val interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			val, err = nil, fmt.Errorf("bencode: %v", r)
+		}
+	}()
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("bencode: empty input")
+	}
+	return dec.Decode(buf), nil
+}
+
 func (dec *Decoder) decode() interface{} {
 	var val interface{}
 	if dec.IsEnd() {
@@ -211,10 +229,17 @@ func (dec *Decoder) decodeDict() map[string]interface{} {
 	}
 	dec.Next()
 
+	dec.depth++
+	defer func() { dec.depth-- }()
+
 	val := make(map[string]interface{})
 	for !dec.IsEnd() {
 		key := dec.decodeString()
+		start := dec.Pos()
 		_val := dec.decode()
+		if key == "info" && dec.depth == 1 {
+			dec.Info = string(dec.buf[start:dec.Pos()])
+		}
 		// All strings must be UTF-8 encoded, except for pieces, which contains binary data.
 		if key == "pieces" {  // TODO: 更好的Bencode解码机制
 			dec.Pieces = _val.(string)
@@ -51,6 +51,11 @@ This allows for arbitrarily complex data structures to be encoded.
 type Encoder struct {
 }
 
+// 已经编码好的内容，编码时原样输出
+type Raw string
+
+var rawType = reflect.TypeOf(Raw(""))
+
 //////////////////////////////////////////////////////////////////////////////////////////
 //
 //  编解码函数
@@ -68,6 +73,9 @@ func (enc *Encoder) Encode(val interface{}) string {
 
 func (enc *Encoder) encode(val reflect.Value) string {
 	var result string
+	if val.IsValid() && val.Type() == rawType {
+		return val.String()
+	}
 	switch val.Kind() {
 	case reflect.Int, reflect.Int64:
 		result = enc.encodeInt(int(val.Int()))
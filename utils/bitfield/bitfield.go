@@ -0,0 +1,239 @@
+package bitfield
+
+//
+// 位图，用于piece的拥有情况、文件选择和恢复数据。
+// 字节内最高位在前，与BEP 3中bitfield消息的格式相同
+//
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+var (
+	ErrLength    = errors.New("bitfield: wrong length")
+	ErrSpareBits = errors.New("bitfield: spare bits set")
+)
+
+type Bitfield struct {
+	b []byte
+	n int
+}
+
+// n位，全部为0
+func New(n int) *Bitfield {
+	return &Bitfield{b: make([]byte, (n+7)/8), n: n}
+}
+
+// n位，全部为1
+func Full(n int) *Bitfield {
+	f := New(n)
+	f.SetAll()
+	return f
+}
+
+// 解析线路上的bitfield，检查长度和末尾的多余位
+func FromBytes(b []byte, n int) (*Bitfield, error) {
+	if len(b) != (n+7)/8 {
+		return nil, ErrLength
+	}
+	f := &Bitfield{b: append([]byte(nil), b...), n: n}
+	if n%8 != 0 && f.b[len(f.b)-1]&(0xff>>uint(n%8)) != 0 {
+		return nil, ErrSpareBits
+	}
+	return f, nil
+}
+
+// 线路格式，返回内部数据不要修改
+func (f *Bitfield) Bytes() []byte {
+	return f.b
+}
+
+func (f *Bitfield) Len() int {
+	return f.n
+}
+
+func (f *Bitfield) Clone() *Bitfield {
+	return &Bitfield{b: append([]byte(nil), f.b...), n: f.n}
+}
+
+func (f *Bitfield) Get(i int) bool {
+	return i >= 0 && i < f.n && f.b[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+func (f *Bitfield) Set(i int) {
+	f.b[i/8] |= 0x80 >> uint(i%8)
+}
+
+func (f *Bitfield) Clear(i int) {
+	f.b[i/8] &^= 0x80 >> uint(i%8)
+}
+
+func (f *Bitfield) SetAll() {
+	for i := range f.b {
+		f.b[i] = 0xff
+	}
+	f.trim()
+}
+
+func (f *Bitfield) ClearAll() {
+	for i := range f.b {
+		f.b[i] = 0
+	}
+}
+
+// 清除末尾的多余位
+func (f *Bitfield) trim() {
+	if f.n%8 != 0 {
+		f.b[len(f.b)-1] &= 0xff << uint(8-f.n%8)
+	}
+}
+
+// 为1的位数
+func (f *Bitfield) Count() int {
+	n := 0
+	for _, x := range f.b {
+		n += bits.OnesCount8(x)
+	}
+	return n
+}
+
+func (f *Bitfield) All() bool {
+	return f.Count() == f.n
+}
+
+func (f *Bitfield) None() bool {
+	for _, x := range f.b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 从i开始（含i）的第一个为1的位，没有时返回-1
+func (f *Bitfield) NextSet(i int) int {
+	if i < 0 {
+		i = 0
+	}
+	for i < f.n {
+		x := f.b[i/8] << uint(i%8)
+		if x != 0 {
+			if i += bits.LeadingZeros8(x); i < f.n {
+				return i
+			}
+			return -1
+		}
+		i = (i/8 + 1) * 8
+	}
+	return -1
+}
+
+// 从i开始（含i）的第一个为0的位，没有时返回-1
+func (f *Bitfield) NextClear(i int) int {
+	if i < 0 {
+		i = 0
+	}
+	for i < f.n {
+		x := ^f.b[i/8] << uint(i%8)
+		if x != 0 {
+			if i += bits.LeadingZeros8(x); i < f.n {
+				return i
+			}
+			return -1
+		}
+		i = (i/8 + 1) * 8
+	}
+	return -1
+}
+
+func (f *Bitfield) FirstSet() int {
+	return f.NextSet(0)
+}
+
+func (f *Bitfield) FirstClear() int {
+	return f.NextClear(0)
+}
+
+func (f *Bitfield) check(g *Bitfield) {
+	if f.n != g.n {
+		panic(fmt.Sprintf("bitfield: length mismatch %d != %d", f.n, g.n))
+	}
+}
+
+// 以下集合运算修改f并返回f，长度必须相同
+func (f *Bitfield) And(g *Bitfield) *Bitfield {
+	f.check(g)
+	for i := range f.b {
+		f.b[i] &= g.b[i]
+	}
+	return f
+}
+
+func (f *Bitfield) Or(g *Bitfield) *Bitfield {
+	f.check(g)
+	for i := range f.b {
+		f.b[i] |= g.b[i]
+	}
+	return f
+}
+
+func (f *Bitfield) AndNot(g *Bitfield) *Bitfield {
+	f.check(g)
+	for i := range f.b {
+		f.b[i] &^= g.b[i]
+	}
+	return f
+}
+
+func (f *Bitfield) Equal(g *Bitfield) bool {
+	return f.n == g.n && string(f.b) == string(g.b)
+}
+
+// [from, to)范围内的位组成的新位图
+func (f *Bitfield) Slice(from, to int) *Bitfield {
+	if from < 0 || to > f.n || from > to {
+		panic(fmt.Sprintf("bitfield: slice [%d:%d] out of range %d", from, to, f.n))
+	}
+	g := New(to - from)
+	if from%8 == 0 {
+		copy(g.b, f.b[from/8:])
+		g.trim()
+		return g
+	}
+	for i := f.NextSet(from); i >= 0 && i < to; i = f.NextSet(i + 1) {
+		g.Set(i - from)
+	}
+	return g
+}
+
+// 十六进制显示
+func (f *Bitfield) Hex() string {
+	return hex.EncodeToString(f.b)
+}
+
+// 游程显示为1的范围，例如"0-15,20,30-99"
+func (f *Bitfield) Ranges() string {
+	var parts []string
+	for i := f.FirstSet(); i >= 0; {
+		j := f.NextClear(i)
+		if j < 0 {
+			j = f.n
+		}
+		if j-i == 1 {
+			parts = append(parts, fmt.Sprint(i))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", i, j-1))
+		}
+		i = f.NextSet(j)
+	}
+	return strings.Join(parts, ",")
+}
+
+// 例如"[20/100] 0-15,20,30-32"
+func (f *Bitfield) String() string {
+	return fmt.Sprintf("[%d/%d] %s", f.Count(), f.n, f.Ranges())
+}
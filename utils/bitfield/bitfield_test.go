@@ -0,0 +1,100 @@
+package bitfield
+
+import (
+	"testing"
+)
+
+func TestBits(t *testing.T) {
+	f := New(20)
+	if len(f.Bytes()) != 3 || f.Count() != 0 || !f.None() || f.FirstSet() != -1 || f.FirstClear() != 0 {
+		t.Fatal("new bitfield not empty")
+	}
+	for _, i := range []int{0, 7, 8, 19} {
+		f.Set(i)
+	}
+	if !f.Get(7) || f.Get(6) || f.Get(20) || f.Get(-1) || f.Count() != 4 {
+		t.Errorf("get: %s", f)
+	}
+	if f.Hex() != "818010" {
+		t.Errorf("hex %s", f.Hex())
+	}
+	f.Clear(0)
+	if f.FirstSet() != 7 || f.NextSet(8) != 8 || f.NextSet(9) != 19 || f.NextSet(20) != -1 {
+		t.Error("next set")
+	}
+	if f.NextClear(7) != 9 || f.NextClear(19) != -1 {
+		t.Error("next clear")
+	}
+
+	g := Full(20)
+	if !g.All() || g.Hex() != "fffff0" || g.NextClear(0) != -1 {
+		t.Errorf("full %s", g.Hex())
+	}
+	if g.Ranges() != "0-19" || f.String() != "[3/20] 7-8,19" {
+		t.Errorf("ranges %q %q", g.Ranges(), f.String())
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	a, b := New(10), New(10)
+	for i := 0; i < 6; i++ {
+		a.Set(i)
+	}
+	for i := 4; i < 10; i++ {
+		b.Set(i)
+	}
+	if s := a.Clone().And(b).Ranges(); s != "4-5" {
+		t.Errorf("and %s", s)
+	}
+	if s := a.Clone().Or(b).Ranges(); s != "0-9" {
+		t.Errorf("or %s", s)
+	}
+	if s := a.Clone().AndNot(b).Ranges(); s != "0-3" {
+		t.Errorf("andnot %s", s)
+	}
+	if a.Ranges() != "0-5" || a.Equal(b) || !a.Equal(a.Clone()) {
+		t.Error("clone modified")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("length mismatch not detected")
+		}
+	}()
+	a.And(New(11))
+}
+
+func TestSlice(t *testing.T) {
+	f := New(30)
+	for _, i := range []int{1, 8, 9, 17, 29} {
+		f.Set(i)
+	}
+	if s := f.Slice(8, 18).Ranges(); s != "0-1,9" {
+		t.Errorf("aligned %s", s)
+	}
+	if s := f.Slice(8, 16); s.Len() != 8 || s.Ranges() != "0-1" {
+		t.Errorf("trim %s", s)
+	}
+	if s := f.Slice(1, 30).Ranges(); s != "0,7-8,16,28" {
+		t.Errorf("unaligned %s", s)
+	}
+	if f.Slice(5, 5).Len() != 0 {
+		t.Error("empty slice")
+	}
+}
+
+func TestFromBytes(t *testing.T) {
+	f, err := FromBytes([]byte{0xa0, 0x40}, 10)
+	if err != nil || f.Ranges() != "0,2,9" {
+		t.Errorf("%v %v", f, err)
+	}
+	if _, err := FromBytes([]byte{0xa0, 0x20}, 10); err != ErrSpareBits {
+		t.Errorf("spare bits: %v", err)
+	}
+	if _, err := FromBytes([]byte{0xa0}, 10); err != ErrLength {
+		t.Errorf("length: %v", err)
+	}
+	if f, err := FromBytes([]byte{0xff}, 8); err != nil || !f.All() {
+		t.Errorf("%v %v", f, err)
+	}
+}
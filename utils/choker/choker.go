@@ -0,0 +1,229 @@
+package choker
+
+//
+// choke算法：下载时tit-for-tat，做种时按配置的算法选择，
+// 另外定期轮换一个optimistic unchoke给新的peer机会
+//
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	Interval           = 10 * time.Second // 重新计算的周期
+	OptimisticInterval = 30 * time.Second // optimistic unchoke轮换的周期
+	DefaultSlots       = 4
+
+	// 连接时间不到这么久的peer，被选为optimistic的机会是其他peer的3倍
+	newPeerAge    = 3 * OptimisticInterval
+	newPeerWeight = 3
+)
+
+// 做种时的选择算法
+type Algorithm int
+
+const (
+	FastestUpload Algorithm = iota // 上传给对方最快的
+	AntiLeech                      // 刚开始或快完成的peer优先，不利于只下载不上传的
+	RoundRobin                     // 轮流
+)
+
+var algorithmNames = []string{"fastest-upload", "anti-leech", "round-robin"}
+
+func (a Algorithm) String() string {
+	if a >= 0 && int(a) < len(algorithmNames) {
+		return algorithmNames[a]
+	}
+	return fmt.Sprintf("algorithm(%d)", int(a))
+}
+
+// 解析配置，为空时使用fastest-upload
+func ParseAlgorithm(s string) (Algorithm, error) {
+	if s == "" {
+		return FastestUpload, nil
+	}
+	for i, name := range algorithmNames {
+		if strings.EqualFold(s, name) {
+			return Algorithm(i), nil
+		}
+	}
+	return FastestUpload, fmt.Errorf("choker: unknown algorithm %q", s)
+}
+
+// 计算时需要的peer状态
+type Peer struct {
+	Key        string
+	Interested bool      // 对方对我们感兴趣
+	Snubbed    bool      // 对方长时间不给我们数据
+	Download   float64   // 从对方下载的速度，字节/秒
+	Upload     float64   // 上传给对方的速度
+	Progress   float64   // 对方的完成比例，0到1
+	Connected  time.Time // 连接建立的时间
+}
+
+type Choker struct {
+	Slots     int // 包括optimistic unchoke
+	Algorithm Algorithm
+
+	optimistic     string
+	lastOptimistic time.Time
+	unchokedSince  map[string]time.Time // round-robin使用
+	lastUnchoked   map[string]time.Time
+}
+
+func New(slots int, algorithm Algorithm) *Choker {
+	if slots <= 0 {
+		slots = DefaultSlots
+	}
+	return &Choker{
+		Slots:         slots,
+		Algorithm:     algorithm,
+		unchokedSince: make(map[string]time.Time),
+		lastUnchoked:  make(map[string]time.Time),
+	}
+}
+
+// 当前的optimistic unchoke
+func (c *Choker) Optimistic() string {
+	return c.optimistic
+}
+
+// 重新计算，每Interval调用一次，返回应该unchoke的peer，其余的应该choke
+func (c *Choker) Update(now time.Time, peers []Peer, seeding bool) []string {
+	var list []Peer
+	for _, p := range peers {
+		if p.Interested && (seeding || !p.Snubbed) {
+			list = append(list, p)
+		}
+	}
+	// 相同速度的peer随机排列
+	rand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+
+	switch {
+	case !seeding:
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Download > list[j].Download })
+	case c.Algorithm == FastestUpload:
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Upload > list[j].Upload })
+	case c.Algorithm == AntiLeech:
+		sort.SliceStable(list, func(i, j int) bool { return antiLeech(list[i]) > antiLeech(list[j]) })
+	case c.Algorithm == RoundRobin:
+		c.roundRobin(now, list)
+	}
+
+	regular := c.Slots - 1
+	if regular < 1 {
+		regular = 1
+	}
+	if regular > len(list) {
+		regular = len(list)
+	}
+	unchoked := make(map[string]bool)
+	var result []string
+	for _, p := range list[:regular] {
+		unchoked[p.Key] = true
+		result = append(result, p.Key)
+	}
+
+	// optimistic不再感兴趣、断开或进入正常名额时立即换一个
+	rest := list[regular:]
+	valid := false
+	for _, p := range rest {
+		if p.Key == c.optimistic {
+			valid = true
+		}
+	}
+	if !valid || now.Sub(c.lastOptimistic) >= OptimisticInterval {
+		c.optimistic = pickOptimistic(now, rest)
+		c.lastOptimistic = now
+	}
+	if c.optimistic != "" {
+		unchoked[c.optimistic] = true
+		result = append(result, c.optimistic)
+	}
+
+	// 只记录正常名额的unchoke时间，optimistic不会因此留在正常名额中
+	for key := range c.unchokedSince {
+		if !contains(result[:regular], key) {
+			delete(c.unchokedSince, key)
+		}
+	}
+	for _, key := range result[:regular] {
+		if _, ok := c.unchokedSince[key]; !ok {
+			c.unchokedSince[key] = now
+		}
+	}
+	for key := range unchoked {
+		c.lastUnchoked[key] = now
+	}
+	return result
+}
+
+func contains(list []string, key string) bool {
+	for _, k := range list {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// 完成比例离一半越远分数越高
+func antiLeech(p Peer) float64 {
+	d := p.Progress - 0.5
+	if d < 0 {
+		d = -d
+	}
+	return d
+}
+
+// unchoke不到一个轮换周期的保持，其他按上次unchoke的时间先后轮流
+func (c *Choker) roundRobin(now time.Time, list []Peer) {
+	keep := func(p Peer) bool {
+		since, ok := c.unchokedSince[p.Key]
+		return ok && now.Sub(since) < OptimisticInterval
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		ki, kj := keep(list[i]), keep(list[j])
+		if ki != kj {
+			return ki
+		}
+		return c.lastUnchoked[list[i].Key].Before(c.lastUnchoked[list[j].Key])
+	})
+}
+
+// 按权重随机选择，新连接的peer权重更高
+func pickOptimistic(now time.Time, list []Peer) string {
+	total := 0
+	weight := func(p Peer) int {
+		if now.Sub(p.Connected) < newPeerAge {
+			return newPeerWeight
+		}
+		return 1
+	}
+	for _, p := range list {
+		total += weight(p)
+	}
+	if total == 0 {
+		return ""
+	}
+	n := rand.Intn(total)
+	for _, p := range list {
+		if n -= weight(p); n < 0 {
+			return p.Key
+		}
+	}
+	return ""
+}
+
+// 忘记断开的peer
+func (c *Choker) Remove(key string) {
+	delete(c.unchokedSince, key)
+	delete(c.lastUnchoked, key)
+	if c.optimistic == key {
+		c.optimistic = ""
+	}
+}
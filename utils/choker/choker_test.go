@@ -0,0 +1,118 @@
+package choker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func swarm(n int, connected time.Time) []Peer {
+	peers := make([]Peer, n)
+	for i := range peers {
+		peers[i] = Peer{
+			Key:        fmt.Sprint(i),
+			Interested: true,
+			Download:   float64(i * 1000),
+			Upload:     float64((n - i) * 1000),
+			Progress:   float64(i) / float64(n-1),
+			Connected:  connected,
+		}
+	}
+	return peers
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, a := range []Algorithm{FastestUpload, AntiLeech, RoundRobin} {
+		if b, err := ParseAlgorithm(a.String()); err != nil || a != b {
+			t.Errorf("%v: %v %v", a, b, err)
+		}
+	}
+	if _, err := ParseAlgorithm("nope"); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
+
+func TestTitForTat(t *testing.T) {
+	now := time.Now()
+	peers := swarm(10, now.Add(-time.Hour))
+	peers[9].Snubbed = true
+	peers[0].Interested = false
+
+	c := New(4, FastestUpload)
+	got := c.Update(now, peers, false)
+	if len(got) != 4 {
+		t.Fatalf("unchoked %v", got)
+	}
+	for _, key := range []string{"8", "7", "6"} {
+		if !contains(got[:3], key) {
+			t.Errorf("best uploader %s choked: %v", key, got)
+		}
+	}
+	opt := c.Optimistic()
+	if opt == "" || opt == "0" || opt == "9" || contains(got[:3], opt) {
+		t.Errorf("optimistic %q", opt)
+	}
+
+	// 30秒内optimistic不变，之后轮换
+	if c.Update(now.Add(Interval), peers, false); c.Optimistic() != opt {
+		t.Error("optimistic rotated too early")
+	}
+	changed := false
+	for i := 1; i < 20 && !changed; i++ {
+		c.Update(now.Add(time.Duration(i)*OptimisticInterval), peers, false)
+		changed = c.Optimistic() != opt
+	}
+	if !changed {
+		t.Error("optimistic never rotated")
+	}
+
+	c.Remove(c.Optimistic())
+	if c.Optimistic() != "" {
+		t.Error("removed peer still optimistic")
+	}
+}
+
+func TestNewPeerWeight(t *testing.T) {
+	now := time.Now()
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		peers := swarm(5, now.Add(-time.Hour))
+		peers[0].Connected = now
+		c := New(2, FastestUpload)
+		c.Update(now, peers, false)
+		counts[c.Optimistic()]++
+	}
+	// 4个候选，新peer的权重为3，期望约一半
+	if counts["0"] < 700 || counts["0"] > 1300 {
+		t.Errorf("new peer chosen %d of 2000", counts["0"])
+	}
+}
+
+func TestSeeding(t *testing.T) {
+	now := time.Now()
+	peers := swarm(10, now.Add(-time.Hour))
+
+	got := New(4, FastestUpload).Update(now, peers, true)
+	for _, key := range []string{"0", "1", "2"} {
+		if !contains(got, key) {
+			t.Errorf("fastest-upload: %s choked: %v", key, got)
+		}
+	}
+
+	got = New(3, AntiLeech).Update(now, peers, true)
+	if !contains(got[:2], "0") || !contains(got[:2], "9") {
+		t.Errorf("anti-leech: %v", got)
+	}
+
+	// round-robin使所有peer轮流得到名额
+	c := New(3, RoundRobin)
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		for _, key := range c.Update(now.Add(time.Duration(i)*Interval), peers, true) {
+			seen[key] = true
+		}
+	}
+	if len(seen) != len(peers) {
+		t.Errorf("round-robin unchoked only %v", seen)
+	}
+}
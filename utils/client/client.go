@@ -0,0 +1,258 @@
+package client
+
+//
+// BitTorrent客户端：监听端口、接受连接并分发给对应的种子
+//
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/choker"
+	"github.com/openqt/whonet/utils/connmgr"
+	"github.com/openqt/whonet/utils/mse"
+	"github.com/openqt/whonet/utils/network"
+	"github.com/openqt/whonet/utils/peer"
+	"github.com/openqt/whonet/utils/ratelimit"
+	"github.com/openqt/whonet/utils/storage"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/utp"
+	"github.com/spf13/afero"
+)
+
+var LOG = utils.GetLogger()
+
+const (
+	DefaultMaxPeers  = 50
+	HandshakeTimeout = 20 * time.Second
+)
+
+type Config struct {
+	PeerId      [20]byte
+	Listen      string         // 监听地址，为空时不接受连接
+	TCP         network.Dialer // 主动连接使用的TCP Dialer，为nil时直接连接
+	Transport   utp.Preference
+	Encryption  mse.Policy
+	MaxPeers    int           // 每个种子的最大连接数
+	MaxConns    int           // 所有种子合计的最大连接数
+	MaxHalfOpen int           // 同时进行中的主动连接数
+	KeepAlive   time.Duration // 这么久没有发送消息时发送keep-alive
+	Inactive    time.Duration // 这么久没有收到消息时断开
+	UploadSlots int
+	Choker      choker.Algorithm
+	Allocation  storage.Allocation // 创建文件时分配空间的方式
+	Fs          afero.Fs           // 保存数据的文件系统，为nil时使用本地文件
+	Limits      Limits             // 带宽限制，运行中用SetLimits修改
+}
+
+type Client struct {
+	Config
+
+	listener *utp.Listener
+	dialer   *utp.Dialer
+	conns    *connmgr.Manager
+	global   *ratelimit.Pair // 非局域网peer合计
+	local    *ratelimit.Pair // 局域网peer合计
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func New(cfg Config) (*Client, error) {
+	if cfg.PeerId == ([20]byte{}) {
+		copy(cfg.PeerId[:], utils.NewPeerId())
+	}
+	if cfg.Fs == nil {
+		cfg.Fs = afero.NewOsFs()
+	}
+	if cfg.MaxPeers <= 0 {
+		cfg.MaxPeers = DefaultMaxPeers
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = KeepAliveInterval
+	}
+	if cfg.Inactive <= 0 {
+		cfg.Inactive = InactiveTimeout
+	}
+	c := &Client{
+		Config:   cfg,
+		torrents: make(map[[20]byte]*Torrent),
+		closed:   make(chan struct{}),
+		conns:    connmgr.New(cfg.MaxConns, cfg.MaxHalfOpen),
+		global:   ratelimit.NewPair(cfg.Limits.Upload, cfg.Limits.Download),
+		local:    ratelimit.NewPair(cfg.Limits.LocalUpload, cfg.Limits.LocalDownload),
+	}
+
+	d := &utp.Dialer{TCP: cfg.TCP, Preference: cfg.Transport}
+	if cfg.Listen != "" {
+		l, err := utp.ListenBoth(cfg.Listen)
+		if err != nil {
+			return nil, err
+		}
+		c.listener = l
+		d.Socket = l.UTP
+		go c.acceptLoop()
+	}
+	c.dialer = d
+	return c, nil
+}
+
+// 监听的端口，没有监听时为0
+func (c *Client) Port() int {
+	if c.listener == nil {
+		return 0
+	}
+	return c.listener.Addr().(*net.TCPAddr).Port
+}
+
+// 加入种子，之后用Verify或Trust检查dir中已有的数据
+func (c *Client) Add(t *torrent.TorrentStruct, dir string) (*Torrent, error) {
+	tt, err := newTorrent(c, t, dir)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.torrents[tt.InfoHash] = tt
+	c.mu.Unlock()
+	return tt, nil
+}
+
+func (c *Client) remove(t *Torrent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.torrents[t.InfoHash] == t {
+		delete(c.torrents, t.InfoHash)
+	}
+}
+
+func (c *Client) get(infoHash [20]byte) *Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.torrents[infoHash]
+}
+
+// 停止所有种子并关闭端口
+func (c *Client) Close() {
+	c.once.Do(func() {
+		close(c.closed)
+		if c.listener != nil {
+			c.listener.Close()
+		}
+		c.mu.Lock()
+		var list []*Torrent
+		for _, t := range c.torrents {
+			list = append(list, t)
+		}
+		c.mu.Unlock()
+		for _, t := range list {
+			t.Stop()
+		}
+	})
+}
+
+// 按PEX得到的标志调整主动连接的方式：对方支持uTP时优先uTP，支持加密时先尝试加密
+func (c *Client) dialOptions(flags byte) (network.Dialer, mse.Policy) {
+	d := *c.dialer
+	if flags&peer.PexUTP != 0 && d.Preference == utp.PreferTCP {
+		d.Preference = utp.PreferUTP
+	}
+	policy := c.Encryption
+	if flags&peer.PexEncryption != 0 && policy == mse.Enabled {
+		policy = mse.Preferred
+	}
+	return &d, policy
+}
+
+// 当前的连接数和正在进行的主动连接数
+func (c *Client) Conns() (conns, halfOpen int) {
+	return c.conns.Count()
+}
+
+// ban一个IP，断开所有种子中与它的连接
+func (c *Client) Ban(ip net.IP) {
+	LOG.Infof("Ban %s", ip)
+	c.conns.Ban(ip, connmgr.BanDuration)
+	c.mu.Lock()
+	var list []*Torrent
+	for _, t := range c.torrents {
+		list = append(list, t)
+	}
+	c.mu.Unlock()
+	for _, t := range list {
+		t.mu.Lock()
+		for _, pc := range t.peers {
+			if pc.ip.Equal(ip) {
+				pc.Close()
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (c *Client) Banned(ip net.IP) bool {
+	return c.conns.Banned(ip)
+}
+
+func (c *Client) acceptLoop() {
+	for {
+		nc, err := c.listener.Accept()
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				LOG.Warnf("Accept: %v", err)
+			}
+			return
+		}
+		go c.handle(nc)
+	}
+}
+
+// 加密握手中根据req2找到对应的种子
+func (c *Client) lookup(req2 [20]byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hash := range c.torrents {
+		if mse.Req2(hash[:]) == req2 {
+			return append([]byte(nil), hash[:]...)
+		}
+	}
+	return nil
+}
+
+func (c *Client) handle(nc net.Conn) {
+	if c.conns.Banned(hostIP(nc.RemoteAddr().String())) || !c.conns.Accept() {
+		nc.Close()
+		return
+	}
+	defer c.conns.Closed()
+	nc.SetDeadline(time.Now().Add(HandshakeTimeout))
+	mc, err := mse.Accept(nc, c.lookup, c.Encryption)
+	if err != nil {
+		LOG.Debugf("Incoming %s: %v", nc.RemoteAddr(), err)
+		nc.Close()
+		return
+	}
+	pc := peer.NewConn(mc)
+	h, err := pc.ReadHandshake()
+	if err != nil {
+		nc.Close()
+		return
+	}
+	t := c.get(h.InfoHash)
+	if t == nil {
+		LOG.Debugf("Incoming %s: unknown info hash %X", nc.RemoteAddr(), h.InfoHash)
+		nc.Close()
+		return
+	}
+	if err := pc.WriteHandshake(t.handshake()); err != nil {
+		nc.Close()
+		return
+	}
+	nc.SetDeadline(time.Time{})
+	t.run(pc, nc.RemoteAddr().String(), h, false)
+}
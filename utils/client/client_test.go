@@ -0,0 +1,707 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/bitfield"
+	"github.com/openqt/whonet/utils/choker"
+	"github.com/openqt/whonet/utils/mse"
+	"github.com/openqt/whonet/utils/peer"
+	"github.com/openqt/whonet/utils/picker"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/tracker"
+	"github.com/openqt/whonet/utils/utp"
+	"github.com/spf13/afero"
+)
+
+// 按tests/中种子的文件布局生成随机数据
+func fixtureData(t *testing.T, fixture, dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join("../../tests", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := torrent.NewTorrent(data).Info
+	write := func(path string, n int64) {
+		b := make([]byte, n)
+		rand.Read(b)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(dir, info.Name)
+	if info.Length != nil {
+		write(root, *info.Length)
+	}
+	for _, f := range info.Files {
+		write(filepath.Join(append([]string{root}, f.Path...)...), f.Length)
+	}
+	return root
+}
+
+func newTestClient(t *testing.T, policy mse.Policy, transport utp.Preference) *Client {
+	c, err := New(Config{Listen: "127.0.0.1:0", Encryption: policy, Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// 本地tracker、做种和下载，检查下载的文件与原始数据相同
+func downloadFrom(t *testing.T, root string, pieceLength int64, policy mse.Policy, transport utp.Preference) {
+	ts := httptest.NewServer(tracker.NewServer(time.Minute, time.Second))
+	defer ts.Close()
+
+	meta, err := torrent.Create(root, pieceLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Announce = ts.URL + "/announce"
+	// 重新解析，与从文件读取的种子相同
+	meta = torrent.NewTorrent([]byte(bencode.NewEncoder().Encode(meta.ToMap())))
+
+	seeder := newTestClient(t, policy, transport)
+	defer seeder.Close()
+	st, err := seeder.Add(meta, filepath.Dir(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Verify()
+	select {
+	case <-st.Done():
+	default:
+		t.Fatal("seeder data not verified")
+	}
+	st.Start()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, _ := st.Announcer().Last(); resp != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("seeder did not announce")
+		}
+	}
+
+	out, err := ioutil.TempDir("", "whonet-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	leecher := newTestClient(t, policy, transport)
+	defer leecher.Close()
+	lt, err := leecher.Add(meta, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.Verify()
+	if lt.Stats().Have != 0 {
+		t.Fatal("leecher has data")
+	}
+	lt.Start()
+
+	select {
+	case <-lt.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("download timeout: %+v", lt.Stats())
+	}
+	if s := lt.Stats(); s.Left != 0 || s.Downloaded < meta.Info.TotalLength() {
+		t.Errorf("stats %+v", s)
+	}
+
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(filepath.Dir(root), path)
+		want, _ := ioutil.ReadFile(path)
+		got, err := ioutil.ReadFile(filepath.Join(out, rel))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s differs: %v", rel, err)
+		}
+		return nil
+	})
+}
+
+func TestDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whonet-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := fixtureData(t, "puppy.torrent", dir)
+	downloadFrom(t, root, 16384, mse.Preferred, utp.OnlyTCP)
+}
+
+func TestDownloadMultiFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whonet-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 多个文件，piece跨越文件边界
+	root := filepath.Join(dir, "multi")
+	for i, n := range []int{100000, 1, 40000, 0, 70000} {
+		b := make([]byte, n)
+		rand.Read(b)
+		path := filepath.Join(root, "sub", string(rune('a'+i)))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, b, 0644)
+	}
+	downloadFrom(t, root, 32768, mse.Required, utp.OnlyUTP)
+}
+
+// 随机内容的文件
+func memFiles(sizes ...int) [][]byte {
+	var files [][]byte
+	for _, n := range sizes {
+		b := make([]byte, n)
+		rand.Read(b)
+		files = append(files, b)
+	}
+	return files
+}
+
+// 多文件种子，文件名依次为a、b、c...
+func memMeta(name string, pieceLength int, files [][]byte) *torrent.TorrentStruct {
+	meta := &torrent.TorrentStruct{Info: torrent.InfoStruct{Name: name, PieceLength: int64(pieceLength)}}
+	var data []byte
+	for i, b := range files {
+		data = append(data, b...)
+		meta.Info.Files = append(meta.Info.Files, torrent.FileStruct{Length: int64(len(b)), Path: []string{string(rune('a' + i))}})
+	}
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[i:end])
+		meta.Info.Pieces.O += string(h[:])
+	}
+	return torrent.NewTorrent([]byte(bencode.NewEncoder().Encode(meta.ToMap())))
+}
+
+// 做种和下载都在内存中，不使用本地文件
+func TestDownloadMemory(t *testing.T) {
+	ts := httptest.NewServer(tracker.NewServer(time.Minute, time.Second))
+	defer ts.Close()
+
+	data := make([]byte, 300000)
+	rand.Read(data)
+	length := int64(len(data))
+	meta := &torrent.TorrentStruct{
+		Announce: ts.URL + "/announce",
+		Info:     torrent.InfoStruct{Name: "memory", PieceLength: 32768, Length: &length},
+	}
+	for i := 0; i < len(data); i += 32768 {
+		end := i + 32768
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[i:end])
+		meta.Info.Pieces.O += string(h[:])
+	}
+	meta = torrent.NewTorrent([]byte(bencode.NewEncoder().Encode(meta.ToMap())))
+
+	src := afero.NewMemMapFs()
+	afero.WriteFile(src, "/seed/memory", data, 0644)
+	seeder, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: afero.NewReadOnlyFs(src)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	st, err := seeder.Add(meta, "/seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Trust(); err != nil {
+		t.Fatal(err)
+	}
+	st.Start()
+
+	dst := afero.NewMemMapFs()
+	leecher, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	lt, err := leecher.Add(meta, "/out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.AddPeers([]string{fmt.Sprintf("127.0.0.1:%d", seeder.Port())})
+	lt.Start()
+
+	select {
+	case <-lt.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("download timeout: %+v", lt.Stats())
+	}
+	lt.Stop()
+	if got, _ := afero.ReadFile(dst, "/out/memory"); !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+}
+
+func TestResume(t *testing.T) {
+	files := memFiles(40000, 30000)
+	a := files[0]
+	meta := memMeta("resume", 32768, files)
+
+	// 只有文件a，piece 1收到了第一块
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/data/resume/a", a, 0644)
+	open := func() (*Client, *Torrent) {
+		c, err := New(Config{Fs: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt, err := c.Add(meta, "/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, tt
+	}
+	c, tt := open()
+	tt.Verify()
+	blocks := bitfield.New(2)
+	blocks.Set(0)
+	tt.Picker.SetUnfinished(1, blocks)
+	c.Close()
+
+	c, tt = open()
+	if ok, err := tt.Resume(context.Background()); !ok || err != nil {
+		t.Fatalf("resume: %v %v", ok, err)
+	}
+	if s := tt.Stats(); s.Have != 1 || !tt.Picker.Have(0) {
+		t.Errorf("resumed %+v", s)
+	}
+	if u := tt.Picker.Unfinished(); len(u) != 1 || u[1] == nil || !u[1].Get(0) {
+		t.Errorf("unfinished %v", u)
+	}
+	c.Close()
+
+	// 修改过的文件重新校验
+	f, _ := fs.OpenFile("/data/resume/a", os.O_RDWR, 0)
+	f.WriteAt([]byte("x"), 0)
+	f.Close()
+	fs.Chtimes("/data/resume/a", time.Now(), time.Now().Add(time.Hour))
+	c, tt = open()
+	defer c.Close()
+	if ok, err := tt.Resume(context.Background()); !ok || err != nil {
+		t.Fatalf("resume: %v %v", ok, err)
+	}
+	if s := tt.Stats(); s.Have != 0 || len(tt.Picker.Unfinished()) != 0 {
+		t.Errorf("changed file not rechecked: %+v", s)
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	files := memFiles(50000, 100000, 60000)
+	meta := memMeta("select", 32768, files)
+	src := afero.NewMemMapFs()
+	for i, b := range files {
+		afero.WriteFile(src, "/seed/select/"+string(rune('a'+i)), b, 0644)
+	}
+	seeder, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	st, _ := seeder.Add(meta, "/seed")
+	st.Verify()
+	st.Start()
+
+	// 不下载b，它和a、c各共用一个piece
+	dst := afero.NewMemMapFs()
+	leecher, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	lt, _ := leecher.Add(meta, "/out")
+	if err := lt.SetFilePriority(1, picker.Skip); err != nil {
+		t.Fatal(err)
+	}
+	lt.Verify()
+	lt.AddPeers([]string{fmt.Sprintf("127.0.0.1:%d", seeder.Port())})
+	lt.Start()
+	select {
+	case <-lt.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("download timeout: %+v", lt.Stats())
+	}
+	if s := lt.Stats(); s.Selected != 110000 || s.Completed != s.Selected || s.Have == s.Pieces {
+		t.Errorf("stats %+v", s)
+	}
+	if ok, _ := afero.Exists(dst, "/out/select/b"); ok {
+		t.Error("skipped file created")
+	}
+	for _, i := range []int{0, 2} {
+		got, _ := afero.ReadFile(dst, "/out/select/"+string(rune('a'+i)))
+		if !bytes.Equal(got, files[i]) {
+			t.Errorf("file %d differs", i)
+		}
+	}
+
+	// 下载中重新选择b
+	if err := lt.SetFilePriority(1, picker.High); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if s := lt.Stats(); s.Have == s.Pieces {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("download timeout: %+v", lt.Stats())
+		}
+	}
+	lt.Stop()
+	if got, _ := afero.ReadFile(dst, "/out/select/b"); !bytes.Equal(got, files[1]) {
+		t.Error("file b differs")
+	}
+}
+
+// 取消选择剩下的文件时完成，重新选择后恢复未完成
+func TestSelectComplete(t *testing.T) {
+	ts := httptest.NewServer(tracker.NewServer(time.Minute, time.Second))
+	defer ts.Close()
+	announce := ts.URL + "/announce"
+
+	files := memFiles(65536, 30000)
+	meta := memMeta("complete", 32768, files)
+	meta.Announce = announce
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/data/complete/a", files[0], 0644)
+	c, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tt, _ := c.Add(meta, "/data")
+	tt.Verify()
+	tt.Start()
+	defer tt.Stop()
+
+	closed := func() bool {
+		select {
+		case <-tt.Done():
+			return true
+		default:
+			return false
+		}
+	}
+	if closed() {
+		t.Fatal("complete without file b")
+	}
+	waitFor(t, "started announce", func() bool {
+		resp, _ := tt.Announcer().Last()
+		return resp != nil
+	})
+	if err := tt.SetFilePriority(1, picker.Skip); err != nil {
+		t.Fatal(err)
+	}
+	if !closed() {
+		t.Error("not complete after skipping b")
+	}
+	waitFor(t, "completed announce", func() bool {
+		res, err := tracker.DefaultClient.Scrape(context.Background(), announce, []string{meta.InfoHash()})
+		return err == nil && res[meta.InfoHash()].Downloaded == 1
+	})
+
+	if err := tt.SetFilePriority(1, picker.Normal); err != nil {
+		t.Fatal(err)
+	}
+	if closed() {
+		t.Error("still complete after selecting b")
+	}
+	if _, _, left := tt.Announcer().Stats(); left != 30000 {
+		t.Errorf("left %d", left)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	files := memFiles(300000)
+	meta := memMeta("limit", 32768, files)
+	src := afero.NewMemMapFs()
+	afero.WriteFile(src, "/seed/limit/a", files[0], 0644)
+	// 本地连接使用局域网限制，全局限制不起作用
+	seeder, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: src,
+		Limits: Limits{Upload: 1, LocalUpload: 150000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	st, _ := seeder.Add(meta, "/seed")
+	st.Trust()
+	st.Start()
+
+	leecher, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: afero.NewMemMapFs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	lt, _ := leecher.Add(meta, "/out")
+	lt.AddPeers([]string{fmt.Sprintf("127.0.0.1:%d", seeder.Port())})
+	start := time.Now()
+	lt.Start()
+	select {
+	case <-lt.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("download timeout: %+v", lt.Stats())
+	}
+	// 除去一秒的突发，剩下的150000字节至少需要一秒
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("downloaded in %v", elapsed)
+	}
+}
+
+// 等待条件满足
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSmartBan(t *testing.T) {
+	files := memFiles(200000)
+	meta := memMeta("ban", 32768, files)
+	// 做种方的数据全部是错的
+	src := afero.NewMemMapFs()
+	afero.WriteFile(src, "/seed/ban/a", make([]byte, 200000), 0644)
+	seeder, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	st, _ := seeder.Add(meta, "/seed")
+	st.Trust()
+	st.Start()
+
+	leecher, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: afero.NewMemMapFs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	lt, _ := leecher.Add(meta, "/out")
+	lt.AddPeers([]string{fmt.Sprintf("127.0.0.1:%d", seeder.Port())})
+	lt.Start()
+
+	ip := net.ParseIP("127.0.0.1")
+	waitFor(t, "ban", func() bool { return leecher.Banned(ip) && lt.Stats().Peers == 0 })
+	if s := lt.Stats(); s.Have != 0 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	meta := memMeta("conns", 32768, memFiles(1000))
+	a, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: afero.NewMemMapFs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: afero.NewMemMapFs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ta, _ := a.Add(meta, "/a")
+	tb, _ := b.Add(meta, "/b")
+	addrA := fmt.Sprintf("127.0.0.1:%d", a.Port())
+	addrB := fmt.Sprintf("127.0.0.1:%d", b.Port())
+
+	// 连接到自己的地址不再使用
+	ta.AddPeers([]string{addrA})
+	waitFor(t, "self connection", func() bool {
+		conns, half := a.Conns()
+		return conns == 0 && half == 0
+	})
+	ta.mu.Lock()
+	addrs := ta.book.Addrs()
+	ta.mu.Unlock()
+	if len(addrs) != 0 {
+		t.Errorf("self address kept: %v", addrs)
+	}
+
+	// 双方同时连接，只保留一个连接
+	ta.AddPeers([]string{addrB})
+	tb.AddPeers([]string{addrA})
+	waitFor(t, "duplicate connection", func() bool {
+		ca, _ := a.Conns()
+		cb, _ := b.Conns()
+		return ca == 1 && cb == 1 && ta.Stats().Peers == 1 && tb.Stats().Peers == 1
+	})
+}
+
+func TestPexFlags(t *testing.T) {
+	meta := memMeta("flags", 32768, memFiles(1000))
+	src := afero.NewMemMapFs()
+	afero.WriteFile(src, "/seed/flags/a", memFiles(1000)[0], 0644)
+	seeder, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	st, _ := seeder.Add(meta, "/seed")
+	st.Trust()
+
+	leecher, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: afero.NewMemMapFs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	lt, _ := leecher.Add(meta, "/out")
+	lt.AddPeers([]string{fmt.Sprintf("127.0.0.1:%d", seeder.Port())})
+	lt.Start()
+
+	// 主动连上的做种方
+	waitFor(t, "seed flags", func() bool {
+		lt.mu.Lock()
+		defer lt.mu.Unlock()
+		for _, pc := range lt.peers {
+			if pc.listen != nil && pc.listen.Flags == peer.PexReachable|peer.PexSeed {
+				return true
+			}
+		}
+		return false
+	})
+
+	// 收到的标志影响连接方式
+	c := newTestClient(t, mse.Enabled, utp.PreferTCP)
+	defer c.Close()
+	d, policy := c.dialOptions(peer.PexUTP | peer.PexEncryption)
+	if d.(*utp.Dialer).Preference != utp.PreferUTP || policy != mse.Preferred {
+		t.Errorf("dial options %v %v", d.(*utp.Dialer).Preference, policy)
+	}
+	if d, policy := c.dialOptions(0); d.(*utp.Dialer).Preference != utp.PreferTCP || policy != mse.Enabled {
+		t.Errorf("dial options without flags %v %v", d.(*utp.Dialer).Preference, policy)
+	}
+}
+
+func TestSetChoker(t *testing.T) {
+	c, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, UploadSlots: 8, Fs: afero.NewMemMapFs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tt, _ := c.Add(memMeta("choker", 32768, memFiles(1000)), "/data")
+	if tt.choker.Slots != 8 || tt.choker.Algorithm != choker.FastestUpload {
+		t.Errorf("client defaults %+v", tt.choker)
+	}
+	tt.SetChoker(2, choker.RoundRobin)
+	if tt.choker.Slots != 2 || tt.choker.Algorithm != choker.RoundRobin {
+		t.Errorf("choker %+v", tt.choker)
+	}
+	tt.SetChoker(0, choker.AntiLeech)
+	if tt.choker.Slots != choker.DefaultSlots || tt.choker.Algorithm != choker.AntiLeech {
+		t.Errorf("default slots %+v", tt.choker)
+	}
+}
+
+func TestAllowedFast(t *testing.T) {
+	files := memFiles(20 * 16384)
+	meta := memMeta("fast", 16384, files)
+	src := afero.NewMemMapFs()
+	afero.WriteFile(src, "/seed/fast/a", files[0], 0644)
+	seeder, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	st, _ := seeder.Add(meta, "/seed")
+	st.Trust()
+	// 没有unchoke的名额，也不运行choker
+	st.choker.Slots = 0
+
+	leecher, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: afero.NewMemMapFs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	lt, _ := leecher.Add(meta, "/out")
+	lt.AddPeers([]string{fmt.Sprintf("127.0.0.1:%d", seeder.Port())})
+	lt.Start()
+
+	set := peer.AllowedFastSet(peer.AllowedFastCount, net.ParseIP("127.0.0.1"), lt.InfoHash, 20)
+	waitFor(t, "allowed fast pieces", func() bool { return lt.Stats().Have == len(set) })
+	for _, i := range set {
+		if !lt.Picker.Have(int(i)) {
+			t.Errorf("allowed fast piece %d not downloaded", i)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s := lt.Stats(); s.Have != len(set) {
+		t.Errorf("downloaded %d pieces while choked", s.Have)
+	}
+}
+
+func TestRequestBounds(t *testing.T) {
+	files := memFiles(40000)
+	meta := memMeta("bounds", 32768, files)
+	src := afero.NewMemMapFs()
+	afero.WriteFile(src, "/seed/bounds/a", files[0], 0644)
+	seeder, err := New(Config{Listen: "127.0.0.1:0", Transport: utp.OnlyTCP, Fs: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	st, _ := seeder.Add(meta, "/seed")
+	st.Trust()
+
+	nc, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", seeder.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	c := peer.NewConn(nc)
+	h := &peer.Handshake{InfoHash: st.InfoHash}
+	copy(h.PeerId[:], "-XX0000-boundscheck1")
+	h.Reserved.Set(peer.BitFast)
+	if _, err := c.Handshake(h); err != nil {
+		t.Fatal(err)
+	}
+	// 有空闲名额时感兴趣后立即unchoke
+	if err := c.WriteMessage(&peer.Message{Id: peer.MsgInterested}); err != nil {
+		t.Fatal(err)
+	}
+	// Begin+Length在uint32中回绕
+	bad := &peer.Message{Id: peer.MsgRequest, Index: 0, Begin: 0xFFFFFFF0, Length: 0x10}
+	for {
+		m, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch m.Id {
+		case peer.MsgUnchoke:
+			if err := c.WriteMessage(bad); err != nil {
+				t.Fatal(err)
+			}
+		case peer.MsgPiece:
+			t.Fatal("out of range request served")
+		case peer.MsgReject:
+			if m.Begin != bad.Begin || m.Length != bad.Length {
+				t.Errorf("reject %+v", m)
+			}
+			return
+		}
+	}
+}
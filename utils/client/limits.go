@@ -0,0 +1,89 @@
+package client
+
+//
+// 带宽限制：全局、种子和peer三级，局域网的peer使用单独的限制代替全局限制
+//
+
+import (
+	"net"
+
+	"github.com/openqt/whonet/utils/peer"
+	"github.com/openqt/whonet/utils/ratelimit"
+)
+
+// 速度都是字节/秒，0表示不限制
+type Limits struct {
+	Upload, Download           int64 // 所有种子合计
+	LocalUpload, LocalDownload int64 // 局域网peer合计，不计入全局限制
+	PeerUpload, PeerDownload   int64 // 每个peer
+	CountOverhead              bool  // 协议消息也计入，否则只计算piece数据
+}
+
+// 回环、私有和链路本地地址
+func isLocal(ip net.IP) bool {
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// 运行中修改限制，对已有的连接也生效
+func (c *Client) SetLimits(l Limits) {
+	c.mu.Lock()
+	c.Limits = l
+	c.global.Set(l.Upload, l.Download)
+	c.local.Set(l.LocalUpload, l.LocalDownload)
+	var list []*Torrent
+	for _, t := range c.torrents {
+		list = append(list, t)
+	}
+	c.mu.Unlock()
+
+	for _, t := range list {
+		t.mu.Lock()
+		for _, pc := range t.peers {
+			pc.limit.Set(l.PeerUpload, l.PeerDownload)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (c *Client) limits() Limits {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Limits
+}
+
+// 设置这个种子的速度限制，0表示不限制
+func (t *Torrent) SetRateLimit(up, down int64) {
+	t.limit.Set(up, down)
+}
+
+func (t *Torrent) RateLimit() (up, down int64) {
+	return t.limit.Up.Rate(), t.limit.Down.Rate()
+}
+
+// 消息计入限制的字节数
+func (pc *peerConn) cost(m *peer.Message) int {
+	if pc.t.client.limits().CountOverhead {
+		return m.WireSize()
+	}
+	if m.Id == peer.MsgPiece {
+		return len(m.Block)
+	}
+	return 0
+}
+
+// 按各级限制等待，连接关闭时返回false
+func (pc *peerConn) throttle(m *peer.Message, up bool) bool {
+	n := pc.cost(m)
+	if n == 0 {
+		return true
+	}
+	c, t := pc.t.client, pc.t
+	outer := c.global
+	if pc.local {
+		outer = c.local
+	}
+	if up {
+		return ratelimit.Wait(pc.closed, n, outer.Up, t.limit.Up, pc.limit.Up)
+	}
+	return ratelimit.Wait(pc.closed, n, outer.Down, t.limit.Down, pc.limit.Down)
+}
@@ -0,0 +1,435 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils/bitfield"
+	"github.com/openqt/whonet/utils/mse"
+	"github.com/openqt/whonet/utils/peer"
+	"github.com/openqt/whonet/utils/picker"
+	"github.com/openqt/whonet/utils/ratelimit"
+	"github.com/openqt/whonet/utils/utp"
+)
+
+var errBadIndex = errors.New("client: piece index out of range")
+
+// 地址中的IP
+func hostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// 与一个peer的连接状态，除发送队列外都由Torrent.mu保护
+type peerConn struct {
+	*peer.Conn
+	t        *Torrent
+	addr     string
+	ip       net.IP
+	id       [20]byte
+	outgoing bool     // 我们主动连接的
+	aliases  []string // 地址簿中属于这个peer的地址
+	ext      *peer.Extended
+	listen   *peer.PexPeer // 对方的监听地址，用于PEX
+	has      *bitfield.Bitfield
+	pipeline *peer.Pipeline
+	uploads  *peer.Uploads      // 对方的请求，由uploadLoop读取数据发送
+	allowed  *bitfield.Bitfield // 对方允许我们在choke时请求的piece
+	suggest  *bitfield.Bitfield // 对方建议我们下载的piece
+	local    bool               // 局域网peer，不受全局限制
+	limit    *ratelimit.Pair    // 这个peer的限制
+
+	amChoking, amInterested     bool
+	peerChoking, peerInterested bool
+
+	connected            time.Time
+	downloaded, uploaded int64
+	lastDown, lastUp     int64
+	lastRate             time.Time
+	downRate, upRate     float64
+
+	// 发送队列，由writeLoop写出，避免持有锁时阻塞在网络上
+	qmu    sync.Mutex
+	queue  []*peer.Message
+	pieces int // 已经读盘还没有写出的piece消息
+	wake   chan struct{}
+	upWake chan struct{}
+	sent   chan struct{} // 写出了一个piece消息
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPeerConn(t *Torrent, c *peer.Conn, addr string, h *peer.Handshake) *peerConn {
+	now := time.Now()
+	l := t.client.limits()
+	ip := hostIP(addr)
+	n := t.Picker.NumPieces()
+	fast := c.Supports(peer.BitFast)
+	return &peerConn{
+		Conn:        c,
+		t:           t,
+		addr:        addr,
+		ip:          ip,
+		id:          h.PeerId,
+		has:         bitfield.New(n),
+		pipeline:    peer.NewPipeline(0, fast),
+		uploads:     peer.NewUploads(fast),
+		allowed:     bitfield.New(n),
+		suggest:     bitfield.New(n),
+		local:       isLocal(ip),
+		limit:       ratelimit.NewPair(l.PeerUpload, l.PeerDownload),
+		amChoking:   true,
+		peerChoking: true,
+		connected:   now,
+		lastRate:    now,
+		wake:        make(chan struct{}, 1),
+		upWake:      make(chan struct{}, 1),
+		sent:        make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (pc *peerConn) Close() error {
+	pc.once.Do(func() {
+		close(pc.closed)
+		pc.Conn.Close()
+	})
+	return nil
+}
+
+func (pc *peerConn) send(m *peer.Message) {
+	pc.qmu.Lock()
+	pc.queue = append(pc.queue, m)
+	if m.Id == peer.MsgPiece {
+		pc.pieces++
+	}
+	pc.qmu.Unlock()
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (pc *peerConn) writeLoop() {
+	for {
+		select {
+		case <-pc.closed:
+			return
+		case <-pc.wake:
+		}
+		pc.qmu.Lock()
+		queue := pc.queue
+		pc.queue = nil
+		pc.qmu.Unlock()
+		for _, m := range queue {
+			if !pc.throttle(m, true) {
+				return
+			}
+			if err := pc.WriteMessage(m); err != nil {
+				pc.Close()
+				return
+			}
+			if m.Id == peer.MsgPiece {
+				pc.pieceSent(len(m.Block))
+			}
+		}
+	}
+}
+
+// piece写出后才计入上传量，并让uploadLoop继续读盘
+func (pc *peerConn) pieceSent(n int) {
+	pc.qmu.Lock()
+	pc.pieces--
+	pc.qmu.Unlock()
+	select {
+	case pc.sent <- struct{}{}:
+	default:
+	}
+
+	t := pc.t
+	t.mu.Lock()
+	pc.uploaded += int64(n)
+	t.uploaded += int64(n)
+	if t.announcer != nil {
+		t.announcer.AddUploaded(int64(n))
+	}
+	t.mu.Unlock()
+}
+
+// 等待发送队列中的piece消息少于uploadWatermark，连接关闭时返回false
+func (pc *peerConn) waitSent() bool {
+	for {
+		pc.qmu.Lock()
+		n := pc.pieces
+		pc.qmu.Unlock()
+		if n < uploadWatermark {
+			return true
+		}
+		select {
+		case <-pc.closed:
+			return false
+		case <-pc.sent:
+		}
+	}
+}
+
+// 连接本身决定的PEX标志：经过MSE握手、使用uTP、我们能主动连上对方
+func connFlags(c *peer.Conn, outgoing bool) byte {
+	var f byte
+	nc := c.Conn
+	if mc, ok := nc.(*mse.Conn); ok {
+		if mc.Selected != 0 {
+			f |= peer.PexEncryption
+		}
+		nc = mc.Conn
+	}
+	if _, ok := nc.(*utp.Conn); ok {
+		f |= peer.PexUTP
+	}
+	if outgoing {
+		f |= peer.PexReachable
+	}
+	return f
+}
+
+// 记录对方的监听端口，通过PEX告诉其他peer，调用时持有Torrent.mu
+func (pc *peerConn) setListen(port int) {
+	pc.listen = &peer.PexPeer{Flags: connFlags(pc.Conn, pc.outgoing)}
+	pc.listen.IP, pc.listen.Port = pc.ip, port
+	if pc.has.All() {
+		pc.listen.Flags |= peer.PexSeed
+	}
+	pc.t.pex.Connected(*pc.listen)
+}
+
+// 对方的请求加入队列后唤醒uploadLoop
+func (pc *peerConn) wakeUpload() {
+	select {
+	case pc.upWake <- struct{}{}:
+	default:
+	}
+}
+
+// 按队列读取对方请求的数据，读盘时不持有Torrent.mu
+func (pc *peerConn) uploadLoop() {
+	t := pc.t
+	for {
+		select {
+		case <-pc.closed:
+			return
+		case <-pc.upWake:
+		}
+		for {
+			// 按写出的速度读盘，不在内存中堆积数据
+			if !pc.waitSent() {
+				return
+			}
+			r, ok := pc.uploads.Next()
+			if !ok {
+				break
+			}
+			block := make([]byte, r.Length)
+			if err := t.Storage.ReadBlock(int(r.Index), int(r.Begin), block); err != nil {
+				LOG.Errorf("Read piece %d: %v", r.Index, err)
+				if pc.Supports(peer.BitFast) {
+					pc.send(&peer.Message{Id: peer.MsgReject, Index: r.Index, Begin: r.Begin, Length: r.Length})
+				}
+				continue
+			}
+			pc.send(&peer.Message{Id: peer.MsgPiece, Index: r.Index, Begin: r.Begin, Block: block})
+		}
+	}
+}
+
+func (pc *peerConn) setChoking(choking bool) {
+	if choking == pc.amChoking {
+		return
+	}
+	pc.amChoking = choking
+	if choking {
+		pc.send(&peer.Message{Id: peer.MsgChoke})
+		// 有Fast Extension时队列中不在allowed fast集合的请求要逐个reject
+		for _, r := range pc.uploads.Choke() {
+			pc.send(&peer.Message{Id: peer.MsgReject, Index: r.Index, Begin: r.Begin, Length: r.Length})
+		}
+	} else {
+		pc.uploads.Unchoke()
+		pc.send(&peer.Message{Id: peer.MsgUnchoke})
+	}
+}
+
+// 最近一个周期的速度
+func (pc *peerConn) updateRates(now time.Time) {
+	elapsed := now.Sub(pc.lastRate).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	down := float64(pc.downloaded-pc.lastDown) / elapsed
+	up := float64(pc.uploaded-pc.lastUp) / elapsed
+	pc.downRate = (pc.downRate + down) / 2
+	pc.upRate = (pc.upRate + up) / 2
+	pc.lastDown, pc.lastUp, pc.lastRate = pc.downloaded, pc.uploaded, now
+}
+
+// 握手后发送bitfield和扩展握手，bitfield必须是第一条消息
+func (pc *peerConn) start() error {
+	t := pc.t
+	have := t.bitfield()
+	fast := pc.Supports(peer.BitFast)
+	var err error
+	switch {
+	case fast && have.All():
+		err = pc.HaveAll()
+	case fast && have.None():
+		err = pc.HaveNone()
+	case !have.None():
+		err = pc.WriteMessage(&peer.Message{Id: peer.MsgBitfield, Bitfield: have.Bytes()})
+	}
+	if err != nil {
+		return err
+	}
+
+	// 允许对方在choke时请求的piece，让新的peer尽快有数据可以交换，只通知我们已经有的
+	if fast && pc.ip != nil {
+		for _, i := range peer.AllowedFastSet(peer.AllowedFastCount, pc.ip, t.InfoHash, have.Len()) {
+			pc.uploads.Allow(i)
+			if have.Get(int(i)) {
+				if err := pc.AllowedFast(i); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if pc.Supports(peer.BitExtension) {
+		pc.ext = t.registry.NewExtended(pc.Conn)
+		h := peer.ExtendedHandshake{V: "whonet", Reqq: peer.DefaultReqq}
+		if port := t.client.Port(); port > 0 {
+			h.P = port
+		}
+		return pc.ext.Handshake(h)
+	}
+	return nil
+}
+
+func (pc *peerConn) readLoop() error {
+	for {
+		m, err := pc.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if !pc.throttle(&m, false) {
+			return net.ErrClosed
+		}
+		if m.KeepAlive {
+			continue
+		}
+		if err := pc.handle(&m); err != nil {
+			return err
+		}
+	}
+}
+
+func (pc *peerConn) handle(m *peer.Message) error {
+	t := pc.t
+	if m.Id == peer.MsgExtended {
+		// 扩展的回调可能需要Torrent.mu，不能持有锁
+		if err := pc.ext.Handle(m.Payload); err != nil {
+			return err
+		}
+		if r := pc.ext.Remote; r != nil {
+			pc.pipeline.SetReqq(r.Reqq)
+			if r.P > 0 && pc.listen == nil {
+				t.mu.Lock()
+				if pc.ip != nil {
+					pc.setListen(r.P)
+					// 以后不再连接这个监听地址
+					pc.aliases = append(pc.aliases, pc.listen.String())
+					t.book.Connected(pc.listen.String())
+				}
+				t.mu.Unlock()
+			}
+		}
+		return nil
+	}
+
+	if m.Id == peer.MsgPiece {
+		t.received(pc, m)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	switch m.Id {
+	case peer.MsgChoke:
+		pc.peerChoking = true
+		for _, r := range pc.pipeline.Choked() {
+			t.Picker.Abort(pc.addr, picker.Block{Piece: int(r.Index), Begin: int(r.Begin), Length: int(r.Length)})
+		}
+	case peer.MsgUnchoke:
+		pc.peerChoking = false
+		pc.pipeline.Unchoked(now)
+	case peer.MsgInterested:
+		pc.peerInterested = true
+		// 还有空闲名额时立即unchoke，不必等下一次计算
+		if pc.amChoking && t.unchokedCount() < t.choker.Slots {
+			pc.setChoking(false)
+		}
+	case peer.MsgNotInterested:
+		pc.peerInterested = false
+	case peer.MsgHave:
+		if int(m.Index) >= pc.has.Len() {
+			return errBadIndex
+		}
+		if !pc.has.Get(int(m.Index)) {
+			pc.has.Set(int(m.Index))
+			t.Picker.PeerHave(int(m.Index))
+		}
+	case peer.MsgBitfield:
+		has, err := bitfield.FromBytes(m.Bitfield, t.Picker.NumPieces())
+		if err != nil {
+			return err
+		}
+		pc.has = has
+		t.Picker.AddPeer(has)
+	case peer.MsgHaveAll:
+		pc.has = bitfield.Full(t.Picker.NumPieces())
+		t.Picker.AddPeer(pc.has)
+	case peer.MsgHaveNone:
+	case peer.MsgRequest:
+		t.request(pc, m)
+	case peer.MsgCancel:
+		r := peer.Request{Index: m.Index, Begin: m.Begin, Length: m.Length}
+		if pc.uploads.Cancel(r) && pc.Supports(peer.BitFast) {
+			pc.send(&peer.Message{Id: peer.MsgReject, Index: r.Index, Begin: r.Begin, Length: r.Length})
+		}
+	case peer.MsgAllowedFast:
+		if int(m.Index) < pc.allowed.Len() {
+			pc.allowed.Set(int(m.Index))
+		}
+	case peer.MsgSuggest:
+		if int(m.Index) < pc.suggest.Len() {
+			pc.suggest.Set(int(m.Index))
+		}
+	case peer.MsgReject:
+		r := peer.Request{Index: m.Index, Begin: m.Begin, Length: m.Length}
+		if pc.pipeline.Rejected(r) {
+			t.Picker.Abort(pc.addr, picker.Block{Piece: int(r.Index), Begin: int(r.Begin), Length: int(r.Length)})
+		}
+	}
+	switch m.Id {
+	case peer.MsgHave, peer.MsgBitfield, peer.MsgHaveAll:
+		t.updateInterest(pc)
+		if pc.listen != nil && pc.listen.Flags&peer.PexSeed == 0 && pc.has.All() {
+			pc.listen.Flags |= peer.PexSeed
+			t.pex.Connected(*pc.listen)
+		}
+	}
+	t.fill(pc)
+	return nil
+}
@@ -0,0 +1,140 @@
+package client
+
+//
+// 快速恢复数据的保存和加载
+//
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"github.com/openqt/whonet/utils/bitfield"
+	"github.com/openqt/whonet/utils/picker"
+	"github.com/openqt/whonet/utils/resume"
+)
+
+const maxResumePeers = 200
+
+// 当前每个文件的大小和修改时间
+func (t *Torrent) fileStates() []resume.File {
+	files := make([]resume.File, len(t.Storage.Files))
+	for i := range files {
+		fi, err := t.Storage.Stat(i)
+		if err != nil {
+			files[i] = resume.File{Size: -1}
+			continue
+		}
+		files[i] = resume.File{Size: fi.Size(), Mtime: fi.ModTime().UnixNano()}
+	}
+	return files
+}
+
+// 保存快速恢复数据，ResumePath为空时不保存
+func (t *Torrent) SaveResume() error {
+	if t.ResumePath == "" {
+		return nil
+	}
+	// 先把数据写入磁盘，修改时间才是最终的
+	if err := t.Storage.Sync(); err != nil {
+		return err
+	}
+	d := &resume.Data{
+		InfoHash: string(t.InfoHash[:]),
+		Have:     t.Picker.Bitfield(),
+		Files:    t.fileStates(),
+	}
+	unfinished := t.Picker.Unfinished()
+	for i, blocks := range unfinished {
+		d.Unfinished = append(d.Unfinished, resume.Unfinished{Piece: i, Blocks: blocks})
+	}
+	sort.Slice(d.Unfinished, func(a, b int) bool { return d.Unfinished[a].Piece < d.Unfinished[b].Piece })
+	for f := range t.Storage.Files {
+		d.Priorities = append(d.Priorities, int(t.Picker.FilePriority(f)))
+	}
+
+	t.mu.Lock()
+	d.Uploaded, d.Downloaded = t.uploaded, t.downloaded
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if !seen[addr] && len(d.Peers) < maxResumePeers {
+			seen[addr] = true
+			d.Peers = append(d.Peers, addr)
+		}
+	}
+	// 连接中的peer优先
+	for _, pc := range t.peers {
+		if pc.listen != nil {
+			add(pc.listen.String())
+		}
+	}
+	for _, addr := range t.book.Addrs() {
+		add(addr)
+	}
+	t.mu.Unlock()
+	return resume.Save(t.Storage.Fs, t.ResumePath, d)
+}
+
+// 从快速恢复数据恢复进度，只重新校验大小或修改时间变化了的文件。
+// 没有可用的恢复数据时返回false，需要用Verify校验全部数据
+func (t *Torrent) Resume(ctx context.Context) (bool, error) {
+	if t.ResumePath == "" {
+		return false, nil
+	}
+	d, err := resume.Load(t.Storage.Fs, t.ResumePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG.Warnf("Resume %s: %v", t.ResumePath, err)
+		}
+		return false, nil
+	}
+	n := t.Picker.NumPieces()
+	if d.InfoHash != string(t.InfoHash[:]) || d.Have.Len() != n || len(d.Files) != len(t.Storage.Files) {
+		LOG.Warnf("Resume %s: data does not match torrent", t.ResumePath)
+		return false, nil
+	}
+
+	recheck := bitfield.New(n)
+	for f, st := range t.fileStates() {
+		if st == d.Files[f] {
+			continue
+		}
+		first, last := t.Picker.FilePieces(f)
+		for i := first; i >= 0 && i <= last; i++ {
+			recheck.Set(i)
+		}
+	}
+	for f, p := range d.Priorities {
+		if f < len(t.Storage.Files) {
+			if err := t.SetFilePriority(f, picker.Priority(p)); err != nil {
+				return false, err
+			}
+		}
+	}
+	for i := d.Have.FirstSet(); i >= 0; i = d.Have.NextSet(i + 1) {
+		if !recheck.Get(i) {
+			t.Picker.SetHave(i)
+		}
+	}
+	for _, u := range d.Unfinished {
+		if u.Piece >= 0 && u.Piece < n && !recheck.Get(u.Piece) {
+			t.Picker.SetUnfinished(u.Piece, u.Blocks)
+		}
+	}
+	t.mu.Lock()
+	t.uploaded += d.Uploaded
+	t.downloaded += d.Downloaded
+	t.mu.Unlock()
+	t.AddPeers(d.Peers)
+
+	if recheck.None() {
+		t.checkComplete()
+		return true, nil
+	}
+	var pieces []int
+	for i := recheck.FirstSet(); i >= 0; i = recheck.NextSet(i + 1) {
+		pieces = append(pieces, i)
+	}
+	LOG.Infof("%s: files changed, rechecking %d pieces", t.Meta.Info.Name, len(pieces))
+	return true, t.Recheck(ctx, pieces, nil)
+}
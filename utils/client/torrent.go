@@ -0,0 +1,730 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils/bitfield"
+	"github.com/openqt/whonet/utils/choker"
+	"github.com/openqt/whonet/utils/connmgr"
+	"github.com/openqt/whonet/utils/hasher"
+	"github.com/openqt/whonet/utils/mse"
+	"github.com/openqt/whonet/utils/peer"
+	"github.com/openqt/whonet/utils/picker"
+	"github.com/openqt/whonet/utils/ratelimit"
+	"github.com/openqt/whonet/utils/storage"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/tracker"
+)
+
+const (
+	tickInterval      = time.Second
+	KeepAliveInterval = 2 * time.Minute
+	InactiveTimeout   = 3 * time.Minute
+	StopTimeout       = 5 * time.Second // 发送stopped的最长等待时间
+	ResumeInterval    = time.Minute     // 定期保存快速恢复数据
+
+	maxRequestLength = 128 * 1024
+	uploadWatermark  = 4 // 每个peer读盘后等待写出的piece消息
+)
+
+// 下载或做种中的一个种子
+type Torrent struct {
+	Meta     *torrent.TorrentStruct
+	InfoHash [20]byte
+	Storage  *storage.Storage
+	Picker   *picker.Picker
+
+	// 快速恢复文件在Storage.Fs中的路径，默认在数据目录中，为空时不保存
+	ResumePath string
+
+	client    *Client
+	choker    *choker.Choker
+	announcer *tracker.Announcer
+	registry  *peer.Registry
+	pex       *peer.Pex
+	hashq     *hasher.Queue // 校验下载完的piece
+	book      *connmgr.Book
+	smartban  *connmgr.SmartBan
+	limit     *ratelimit.Pair
+
+	mu         sync.Mutex
+	peers      map[string]*peerConn
+	dialing    map[string]bool
+	downloaded int64 // 有效数据，不含协议开销
+	uploaded   int64
+	lastChoke  time.Time
+
+	complete  chan struct{} // 由t.mu保护，重新选择文件后可能重新创建
+	completed bool          // complete已关闭
+	quit      chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+func newTorrent(c *Client, t *torrent.TorrentStruct, dir string) (*Torrent, error) {
+	tt := &Torrent{
+		Meta:     t,
+		Storage:  storage.NewFs(c.Fs, t.Info, dir),
+		Picker:   picker.New(t.Info),
+		client:   c,
+		choker:   choker.New(c.UploadSlots, c.Choker),
+		registry: peer.NewRegistry(),
+		limit:    ratelimit.NewPair(0, 0),
+		peers:    make(map[string]*peerConn),
+		dialing:  make(map[string]bool),
+		book:     connmgr.NewBook(),
+		smartban: connmgr.NewSmartBan(),
+		complete: make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+	copy(tt.InfoHash[:], t.InfoHash())
+	tt.Storage.Allocation = c.Allocation
+	tt.ResumePath = tt.Storage.StatePath("resume")
+
+	if err := peer.RegisterMetadata(tt.registry, peer.NewMetadataFrom([]byte(t.InfoBytes()))); err != nil {
+		return nil, err
+	}
+	tt.pex = peer.NewPex(t.Info, func(from *peer.Extended, peers []peer.PexPeer) {
+		tt.mu.Lock()
+		defer tt.mu.Unlock()
+		for _, p := range peers {
+			tt.book.Add(p.String())
+			tt.book.SetFlags(p.String(), p.Flags)
+		}
+		tt.connectMore()
+	})
+	if err := peer.RegisterPex(tt.registry, tt.pex); err != nil {
+		return nil, err
+	}
+	tt.hashq = hasher.New(hasher.SHA1).Start(tt.Storage, tt.pieceHashed)
+	return tt, nil
+}
+
+// 校验已有的数据
+func (t *Torrent) Verify() {
+	t.Recheck(context.Background(), nil, nil)
+}
+
+// 重新校验pieces，为nil时校验全部，progress不为nil时报告进度
+func (t *Torrent) Recheck(ctx context.Context, pieces []int, progress func(done, total int, bytes int64)) error {
+	if pieces == nil {
+		for i := 0; i < t.Picker.NumPieces(); i++ {
+			pieces = append(pieces, i)
+		}
+	}
+	h := hasher.New(hasher.SHA1)
+	h.Progress = progress
+	err := h.Run(ctx, t.Storage, pieces, func(r hasher.Result) {
+		if r.Err == nil && string(r.Sum) == t.Meta.Info.PieceHash(r.Index) {
+			t.Picker.SetHave(r.Index)
+		} else {
+			t.Picker.ClearHave(r.Index)
+		}
+	})
+	t.checkComplete()
+	return err
+}
+
+// 不校验，只检查文件大小，认为数据完整
+func (t *Torrent) Trust() error {
+	if err := t.Storage.CheckSizes(); err != nil {
+		return err
+	}
+	for i := 0; i < t.Picker.NumPieces(); i++ {
+		t.Picker.SetHave(i)
+	}
+	t.checkComplete()
+	return nil
+}
+
+// 设置文件的优先级，下载中也可以修改。Skip的文件不会创建，
+// 和其他文件共用的piece中属于它的部分保存在parts目录中
+func (t *Torrent) SetFilePriority(f int, p picker.Priority) error {
+	if err := t.Storage.SetSkip(f, p == picker.Skip); err != nil {
+		return err
+	}
+	t.Picker.SetFilePriority(f, p)
+	t.mu.Lock()
+	for _, pc := range t.peers {
+		t.updateInterest(pc)
+	}
+	t.mu.Unlock()
+	t.checkComplete()
+	return nil
+}
+
+// 更新剩余字节数，选择的数据全部完成时创建空文件、通知tracker并关闭Done；
+// 完成后又选择了没有的数据时重新创建Done。不能持有t.mu调用
+func (t *Torrent) checkComplete() {
+	complete := t.Picker.Complete()
+	t.mu.Lock()
+	a := t.announcer
+	changed := complete != t.completed
+	if changed {
+		t.completed = complete
+		if complete {
+			close(t.complete)
+		} else {
+			t.complete = make(chan struct{})
+		}
+	}
+	t.mu.Unlock()
+
+	if a != nil {
+		a.SetLeft(t.Left())
+	}
+	if !changed || !complete {
+		return
+	}
+	LOG.Infof("%s: complete", t.Meta.Info.Name)
+	if err := t.Storage.CreateEmpty(); err != nil {
+		LOG.Errorf("Create files: %v", err)
+	}
+	if a != nil {
+		a.Completed()
+	}
+}
+
+// 所有选择的数据下载并校验完成时关闭
+func (t *Torrent) Done() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.complete
+}
+
+// 还需要下载的字节数
+func (t *Torrent) Left() int64 {
+	have := t.Picker.Bitfield()
+	sel := t.Picker.Selected().AndNot(have)
+	var left int64
+	for i := sel.FirstSet(); i >= 0; i = sel.NextSet(i + 1) {
+		left += int64(t.Storage.PieceSize(i))
+	}
+	return left
+}
+
+func (t *Torrent) Announcer() *tracker.Announcer {
+	return t.announcer
+}
+
+// 开始announce和连接peer
+func (t *Torrent) Start() {
+	a := tracker.NewAnnouncer(t.Meta, string(t.client.PeerId[:]), t.client.Port(), t.Left())
+	a.OnPeers = func(peers []tracker.Peer) {
+		var addrs []string
+		for _, p := range peers {
+			addrs = append(addrs, p.String())
+		}
+		t.AddPeers(addrs)
+	}
+	a.NeedPeers = func() int {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.client.MaxPeers - len(t.peers)
+	}
+	t.mu.Lock() // AddPeers后可能已经有连接
+	t.announcer = a
+	t.mu.Unlock()
+	if len(a.Tiers) > 0 {
+		a.Start()
+	}
+	t.wg.Add(1)
+	go t.tickLoop()
+}
+
+// 断开所有连接，向tracker发送stopped
+func (t *Torrent) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.quit)
+		t.mu.Lock()
+		for _, pc := range t.peers {
+			pc.Close()
+		}
+		t.mu.Unlock()
+		t.wg.Wait()
+		t.hashq.Close()
+		if err := t.SaveResume(); err != nil {
+			LOG.Warnf("Save resume data: %v", err)
+		}
+		if t.announcer != nil {
+			if err := t.announcer.Stop(StopTimeout); err != nil {
+				LOG.Debugf("Stopped: %v", err)
+			}
+		}
+		t.Storage.Close()
+		t.client.remove(t)
+	})
+}
+
+// 当前状态
+type Stats struct {
+	Pieces, Have int
+	Peers        int
+	Left         int64
+	Selected     int64 // 选择下载的文件的字节数
+	Completed    int64 // 其中已经完成的
+	Downloaded   int64
+	Uploaded     int64
+	DownRate     float64 // 字节/秒
+	UpRate       float64
+}
+
+func (t *Torrent) Stats() Stats {
+	s := Stats{
+		Pieces: t.Picker.NumPieces(),
+		Have:   t.Picker.NumHave(),
+		Left:   t.Left(),
+	}
+	s.Selected, s.Completed = t.Picker.SelectedBytes()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.Peers = len(t.peers)
+	s.Downloaded, s.Uploaded = t.downloaded, t.uploaded
+	for _, pc := range t.peers {
+		s.DownRate += pc.downRate
+		s.UpRate += pc.upRate
+	}
+	return s
+}
+
+// 加入候选的peer地址
+func (t *Torrent) AddPeers(addrs []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, addr := range addrs {
+		t.book.Add(addr)
+	}
+	t.connectMore()
+}
+
+func (t *Torrent) connectMore() {
+	select {
+	case <-t.quit:
+		return
+	default:
+	}
+	n := t.client.MaxPeers - len(t.peers) - len(t.dialing)
+	if n <= 0 {
+		return
+	}
+	skip := func(addr string) bool {
+		_, ok := t.peers[addr]
+		return ok || t.client.conns.Banned(hostIP(addr))
+	}
+	for _, addr := range t.book.Next(time.Now(), n, skip) {
+		// 超过全局限制的留到下一次
+		if !t.client.conns.Dial() {
+			t.book.Cancel(addr)
+			continue
+		}
+		t.dialing[addr] = true
+		t.wg.Add(1)
+		go func(addr string) {
+			defer t.wg.Done()
+			t.dial(addr)
+		}(addr)
+	}
+}
+
+func (t *Torrent) handshake() *peer.Handshake {
+	h := &peer.Handshake{InfoHash: t.InfoHash, PeerId: t.client.PeerId}
+	h.Reserved.Set(peer.BitFast)
+	h.Reserved.Set(peer.BitExtension)
+	return h
+}
+
+// 连接并握手，成功后处理连接直到断开
+func (t *Torrent) dial(addr string) {
+	connected := false
+	defer func() {
+		t.mu.Lock()
+		delete(t.dialing, addr)
+		if !connected {
+			t.book.Failed(addr, time.Now())
+		}
+		t.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-t.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	t.mu.Lock()
+	d, policy := t.client.dialOptions(t.book.Flags(addr))
+	t.mu.Unlock()
+	nc, err := mse.Dial(ctx, d, addr, t.InfoHash[:], policy)
+	if err != nil {
+		LOG.Debugf("Dial %s: %v", addr, err)
+		t.client.conns.Dialed(false)
+		return
+	}
+	nc.SetDeadline(time.Now().Add(HandshakeTimeout))
+	pc := peer.NewConn(nc)
+	h, err := pc.Handshake(t.handshake())
+	if err != nil {
+		LOG.Debugf("Handshake %s: %v", addr, err)
+		nc.Close()
+		t.client.conns.Dialed(false)
+		return
+	}
+	nc.SetDeadline(time.Time{})
+	t.client.conns.Dialed(true)
+	defer t.client.conns.Closed()
+	connected = true
+
+	t.mu.Lock()
+	delete(t.dialing, addr)
+	t.mu.Unlock()
+	t.run(pc, addr, h, true)
+}
+
+// 同一个peer有两个连接时保留哪一个：双方同时连接时保留peer ID较小的一方发起的，
+// 两边都能得到相同的结果；方向相同时保留已有的
+func (t *Torrent) keepNew(other *peerConn, outgoing bool, id [20]byte) bool {
+	if other.outgoing == outgoing {
+		return false
+	}
+	ours := string(t.client.PeerId[:]) < string(id[:])
+	return outgoing == ours
+}
+
+// 握手完成后的连接处理，直到断开
+func (t *Torrent) run(c *peer.Conn, addr string, h *peer.Handshake, outgoing bool) {
+	if h.PeerId == t.client.PeerId {
+		c.Close() // 连接到自己
+		if outgoing {
+			t.mu.Lock()
+			t.book.Self(addr)
+			t.mu.Unlock()
+		}
+		return
+	}
+
+	pc := newPeerConn(t, c, addr, h)
+	pc.outgoing = outgoing
+	if outgoing {
+		pc.aliases = []string{addr}
+	}
+	t.mu.Lock()
+	select {
+	case <-t.quit:
+		t.mu.Unlock()
+		c.Close()
+		return
+	default:
+	}
+	if _, ok := t.peers[addr]; ok || t.client.conns.Banned(pc.ip) {
+		if outgoing {
+			t.book.Failed(addr, time.Now())
+		}
+		t.mu.Unlock()
+		c.Close()
+		return
+	}
+	for _, other := range t.peers {
+		if other.id != h.PeerId {
+			continue
+		}
+		// 同一个peer的重复连接，两个地址都属于保留的连接
+		if !t.keepNew(other, outgoing, h.PeerId) {
+			other.aliases = append(other.aliases, pc.aliases...)
+			t.book.Connected(pc.aliases...)
+			t.mu.Unlock()
+			c.Close()
+			return
+		}
+		LOG.Debugf("Peer %s: replaced by %s", other.addr, addr)
+		pc.aliases = append(pc.aliases, other.aliases...)
+		other.aliases = nil
+		other.Close()
+	}
+	t.book.Connected(pc.aliases...)
+	t.peers[addr] = pc
+	t.wg.Add(1)
+	t.mu.Unlock()
+	defer t.wg.Done()
+
+	if outgoing {
+		if _, port, err := net.SplitHostPort(addr); err == nil && pc.ip != nil {
+			p, _ := strconv.Atoi(port)
+			t.mu.Lock()
+			pc.setListen(p)
+			t.mu.Unlock()
+		}
+	}
+
+	err := pc.start()
+	if err == nil {
+		go pc.writeLoop()
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			pc.uploadLoop()
+		}()
+		err = pc.readLoop()
+	}
+	LOG.Debugf("Peer %s: %v", addr, err)
+	t.disconnected(pc)
+}
+
+func (t *Torrent) disconnected(pc *peerConn) {
+	pc.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.peers[pc.addr] == pc {
+		delete(t.peers, pc.addr)
+	}
+	t.book.Disconnected(time.Now(), pc.aliases...)
+	t.Picker.RemovePeer(pc.addr, pc.has)
+	pc.pipeline.Close()
+	t.choker.Remove(pc.addr)
+	if pc.listen != nil {
+		t.pex.Disconnected(pc.listen.Peer)
+	}
+	if pc.ext != nil {
+		t.pex.Close(pc.ext)
+	}
+	t.connectMore()
+}
+
+// 我们需要对方的数据时感兴趣
+func (t *Torrent) updateInterest(pc *peerConn) {
+	want := t.Picker.Selected().AndNot(t.Picker.Bitfield()).And(pc.has.Clone())
+	interested := !want.None()
+	if interested != pc.amInterested {
+		pc.amInterested = interested
+		if interested {
+			pc.send(&peer.Message{Id: peer.MsgInterested})
+		} else {
+			pc.send(&peer.Message{Id: peer.MsgNotInterested})
+		}
+	}
+}
+
+// 向对方发出新的请求
+func (t *Torrent) fill(pc *peerConn) {
+	if !pc.amInterested {
+		return
+	}
+	has, n := pc.has, pc.pipeline.Want()
+	if pc.peerChoking {
+		// 被choke时只能请求allowed fast的piece
+		has, n = pc.has.Clone().And(pc.allowed), pc.pipeline.WantAllowed()
+	}
+	if n == 0 || has.None() {
+		return
+	}
+	// 对方建议的piece优先
+	var blocks []picker.Block
+	if !pc.suggest.None() {
+		blocks = t.Picker.Pick(pc.addr, has.Clone().And(pc.suggest), n)
+	}
+	if len(blocks) < n {
+		blocks = append(blocks, t.Picker.Pick(pc.addr, has, n-len(blocks))...)
+	}
+	now := time.Now()
+	for _, b := range blocks {
+		r := peer.Request{Index: uint32(b.Piece), Begin: uint32(b.Begin), Length: uint32(b.Length)}
+		pc.pipeline.Sent(r, now)
+		pc.send(&peer.Message{Id: peer.MsgRequest, Index: r.Index, Begin: r.Begin, Length: r.Length})
+	}
+}
+
+// 收到对方请求的数据块，写盘时不持有t.mu
+func (t *Torrent) received(pc *peerConn, m *peer.Message) {
+	r := peer.Request{Index: m.Index, Begin: m.Begin, Length: uint32(len(m.Block))}
+	if !pc.pipeline.Received(r, time.Now()) {
+		return // 没有请求过，或已经取消
+	}
+	if err := t.Storage.WriteBlock(int(r.Index), int(r.Begin), m.Block); err != nil {
+		LOG.Errorf("Write piece %d: %v", r.Index, err)
+		t.Picker.Abort(pc.addr, picker.Block{Piece: int(r.Index), Begin: int(r.Begin), Length: int(r.Length)})
+		return
+	}
+	t.smartban.Received(int(r.Index), int(r.Begin), int(r.Length), pc.ip.String())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pc.downloaded += int64(len(m.Block))
+	t.downloaded += int64(len(m.Block))
+	if t.announcer != nil {
+		t.announcer.AddDownloaded(int64(len(m.Block)))
+	}
+
+	done, cancels := t.Picker.Received(pc.addr, picker.Block{Piece: int(r.Index), Begin: int(r.Begin), Length: int(r.Length)})
+	for _, c := range cancels {
+		if other := t.peers[c.Peer]; other != nil {
+			cr := peer.Request{Index: uint32(c.Block.Piece), Begin: uint32(c.Block.Begin), Length: uint32(c.Block.Length)}
+			if other.pipeline.Cancel(cr) {
+				other.send(&peer.Message{Id: peer.MsgCancel, Index: cr.Index, Begin: cr.Begin, Length: cr.Length})
+			}
+		}
+	}
+	if done {
+		t.hashq.Add(int(r.Index))
+	}
+}
+
+// 收齐的piece校验完成
+// 读盘和announcer的调用都不持有t.mu，announcer的回调也需要这个锁
+func (t *Torrent) pieceHashed(r hasher.Result) {
+	i := r.Index
+	ok := r.Err == nil && string(r.Sum) == t.Meta.Info.PieceHash(i)
+	// smart ban要重新读取piece，在交还给picker之前做，这时不会有新的数据写入
+	if ok {
+		t.ban(t.smartban.Passed(i, t.Storage))
+	} else {
+		LOG.Warnf("Piece %d failed hash check", i)
+		t.ban(t.smartban.Failed(i, t.Storage))
+	}
+
+	t.mu.Lock()
+	t.Picker.Hashed(i, ok)
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	for _, pc := range t.peers {
+		pc.send(&peer.Message{Id: peer.MsgHave, Index: uint32(i)})
+	}
+	if t.Picker.Complete() {
+		for _, pc := range t.peers {
+			t.updateInterest(pc)
+		}
+	}
+	t.mu.Unlock()
+	t.checkComplete()
+}
+
+// 对方的请求加入上传队列，choke时只接受allowed fast集合中的piece
+func (t *Torrent) request(pc *peerConn, m *peer.Message) {
+	r := peer.Request{Index: m.Index, Begin: m.Begin, Length: m.Length}
+	i := int(m.Index)
+	if i >= t.Picker.NumPieces() || !t.Picker.Have(i) || m.Length == 0 || m.Length > maxRequestLength ||
+		int64(m.Begin)+int64(m.Length) > int64(t.Storage.PieceSize(i)) || !pc.uploads.Add(r) {
+		if pc.Supports(peer.BitFast) {
+			pc.send(&peer.Message{Id: peer.MsgReject, Index: m.Index, Begin: m.Begin, Length: m.Length})
+		}
+		return
+	}
+	pc.wakeUpload()
+}
+
+func (t *Torrent) unchokedCount() int {
+	n := 0
+	for _, pc := range t.peers {
+		if !pc.amChoking {
+			n++
+		}
+	}
+	return n
+}
+
+// 设置这个种子的unchoke名额和做种时的算法，slots小于等于0时使用默认值。
+// 默认使用客户端的设置
+func (t *Torrent) SetChoker(slots int, algorithm choker.Algorithm) {
+	if slots <= 0 {
+		slots = choker.DefaultSlots
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.choker.Slots = slots
+	t.choker.Algorithm = algorithm
+	t.rechoke(time.Now())
+}
+
+// 按choker的结果choke和unchoke
+func (t *Torrent) rechoke(now time.Time) {
+	t.lastChoke = now
+	var list []choker.Peer
+	for _, pc := range t.peers {
+		list = append(list, choker.Peer{
+			Key:        pc.addr,
+			Interested: pc.peerInterested,
+			Snubbed:    pc.pipeline.Snubbed(),
+			Download:   pc.downRate,
+			Upload:     pc.upRate,
+			Progress:   float64(pc.has.Count()) / float64(pc.has.Len()),
+			Connected:  pc.connected,
+		})
+	}
+	unchoke := make(map[string]bool)
+	for _, key := range t.choker.Update(now, list, t.Picker.Complete()) {
+		unchoke[key] = true
+	}
+	for key, pc := range t.peers {
+		pc.setChoking(!unchoke[key])
+	}
+}
+
+func (t *Torrent) tickLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	lastSave := time.Now()
+	for {
+		select {
+		case <-t.quit:
+			return
+		case now := <-ticker.C:
+			t.tick(now)
+			t.pex.Tick(now)
+			if now.Sub(lastSave) >= ResumeInterval {
+				lastSave = now
+				if err := t.SaveResume(); err != nil {
+					LOG.Warnf("Save resume data: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (t *Torrent) tick(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pc := range t.peers {
+		for _, r := range pc.pipeline.Expire(now) {
+			t.Picker.Abort(pc.addr, picker.Block{Piece: int(r.Index), Begin: int(r.Begin), Length: int(r.Length)})
+			pc.send(&peer.Message{Id: peer.MsgCancel, Index: r.Index, Begin: r.Begin, Length: r.Length})
+		}
+		pc.updateRates(now)
+
+		read, written := pc.LastActive()
+		if now.Sub(read) > t.client.Inactive {
+			LOG.Debugf("Peer %s inactive", pc.addr)
+			pc.Close()
+			continue
+		}
+		if now.Sub(written) > t.client.KeepAlive {
+			pc.send(&peer.Message{KeepAlive: true})
+		}
+	}
+	if now.Sub(t.lastChoke) >= choker.Interval {
+		t.rechoke(now)
+	}
+	for _, pc := range t.peers {
+		t.fill(pc)
+	}
+	t.connectMore()
+}
+
+// ban发送过坏数据的IP，Client.Ban需要每个种子的锁，调用时不能持有t.mu
+func (t *Torrent) ban(ips []string) {
+	for _, ip := range ips {
+		t.client.Ban(net.ParseIP(ip))
+	}
+}
+
+// 新连接的peer的初始bitfield
+func (t *Torrent) bitfield() *bitfield.Bitfield {
+	return t.Picker.Bitfield()
+}
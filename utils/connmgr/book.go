@@ -0,0 +1,193 @@
+package connmgr
+
+//
+// 一个种子的peer地址簿。连接失败的地址按指数退避重试，失败太多次后丢弃；
+// 同一个peer的不同地址在连接期间不再重复连接；连接到自己的地址不再使用。
+// 地址数有上限，满了以后先丢弃失败过的空闲地址
+//
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	DialBackoff     = 30 * time.Second // 第一次失败后的等待时间，之后每次加倍
+	MaxBackoff      = 30 * time.Minute
+	MaxDialFailures = 5               // 连续失败这么多次后丢弃地址
+	ReconnectDelay  = 1 * time.Minute // 正常断开后再次连接的等待时间
+	DefaultMaxAddrs = 2000
+)
+
+type state int
+
+const (
+	idle      state = iota
+	dialing         // 正在连接
+	connected       // 已连接，或者是某个已连接的peer的另一个地址
+	self            // 连接到了自己
+)
+
+type entry struct {
+	state    state
+	failures int
+	next     time.Time // 在此之前不连接
+	added    int       // 加入的顺序，先加入的先连接
+	flags    byte      // 来源提供的标志，例如PEX的added.f
+}
+
+// 不是并发安全的，由种子的锁保护
+type Book struct {
+	MaxAddrs int // 最多保存的地址数
+
+	entries map[string]*entry
+	seq     int
+}
+
+func NewBook() *Book {
+	return &Book{MaxAddrs: DefaultMaxAddrs, entries: make(map[string]*entry)}
+}
+
+// 加入地址，已有的地址不变。地址簿满时丢弃一个空闲的地址，没有可以丢弃的就不加入
+func (b *Book) Add(addr string) {
+	if _, ok := b.entries[addr]; ok {
+		return
+	}
+	if len(b.entries) >= b.MaxAddrs && !b.evict() {
+		return
+	}
+	b.insert(addr)
+}
+
+// 正在使用的地址一定加入，满了的话尽量丢弃一个
+func (b *Book) ensure(addr string) *entry {
+	if e := b.entries[addr]; e != nil {
+		return e
+	}
+	if len(b.entries) >= b.MaxAddrs {
+		b.evict()
+	}
+	return b.insert(addr)
+}
+
+func (b *Book) insert(addr string) *entry {
+	b.seq++
+	e := &entry{added: b.seq}
+	b.entries[addr] = e
+	return e
+}
+
+// 丢弃一个空闲的地址：失败次数最多的，一样时最早加入的
+func (b *Book) evict() bool {
+	var victim string
+	var worst *entry
+	for addr, e := range b.entries {
+		if e.state != idle {
+			continue
+		}
+		if worst == nil || e.failures > worst.failures || e.failures == worst.failures && e.added < worst.added {
+			victim, worst = addr, e
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	delete(b.entries, victim)
+	return true
+}
+
+// 记录地址来源提供的标志，连接时参考
+func (b *Book) SetFlags(addr string, flags byte) {
+	if e := b.entries[addr]; e != nil {
+		e.flags = flags
+	}
+}
+
+func (b *Book) Flags(addr string) byte {
+	if e := b.entries[addr]; e != nil {
+		return e.flags
+	}
+	return 0
+}
+
+func (b *Book) Len() int {
+	return len(b.entries)
+}
+
+// 现在可以连接的地址，最多n个，标记为正在连接
+func (b *Book) Next(now time.Time, n int, skip func(addr string) bool) []string {
+	var list []string
+	for addr, e := range b.entries {
+		if e.state == idle && !now.Before(e.next) && (skip == nil || !skip(addr)) {
+			list = append(list, addr)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return b.entries[list[i]].added < b.entries[list[j]].added })
+	if len(list) > n {
+		list = list[:n]
+	}
+	for _, addr := range list {
+		b.entries[addr].state = dialing
+	}
+	return list
+}
+
+// 没有开始连接，不算失败
+func (b *Book) Cancel(addr string) {
+	if e := b.entries[addr]; e != nil && e.state == dialing {
+		e.state = idle
+	}
+}
+
+// 连接失败，等待一段时间后重试
+func (b *Book) Failed(addr string, now time.Time) {
+	e := b.entries[addr]
+	if e == nil || e.state == self {
+		return
+	}
+	e.failures++
+	if e.failures >= MaxDialFailures {
+		delete(b.entries, addr)
+		return
+	}
+	d := DialBackoff << uint(e.failures-1)
+	if d > MaxBackoff {
+		d = MaxBackoff
+	}
+	e.state, e.next = idle, now.Add(d)
+}
+
+// 建立了连接，addrs是同一个peer的所有已知地址
+func (b *Book) Connected(addrs ...string) {
+	for _, addr := range addrs {
+		if e := b.ensure(addr); e.state != self {
+			e.state, e.failures = connected, 0
+		}
+	}
+}
+
+// 连接断开，一段时间后可以重新连接
+func (b *Book) Disconnected(now time.Time, addrs ...string) {
+	for _, addr := range addrs {
+		if e := b.entries[addr]; e != nil && e.state == connected {
+			e.state, e.next = idle, now.Add(ReconnectDelay)
+		}
+	}
+}
+
+// 地址连接到了自己，以后不再连接
+func (b *Book) Self(addr string) {
+	b.ensure(addr).state = self
+}
+
+// 除了自己以外的地址，用于保存和交换
+func (b *Book) Addrs() []string {
+	var list []string
+	for addr, e := range b.entries {
+		if e.state != self {
+			list = append(list, addr)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return b.entries[list[i]].added < b.entries[list[j]].added })
+	return list
+}
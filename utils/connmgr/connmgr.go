@@ -0,0 +1,115 @@
+package connmgr
+
+//
+// 连接管理：所有种子合计的连接数和半开连接数限制，以及被ban的IP。
+// 每个种子的地址簿见Book，坏数据的追查见SmartBan
+//
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxConns    = 200
+	DefaultMaxHalfOpen = 20
+	BanDuration        = time.Hour
+)
+
+// 并发安全，由客户端的所有种子共用
+type Manager struct {
+	MaxConns    int // 包括正在连接的
+	MaxHalfOpen int // 正在连接、还没有完成握手的
+
+	mu       sync.Mutex
+	conns    int
+	halfOpen int
+	banned   map[string]time.Time // IP -> 解除时间
+}
+
+// 参数小于等于0时使用默认值
+func New(maxConns, maxHalfOpen int) *Manager {
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConns
+	}
+	if maxHalfOpen <= 0 {
+		maxHalfOpen = DefaultMaxHalfOpen
+	}
+	return &Manager{
+		MaxConns:    maxConns,
+		MaxHalfOpen: maxHalfOpen,
+		banned:      make(map[string]time.Time),
+	}
+}
+
+// 占用一个连接和一个半开名额，成功后要调用Dialed
+func (m *Manager) Dial() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns >= m.MaxConns || m.halfOpen >= m.MaxHalfOpen {
+		return false
+	}
+	m.conns++
+	m.halfOpen++
+	return true
+}
+
+// 连接完成或失败，释放半开名额。失败时同时释放连接名额
+func (m *Manager) Dialed(ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.halfOpen--
+	if !ok {
+		m.conns--
+	}
+}
+
+// 接受连接时占用一个连接名额
+func (m *Manager) Accept() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns >= m.MaxConns {
+		return false
+	}
+	m.conns++
+	return true
+}
+
+// 连接断开
+func (m *Manager) Closed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns--
+}
+
+// 当前的连接数和半开连接数
+func (m *Manager) Count() (conns, halfOpen int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conns, m.halfOpen
+}
+
+// ban一个IP一段时间
+func (m *Manager) Ban(ip net.IP, d time.Duration) {
+	if ip == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.banned[ip.String()] = time.Now().Add(d)
+}
+
+func (m *Manager) Banned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.banned[ip.String()]
+	if ok && time.Now().After(until) {
+		delete(m.banned, ip.String())
+		return false
+	}
+	return ok
+}
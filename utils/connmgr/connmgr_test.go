@@ -0,0 +1,168 @@
+package connmgr
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	m := New(3, 2)
+	if !m.Dial() || !m.Dial() || m.Dial() {
+		t.Fatal("half-open limit")
+	}
+	m.Dialed(true)
+	m.Dialed(false)
+	if !m.Accept() || !m.Dial() {
+		t.Fatal("slots not released")
+	}
+	if m.Accept() || m.Dial() {
+		t.Error("connection limit")
+	}
+	if conns, half := m.Count(); conns != 3 || half != 1 {
+		t.Errorf("count %d %d", conns, half)
+	}
+	m.Closed()
+	if !m.Accept() {
+		t.Error("closed slot not released")
+	}
+
+	ip := net.ParseIP("10.0.0.1")
+	m.Ban(ip, time.Hour)
+	if !m.Banned(net.ParseIP("10.0.0.1")) || m.Banned(net.ParseIP("10.0.0.2")) || m.Banned(nil) {
+		t.Error("ban")
+	}
+	m.Ban(ip, -time.Second)
+	if m.Banned(ip) {
+		t.Error("ban expired")
+	}
+}
+
+func TestBook(t *testing.T) {
+	b := NewBook()
+	now := time.Now()
+	b.Add("a:1")
+	b.Add("b:1")
+	b.Add("c:1")
+	b.Add("a:1")
+	if got := b.Next(now, 2, func(addr string) bool { return addr == "b:1" }); !reflect.DeepEqual(got, []string{"a:1", "c:1"}) {
+		t.Fatalf("next %v", got)
+	}
+	// 正在连接的不再返回
+	if got := b.Next(now, 10, nil); !reflect.DeepEqual(got, []string{"b:1"}) {
+		t.Fatalf("next %v", got)
+	}
+	b.Cancel("b:1")
+
+	// 失败后退避，次数太多时丢弃
+	b.Failed("a:1", now)
+	if got := b.Next(now.Add(DialBackoff-time.Second), 10, nil); !reflect.DeepEqual(got, []string{"b:1"}) {
+		t.Errorf("next during backoff %v", got)
+	}
+	if got := b.Next(now.Add(DialBackoff), 10, nil); !reflect.DeepEqual(got, []string{"a:1"}) {
+		t.Errorf("next after backoff %v", got)
+	}
+	for i := 1; i < MaxDialFailures; i++ {
+		b.Failed("a:1", now)
+	}
+	if b.Len() != 2 {
+		t.Errorf("failed address kept, %d addresses", b.Len())
+	}
+
+	// 同一个peer的另一个地址在连接期间不会返回
+	b.Connected("c:1", "d:1")
+	b.Self("b:1")
+	if got := b.Next(now.Add(time.Hour), 10, nil); len(got) != 0 {
+		t.Errorf("next %v", got)
+	}
+	b.Disconnected(now, "c:1", "d:1")
+	if got := b.Next(now.Add(ReconnectDelay), 10, nil); !reflect.DeepEqual(got, []string{"c:1", "d:1"}) {
+		t.Errorf("next after disconnect %v", got)
+	}
+	if got := b.Addrs(); !reflect.DeepEqual(got, []string{"c:1", "d:1"}) {
+		t.Errorf("addrs %v", got)
+	}
+
+	b.SetFlags("c:1", 0x05)
+	b.SetFlags("x:1", 0x05)
+	if b.Flags("c:1") != 0x05 || b.Flags("d:1") != 0 || b.Flags("x:1") != 0 {
+		t.Error("flags")
+	}
+}
+
+func TestBookCap(t *testing.T) {
+	b := NewBook()
+	b.MaxAddrs = 3
+	now := time.Now()
+	b.Add("a:1")
+	b.Add("b:1")
+	b.Add("c:1")
+	b.Failed("b:1", now)
+
+	// 先丢弃失败过的，再丢弃最早加入的
+	b.Add("d:1")
+	if got := b.Addrs(); !reflect.DeepEqual(got, []string{"a:1", "c:1", "d:1"}) {
+		t.Errorf("addrs %v", got)
+	}
+	b.Add("e:1")
+	if got := b.Addrs(); !reflect.DeepEqual(got, []string{"c:1", "d:1", "e:1"}) {
+		t.Errorf("addrs %v", got)
+	}
+
+	// 正在使用的地址不丢弃，没有空闲地址时新地址不加入
+	b.Next(now, 2, nil)
+	b.Connected("e:1")
+	b.Add("f:1")
+	if got := b.Addrs(); !reflect.DeepEqual(got, []string{"c:1", "d:1", "e:1"}) {
+		t.Errorf("addrs %v", got)
+	}
+	b.Self("g:1")
+	if b.Len() != 4 {
+		t.Errorf("%d addresses", b.Len())
+	}
+}
+
+// 内存中的piece数据
+type pieces map[int][]byte
+
+func (p pieces) ReadBlock(piece, begin int, b []byte) error {
+	if begin+len(b) > len(p[piece]) {
+		return errors.New("short piece")
+	}
+	copy(b, p[piece][begin:])
+	return nil
+}
+
+func TestSmartBan(t *testing.T) {
+	s := NewSmartBan()
+	data := pieces{0: make([]byte, 32)}
+
+	// 两个peer各发一半，坏数据来自bad
+	s.Received(0, 0, 16, "good")
+	s.Received(0, 16, 16, "bad")
+	data[0][20] = 1
+	if ips := s.Failed(0, data); len(ips) != 0 {
+		t.Errorf("banned on failure %v", ips)
+	}
+	s.Received(0, 0, 16, "other")
+	s.Received(0, 16, 16, "other")
+	data[0][20] = 0
+	if ips := s.Passed(0, data); !reflect.DeepEqual(ips, []string{"bad"}) {
+		t.Errorf("banned %v", ips)
+	}
+	if ips := s.Passed(0, data); len(ips) != 0 {
+		t.Errorf("banned again %v", ips)
+	}
+
+	// 单独发送失败的piece太多次
+	data[1] = make([]byte, 16)
+	for i := 1; i <= s.MaxStrikes; i++ {
+		s.Received(1, 0, 16, "alone")
+		ips := s.Failed(1, data)
+		if i < s.MaxStrikes && len(ips) != 0 || i == s.MaxStrikes && !reflect.DeepEqual(ips, []string{"alone"}) {
+			t.Errorf("strike %d: %v", i, ips)
+		}
+	}
+}
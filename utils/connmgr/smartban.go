@@ -0,0 +1,145 @@
+package connmgr
+
+//
+// smart ban：记录每个块是哪个IP发来的。piece校验失败时保存各块的hash，
+// 重新下载后校验通过时，数据和正确数据不同的块的发送者就是发坏数据的peer。
+// 一个piece全部由同一个IP发来并且失败时记一次，次数太多也ban
+//
+
+import (
+	"crypto/sha1"
+	"sort"
+	"sync"
+)
+
+const DefaultMaxStrikes = 3
+
+// 读取已经写入的块，storage.Storage满足
+type BlockReader interface {
+	ReadBlock(piece, begin int, b []byte) error
+}
+
+type sender struct {
+	length int
+	ip     string
+}
+
+type record struct {
+	sender
+	sum [sha1.Size]byte
+}
+
+// 并发安全，读盘时不持有锁
+type SmartBan struct {
+	MaxStrikes int
+
+	mu      sync.Mutex
+	senders map[int]map[int]sender   // piece -> begin -> 最后写入的数据的发送者
+	failed  map[int]map[int][]record // piece -> begin -> 校验失败时的数据
+	strikes map[string]int
+}
+
+func NewSmartBan() *SmartBan {
+	return &SmartBan{
+		MaxStrikes: DefaultMaxStrikes,
+		senders:    make(map[int]map[int]sender),
+		failed:     make(map[int]map[int][]record),
+		strikes:    make(map[string]int),
+	}
+}
+
+// 收到并写入了一个块
+func (s *SmartBan) Received(piece, begin, length int, ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blocks := s.senders[piece]
+	if blocks == nil {
+		blocks = make(map[int]sender)
+		s.senders[piece] = blocks
+	}
+	blocks[begin] = sender{length, ip}
+}
+
+func sum(r BlockReader, piece, begin, length int) ([sha1.Size]byte, bool) {
+	b := make([]byte, length)
+	if err := r.ReadBlock(piece, begin, b); err != nil {
+		return [sha1.Size]byte{}, false
+	}
+	return sha1.Sum(b), true
+}
+
+// piece校验失败，保存各块数据的hash，返回应该ban的IP。
+// 调用时这个piece的数据不能再被修改
+func (s *SmartBan) Failed(piece int, r BlockReader) []string {
+	s.mu.Lock()
+	blocks := s.senders[piece]
+	delete(s.senders, piece)
+	s.mu.Unlock()
+	if len(blocks) == 0 {
+		return nil
+	}
+	sums := make(map[int][sha1.Size]byte)
+	for begin, snd := range blocks {
+		if h, ok := sum(r, piece, begin, snd.length); ok {
+			sums[begin] = h
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed := s.failed[piece]
+	if failed == nil {
+		failed = make(map[int][]record)
+		s.failed[piece] = failed
+	}
+	ips := make(map[string]bool)
+	for begin, snd := range blocks {
+		ips[snd.ip] = true
+		h, ok := sums[begin]
+		if !ok {
+			continue
+		}
+		dup := false
+		for _, rec := range failed[begin] {
+			dup = dup || rec == record{snd, h}
+		}
+		if !dup {
+			failed[begin] = append(failed[begin], record{snd, h})
+		}
+	}
+	if len(ips) != 1 {
+		return nil
+	}
+	for ip := range ips {
+		if s.strikes[ip]++; s.strikes[ip] >= s.MaxStrikes {
+			delete(s.strikes, ip)
+			return []string{ip}
+		}
+	}
+	return nil
+}
+
+// piece校验通过，和以前失败时的数据比较，返回发过坏数据的IP
+func (s *SmartBan) Passed(piece int, r BlockReader) []string {
+	s.mu.Lock()
+	failed := s.failed[piece]
+	delete(s.senders, piece)
+	delete(s.failed, piece)
+	s.mu.Unlock()
+
+	bad := make(map[string]bool)
+	for begin, records := range failed {
+		for _, rec := range records {
+			h, ok := sum(r, piece, begin, rec.length)
+			if ok && rec.sum != h {
+				bad[rec.ip] = true
+			}
+		}
+	}
+	var ips []string
+	for ip := range bad {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
@@ -0,0 +1,324 @@
+package hasher
+
+//
+// 并行计算piece的hash：一个goroutine按顺序预读数据，多个worker计算hash，
+// 同时在内存中的piece数量有上限。校验、制作种子、下载和重新校验共用
+//
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+)
+
+type Algorithm int
+
+const (
+	SHA1   Algorithm = iota // v1种子的piece hash
+	SHA256                  // v2种子
+)
+
+func (a Algorithm) New() hash.Hash {
+	if a == SHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case SHA1:
+		return "sha1"
+	case SHA256:
+		return "sha256"
+	}
+	return fmt.Sprintf("algorithm(%d)", int(a))
+}
+
+// 数据来源，ReadBlock在同一个goroutine中按加入的顺序调用
+type Source interface {
+	PieceSize(i int) int
+	ReadBlock(piece, begin int, b []byte) error
+}
+
+type Result struct {
+	Index int
+	Sum   []byte
+	Err   error // 读取数据失败
+}
+
+type Hasher struct {
+	Algorithm Algorithm
+	Workers   int  // 计算hash的goroutine数，默认为CPU数
+	Readahead int  // 同时在内存中的piece数，默认为Workers的2倍
+	Ordered   bool // 按加入的顺序返回结果
+
+	// 每个结果返回后调用，done和total是piece数，bytes是已经hash的字节数
+	Progress func(done, total int, bytes int64)
+}
+
+func New(algo Algorithm) *Hasher {
+	return &Hasher{Algorithm: algo}
+}
+
+// 计算pieces的hash，fn在同一个goroutine中依次调用。ctx取消时停止读取，返回ctx的错误
+func (h *Hasher) Run(ctx context.Context, src Source, pieces []int, fn func(Result)) error {
+	q := h.start(ctx, src, fn)
+	q.Add(pieces...)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.cancel()
+		case <-done:
+		}
+	}()
+	q.Close()
+	close(done)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.canceled {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// 计算全部piece的hash
+func (h *Hasher) All(ctx context.Context, src Source, n int, fn func(Result)) error {
+	pieces := make([]int, n)
+	for i := range pieces {
+		pieces[i] = i
+	}
+	return h.Run(ctx, src, pieces, fn)
+}
+
+type job struct {
+	seq int
+	Result
+	b []byte
+}
+
+// 可以随时加入piece的队列，下载时收齐一个piece就加入
+type Queue struct {
+	h   *Hasher
+	ctx context.Context
+	src Source
+	fn  func(Result)
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []int
+	added    int
+	closed   bool
+	canceled bool
+
+	free    chan []byte
+	jobs    chan job
+	results chan job
+	done    chan struct{}
+}
+
+// 启动读取和计算的goroutine，用Close结束
+func (h *Hasher) Start(src Source, fn func(Result)) *Queue {
+	return h.start(context.Background(), src, fn)
+}
+
+func (h *Hasher) start(ctx context.Context, src Source, fn func(Result)) *Queue {
+	workers := h.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	readahead := h.Readahead
+	if readahead <= 0 {
+		readahead = 2 * workers
+	}
+	if readahead < workers {
+		readahead = workers
+	}
+	q := &Queue{
+		h:       h,
+		ctx:     ctx,
+		src:     src,
+		fn:      fn,
+		free:    make(chan []byte, readahead),
+		jobs:    make(chan job, readahead),
+		results: make(chan job, readahead),
+		done:    make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	// 缓冲区在第一次使用时分配
+	for i := 0; i < readahead; i++ {
+		q.free <- nil
+	}
+
+	go q.readLoop()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(q.results)
+	}()
+	go q.deliver()
+	return q
+}
+
+// 加入piece，不会阻塞
+func (q *Queue) Add(pieces ...int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.pending = append(q.pending, pieces...)
+	q.added += len(pieces)
+	q.cond.Signal()
+}
+
+// 不再加入，等待已加入的piece全部完成
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Signal()
+	q.mu.Unlock()
+	<-q.done
+}
+
+// 丢弃还没有读取的piece
+func (q *Queue) cancel() {
+	q.mu.Lock()
+	q.cancelLocked()
+	q.mu.Unlock()
+}
+
+func (q *Queue) cancelLocked() {
+	q.added -= len(q.pending)
+	q.pending = nil
+	q.canceled = true
+	q.cond.Signal()
+}
+
+func (q *Queue) next() (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 && !q.closed && !q.canceled {
+		q.cond.Wait()
+	}
+	if q.ctx.Err() != nil {
+		q.cancelLocked()
+	}
+	if len(q.pending) == 0 {
+		return 0, false
+	}
+	i := q.pending[0]
+	q.pending = q.pending[1:]
+	return i, true
+}
+
+func (q *Queue) readLoop() {
+	defer close(q.jobs)
+	for seq := 0; ; seq++ {
+		i, ok := q.next()
+		if !ok {
+			return
+		}
+		b := <-q.free
+		size := q.src.PieceSize(i)
+		if cap(b) < size {
+			b = make([]byte, size)
+		}
+		b = b[:size]
+		err := q.src.ReadBlock(i, 0, b)
+		q.jobs <- job{seq: seq, Result: Result{Index: i, Err: err}, b: b}
+	}
+}
+
+func (q *Queue) work() {
+	h := q.h.Algorithm.New()
+	for j := range q.jobs {
+		if j.Err == nil {
+			h.Reset()
+			h.Write(j.b)
+			j.Sum = h.Sum(nil)
+		}
+		q.results <- j
+	}
+}
+
+func (q *Queue) deliver() {
+	defer close(q.done)
+	var (
+		next    int
+		count   int
+		bytes   int64
+		waiting = make(map[int]job) // 按顺序返回时，还没轮到的结果
+	)
+	emit := func(j job) {
+		q.fn(j.Result)
+		count++
+		if j.Err == nil {
+			bytes += int64(len(j.b))
+		}
+		if q.h.Progress != nil {
+			q.mu.Lock()
+			total := q.added
+			q.mu.Unlock()
+			q.h.Progress(count, total, bytes)
+		}
+	}
+	for j := range q.results {
+		b := j.b
+		if !q.h.Ordered {
+			emit(j)
+		} else {
+			waiting[j.seq] = j
+			for {
+				w, ok := waiting[next]
+				if !ok {
+					break
+				}
+				delete(waiting, next)
+				next++
+				emit(w)
+			}
+		}
+		q.free <- b[:0]
+	}
+}
+
+// 从io.Reader顺序读取的数据来源，用于制作种子
+type reader struct {
+	r           io.Reader
+	pieceLength int64
+	total       int64
+}
+
+// 依次读出全部数据，只能按顺序hash所有piece
+func NewReader(r io.Reader, pieceLength, total int64) Source {
+	return &reader{r: r, pieceLength: pieceLength, total: total}
+}
+
+func (r *reader) PieceSize(i int) int {
+	if rest := r.total - int64(i)*r.pieceLength; rest < r.pieceLength {
+		return int(rest)
+	}
+	return int(r.pieceLength)
+}
+
+func (r *reader) ReadBlock(piece, begin int, b []byte) error {
+	_, err := io.ReadFull(r.r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package hasher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// 内存中的数据，bad中的piece读取失败
+type memSource struct {
+	data        []byte
+	pieceLength int
+	bad         map[int]bool
+}
+
+func (m *memSource) PieceSize(i int) int {
+	if rest := len(m.data) - i*m.pieceLength; rest < m.pieceLength {
+		return rest
+	}
+	return m.pieceLength
+}
+
+func (m *memSource) ReadBlock(piece, begin int, b []byte) error {
+	if m.bad[piece] {
+		return errors.New("bad piece")
+	}
+	copy(b, m.data[piece*m.pieceLength+begin:])
+	return nil
+}
+
+func newSource(size, pieceLength int) *memSource {
+	data := make([]byte, size)
+	rand.Read(data)
+	return &memSource{data: data, pieceLength: pieceLength}
+}
+
+func (m *memSource) numPieces() int {
+	return (len(m.data) + m.pieceLength - 1) / m.pieceLength
+}
+
+func TestOrdered(t *testing.T) {
+	src := newSource(100000, 1000)
+	src.bad = map[int]bool{7: true}
+	h := New(SHA1)
+	h.Workers, h.Ordered = 4, true
+	var last, total int
+	h.Progress = func(done, n int, _ int64) { last, total = done, n }
+
+	next := 0
+	err := h.All(context.Background(), src, src.numPieces(), func(r Result) {
+		if r.Index != next {
+			t.Fatalf("piece %d, expected %d", r.Index, next)
+		}
+		next++
+		if r.Index == 7 {
+			if r.Err == nil {
+				t.Error("bad piece hashed")
+			}
+			return
+		}
+		want := sha1.Sum(src.data[r.Index*1000 : r.Index*1000+src.PieceSize(r.Index)])
+		if !bytes.Equal(r.Sum, want[:]) {
+			t.Errorf("piece %d hash", r.Index)
+		}
+	})
+	if err != nil || next != 100 || last != 100 || total != 100 {
+		t.Errorf("err %v, %d results, progress %d/%d", err, next, last, total)
+	}
+}
+
+func TestUnordered(t *testing.T) {
+	src := newSource(50500, 1000)
+	h := New(SHA256)
+	seen := make(map[int]bool)
+	err := h.Run(context.Background(), src, []int{50, 3, 10, 3}, func(r Result) {
+		want := sha256.Sum256(src.data[r.Index*1000 : r.Index*1000+src.PieceSize(r.Index)])
+		if !bytes.Equal(r.Sum, want[:]) {
+			t.Errorf("piece %d hash", r.Index)
+		}
+		seen[r.Index] = true
+	})
+	if err != nil || len(seen) != 3 || !seen[50] {
+		t.Errorf("err %v, results %v", err, seen)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	src := newSource(1000000, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	h := New(SHA1)
+	h.Workers, h.Readahead = 2, 2
+	n := 0
+	err := h.All(ctx, src, src.numPieces(), func(r Result) {
+		if n++; n == 10 {
+			cancel()
+		}
+	})
+	if err != context.Canceled || n >= src.numPieces() {
+		t.Errorf("err %v after %d results", err, n)
+	}
+}
+
+func TestReader(t *testing.T) {
+	src := newSource(2500, 1000)
+	r := NewReader(bytes.NewReader(src.data), 1000, 2500)
+	var sums []byte
+	New(SHA1).All(context.Background(), r, 3, func(r Result) {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		sums = append(sums, r.Sum...)
+	})
+	var want []byte
+	for i := 0; i < 3; i++ {
+		h := sha1.Sum(src.data[i*1000 : i*1000+src.PieceSize(i)])
+		want = append(want, h[:]...)
+	}
+	if !bytes.Equal(sums, want) {
+		t.Error("reader hashes")
+	}
+
+	// 数据不够时报错
+	short := NewReader(bytes.NewReader(src.data[:1500]), 1000, 2500)
+	var errs int
+	New(SHA1).All(context.Background(), short, 3, func(r Result) {
+		if r.Err != nil {
+			errs++
+		}
+	})
+	if errs != 2 {
+		t.Errorf("%d short reads", errs)
+	}
+}
+
+func benchmark(b *testing.B, algo Algorithm, workers int) {
+	src := newSource(64<<20, 256<<10)
+	h := New(algo)
+	h.Workers = workers
+	b.SetBytes(int64(len(src.data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.All(context.Background(), src, src.numPieces(), func(Result) {})
+	}
+}
+
+func BenchmarkSHA1(b *testing.B)         { benchmark(b, SHA1, 0) }
+func BenchmarkSHA1Single(b *testing.B)   { benchmark(b, SHA1, 1) }
+func BenchmarkSHA256(b *testing.B)       { benchmark(b, SHA256, 0) }
+func BenchmarkSHA256Single(b *testing.B) { benchmark(b, SHA256, 1) }
@@ -0,0 +1,76 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	"github.com/openqt/whonet/utils/network"
+)
+
+// 明文握手的开头
+var plainHeader = []byte("\x13BitTorrent protocol")
+
+// 按策略建立主动连接，skey为info_hash。Preferred时加密握手失败会用明文重新连接
+func Dial(ctx context.Context, d network.Dialer, addr string, skey []byte, policy Policy) (net.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if policy == Disabled || policy == Enabled {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	c, err := Initiate(nc, skey, policy.Provide(), nil)
+	if err == nil {
+		nc.SetDeadline(time.Time{})
+		return c, nil
+	}
+	nc.Close()
+	if policy == Required {
+		return nil, err
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// 处理监听端口上的连接，根据开头的数据自动区分明文和加密
+func Accept(nc net.Conn, lookup func(req2 [20]byte) []byte, policy Policy) (net.Conn, error) {
+	r := bufio.NewReader(nc)
+	head, err := r.Peek(len(plainHeader))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head, plainHeader) {
+		if policy == Required {
+			return nil, ErrPolicy
+		}
+		return &Conn{Conn: nc, r: r}, nil
+	}
+	if policy == Disabled {
+		return nil, ErrPolicy
+	}
+	c, _, err := Receive(nc, r, lookup, policy)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 按策略加密的Dialer，满足network.Dialer接口
+type Dialer struct {
+	Forward network.Dialer // 为nil时直接连接
+	SKey    []byte
+	Policy  Policy
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return Dial(ctx, d.Forward, addr, d.SKey, d.Policy)
+}
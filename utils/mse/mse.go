@@ -0,0 +1,376 @@
+package mse
+
+//
+// Message Stream Encryption / Protocol Encryption
+// 参考 https://wiki.vuze.com/w/Message_Stream_Encryption
+//
+// A为发起方，B为接收方：
+//   1 A->B: Ya, PadA
+//   2 B->A: Yb, PadB
+//   3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+//           ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+//   4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+//   5 A->B: ENCRYPT2(Payload Stream)
+//
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	CryptoPlaintext = 0x01
+	CryptoRC4       = 0x02
+
+	keySize = 96  // 768位
+	maxPad  = 512 // PadA/PadB/PadC/PadD的最大长度
+)
+
+var (
+	prime, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	vc = make([]byte, 8) // 验证常量，8个0
+
+	ErrNoSync     = errors.New("mse: synchronization failed")
+	ErrUnknownKey = errors.New("mse: unknown info hash")
+	ErrNoCrypto   = errors.New("mse: no common crypto method")
+	ErrPolicy     = errors.New("mse: connection refused by encryption policy")
+)
+
+// 加密策略
+type Policy int
+
+const (
+	Disabled  Policy = iota // 只使用明文
+	Enabled                 // 主动连接使用明文，接受加密连接
+	Preferred               // 主动连接优先加密，失败时用明文重试
+	Required                // 只使用加密连接
+)
+
+var policyNames = []string{"disabled", "enabled", "preferred", "required"}
+
+func (p Policy) String() string {
+	if p >= 0 && int(p) < len(policyNames) {
+		return policyNames[p]
+	}
+	return fmt.Sprintf("policy(%d)", int(p))
+}
+
+// 解析配置中的策略名，为空时是enabled
+func ParsePolicy(s string) (Policy, error) {
+	if s == "" {
+		return Enabled, nil
+	}
+	for i, name := range policyNames {
+		if strings.EqualFold(s, name) {
+			return Policy(i), nil
+		}
+	}
+	return Disabled, fmt.Errorf("mse: unknown encryption policy %q", s)
+}
+
+// 握手中提供的加密方式
+func (p Policy) Provide() uint32 {
+	switch p {
+	case Disabled:
+		return CryptoPlaintext
+	case Required:
+		return CryptoRC4
+	}
+	return CryptoPlaintext | CryptoRC4
+}
+
+// 接收方从对方提供的方式中选择一个
+func (p Policy) Select(provide uint32) uint32 {
+	provide &= p.Provide()
+	switch {
+	case provide&CryptoRC4 != 0 && (p != Enabled || provide&CryptoPlaintext == 0):
+		return CryptoRC4
+	case provide&CryptoPlaintext != 0:
+		return CryptoPlaintext
+	case provide&CryptoRC4 != 0:
+		return CryptoRC4
+	}
+	return 0
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// HASH('req2', SKEY)，接收方用它识别种子
+func Req2(skey []byte) [20]byte {
+	var h [20]byte
+	copy(h[:], hash([]byte("req2"), skey))
+	return h
+}
+
+// 生成DH私钥和公钥
+func newKey() (*big.Int, []byte, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(b)
+	y := new(big.Int).Exp(generator, x, prime)
+	return x, pad(y), nil
+}
+
+// 大整数转换为96字节，高位补0
+func pad(n *big.Int) []byte {
+	b := n.Bytes()
+	out := make([]byte, keySize)
+	copy(out[keySize-len(b):], b)
+	return out
+}
+
+func secret(x *big.Int, y []byte) []byte {
+	return pad(new(big.Int).Exp(new(big.Int).SetBytes(y), x, prime))
+}
+
+// RC4并丢弃前1024字节
+func newCipher(key string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(key), s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() []byte {
+	b := make([]byte, mrand.Intn(maxPad+1))
+	rand.Read(b)
+	return b
+}
+
+// 在r中查找pattern，最多跳过max字节
+func synchronize(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, len(pattern))
+	for read := 0; read < max+len(pattern); read++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			window = append(window[:0], window[1:]...)
+		}
+		window = append(window, c)
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+	return ErrNoSync
+}
+
+// 加密后的连接；选择明文时握手之后的数据不加密
+type Conn struct {
+	net.Conn
+	Selected uint32 // 协商的加密方式，0表示没有使用MSE握手
+
+	r   io.Reader
+	enc *rc4.Cipher
+	wmu sync.Mutex
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// 解密读取
+type cipherReader struct {
+	r   io.Reader
+	dec *rc4.Cipher
+}
+
+func (r *cipherReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.dec.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func readFull(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// 发起方握手。skey为info_hash，ia为随握手发送的初始数据，可以为空
+func Initiate(nc net.Conn, skey []byte, provide uint32, ia []byte) (*Conn, error) {
+	x, ya, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := nc.Write(append(ya, randomPad()...)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	yb, err := readFull(br, keySize)
+	if err != nil {
+		return nil, err
+	}
+	s := secret(x, yb)
+	enc := newCipher("keyA", s, skey)
+	dec := newCipher("keyB", s, skey)
+
+	req2 := Req2(skey)
+	req3 := hash([]byte("req3"), s)
+	for i := range req3 {
+		req3[i] ^= req2[i]
+	}
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), s))
+	msg.Write(req3)
+	plain := make([]byte, 16+len(ia))
+	binary.BigEndian.PutUint32(plain[8:], provide)
+	// 不使用PadC，len(PadC)为0
+	binary.BigEndian.PutUint16(plain[14:], uint16(len(ia)))
+	copy(plain[16:], ia)
+	enc.XORKeyStream(plain, plain)
+	msg.Write(plain)
+	if _, err := nc.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// B加密后的VC，用来跳过PadB
+	encVC := make([]byte, len(vc))
+	newCipher("keyB", s, skey).XORKeyStream(encVC, vc)
+	if err := synchronize(br, encVC, maxPad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(make([]byte, len(vc)), encVC)
+
+	cr := &cipherReader{r: br, dec: dec}
+	b, err := readFull(cr, 6)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(b)
+	if selected&provide == 0 || (selected != CryptoPlaintext && selected != CryptoRC4) {
+		return nil, ErrNoCrypto
+	}
+	if n := int(binary.BigEndian.Uint16(b[4:])); n > maxPad {
+		return nil, ErrNoSync
+	} else if _, err := readFull(cr, n); err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: nc, Selected: selected, r: cr, enc: enc}
+	if selected == CryptoPlaintext {
+		c.r, c.enc = br, nil
+	}
+	return c, nil
+}
+
+// 接收方握手，r中可以有已经读入的数据。lookup根据HASH('req2', SKEY)返回SKEY，
+// 找不到时返回nil。返回的连接会先读出对方随握手发送的IA
+func Receive(nc net.Conn, r *bufio.Reader, lookup func(req2 [20]byte) []byte, policy Policy) (*Conn, []byte, error) {
+	if r == nil {
+		r = bufio.NewReader(nc)
+	}
+	ya, err := readFull(r, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	x, yb, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := nc.Write(append(yb, randomPad()...)); err != nil {
+		return nil, nil, err
+	}
+
+	s := secret(x, ya)
+	if err := synchronize(r, hash([]byte("req1"), s), maxPad); err != nil {
+		return nil, nil, err
+	}
+	b, err := readFull(r, 20)
+	if err != nil {
+		return nil, nil, err
+	}
+	var req2 [20]byte
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] = b[i] ^ req3[i]
+	}
+	skey := lookup(req2)
+	if skey == nil {
+		return nil, nil, ErrUnknownKey
+	}
+
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+	cr := &cipherReader{r: r, dec: dec}
+	b, err = readFull(cr, 14)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(b[:8], vc) {
+		return nil, nil, ErrNoSync
+	}
+	provide := binary.BigEndian.Uint32(b[8:])
+	if n := int(binary.BigEndian.Uint16(b[12:])); n > maxPad {
+		return nil, nil, ErrNoSync
+	} else if _, err := readFull(cr, n); err != nil {
+		return nil, nil, err
+	}
+	b, err = readFull(cr, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	ia, err := readFull(cr, int(binary.BigEndian.Uint16(b)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected := policy.Select(provide)
+	// VC, crypto_select, 不使用PadD
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint32(reply[8:], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, err := nc.Write(reply); err != nil {
+		return nil, nil, err
+	}
+	if selected == 0 {
+		return nil, nil, ErrNoCrypto
+	}
+
+	c := &Conn{Conn: nc, Selected: selected, r: cr, enc: enc}
+	if selected == CryptoPlaintext {
+		c.r, c.enc = r, nil
+	}
+	if len(ia) > 0 {
+		c.r = io.MultiReader(bytes.NewReader(ia), c.r)
+	}
+	return c, skey, nil
+}
@@ -0,0 +1,183 @@
+package mse
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录收到的原始数据
+type recordConn struct {
+	net.Conn
+	mu  sync.Mutex
+	raw bytes.Buffer
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.raw.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recordConn) Raw() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.raw.Bytes()...)
+}
+
+type result struct {
+	conn net.Conn
+	raw  *recordConn
+	err  error
+}
+
+// 监听端口，用指定的策略接受连接
+func listen(t *testing.T, skey []byte, policy Policy) (string, chan result) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan result, 4)
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			rc := &recordConn{Conn: nc}
+			c, err := Accept(rc, func(req2 [20]byte) []byte {
+				if req2 == Req2(skey) {
+					return skey
+				}
+				return nil
+			}, policy)
+			if err != nil {
+				nc.Close()
+			}
+			ch <- result{conn: c, raw: rc, err: err}
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestPolicies(t *testing.T) {
+	skey := []byte("ABCDEFGHIJKLMNOPQRST")
+	handshake := append(append([]byte(nil), plainHeader...), bytes.Repeat([]byte{'x'}, 48)...)
+
+	for _, tc := range []struct {
+		out, in Policy
+		ok      bool
+		crypto  uint32 // 0为明文连接
+	}{
+		{Disabled, Enabled, true, 0},
+		{Enabled, Required, false, 0},
+		{Preferred, Enabled, true, CryptoPlaintext},
+		{Preferred, Preferred, true, CryptoRC4},
+		{Preferred, Disabled, true, 0}, // 加密失败后明文重连
+		{Required, Enabled, true, CryptoRC4},
+		{Required, Disabled, false, 0},
+	} {
+		address, accepted := listen(t, skey, tc.in)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c, err := Dial(ctx, nil, address, skey, tc.out)
+		if err == nil {
+			_, err = c.Write(handshake)
+		}
+		r := <-accepted
+		if r.err != nil && tc.out == Preferred && err == nil {
+			r = <-accepted
+		}
+		cancel()
+		if err == nil {
+			err = r.err
+		}
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%v -> %v: connected", tc.out, tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v -> %v: %v", tc.out, tc.in, err)
+			continue
+		}
+
+		got := make([]byte, len(handshake))
+		if _, err := io.ReadFull(r.conn, got); err != nil || !bytes.Equal(got, handshake) {
+			t.Errorf("%v -> %v: read %q %v", tc.out, tc.in, got, err)
+		}
+		r.conn.Write([]byte("reply"))
+		got = make([]byte, 5)
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != "reply" {
+			t.Errorf("%v -> %v: reply %q %v", tc.out, tc.in, got, err)
+		}
+
+		if selected := r.conn.(*Conn).Selected; selected != tc.crypto {
+			t.Errorf("%v -> %v: selected %d, want %d", tc.out, tc.in, selected, tc.crypto)
+		}
+		if tc.crypto == CryptoRC4 && bytes.Contains(r.raw.Raw(), plainHeader) {
+			t.Errorf("%v -> %v: plaintext on the wire", tc.out, tc.in)
+		}
+		c.Close()
+		r.conn.Close()
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	address, accepted := listen(t, []byte("ABCDEFGHIJKLMNOPQRST"), Required)
+	nc, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	go Initiate(nc, []byte("01234567890123456789"), CryptoRC4, nil)
+	if r := <-accepted; r.err != ErrUnknownKey {
+		t.Errorf("unknown key: %v", r.err)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, s := range []string{"disabled", "Enabled", "preferred", "REQUIRED"} {
+		if p, err := ParsePolicy(s); err != nil || !strings.EqualFold(p.String(), s) {
+			t.Errorf("%s: %v %v", s, p, err)
+		}
+	}
+	if p, err := ParsePolicy(""); err != nil || p != Enabled {
+		t.Errorf("default %v", p)
+	}
+	if _, err := ParsePolicy("always"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestInitialPayload(t *testing.T) {
+	skey := []byte("ABCDEFGHIJKLMNOPQRST")
+	address, accepted := listen(t, skey, Enabled)
+	nc, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	c, err := Initiate(nc, skey, CryptoRC4, []byte("initial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte(" stream"))
+
+	r := <-accepted
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	got := make([]byte, 14)
+	if _, err := io.ReadFull(r.conn, got); err != nil || string(got) != "initial stream" {
+		t.Errorf("read %q %v", got, err)
+	}
+}
@@ -0,0 +1,189 @@
+package network
+
+//
+// Tracker使用的HTTP客户端，支持代理、TLS选项、User-Agent
+// 以及按tracker设置的额外header和cookie
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// 单个tracker的额外设置，用于需要登录的私有tracker。
+// 每项是name=value，用列表而不是map，配置文件中名字的大小写不会丢失
+type Site struct {
+	Headers []string `mapstructure:"headers"`
+	Cookies []string `mapstructure:"cookies"`
+}
+
+// 拆分name=value
+func splitPair(s string) (name, value string, err error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return "", "", errors.New("expect name=value: " + s)
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), nil
+}
+
+func (s Site) check() error {
+	for _, h := range append(s.Headers, s.Cookies...) {
+		if _, _, err := splitPair(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 网络设置
+type Config struct {
+	Proxy      string          `mapstructure:"proxy"`       // http://、https://或socks5://，为空时使用环境变量。设置后不使用udp tracker
+	ProxyPeers bool            `mapstructure:"proxy_peers"` // peer连接也经过socks5代理
+	CAFile     string          `mapstructure:"ca_file"`     // 额外信任的CA证书
+	Insecure   bool            `mapstructure:"insecure"`    // 不校验服务端证书
+	UserAgent  string          `mapstructure:"user_agent"`
+	Timeout    time.Duration   `mapstructure:"timeout"`
+	Sites      map[string]Site `mapstructure:"trackers"`   // 以主机名或host:port为键
+	Encryption string          `mapstructure:"encryption"` // peer连接加密策略：disabled、enabled、preferred或required
+	Transport  string          `mapstructure:"transport"`  // peer连接方式：prefer-utp、prefer-tcp、utp或tcp
+}
+
+// 当前使用的设置
+var Default = &Config{}
+
+// 代理地址，未设置时从HTTPS_PROXY/HTTP_PROXY环境变量获取
+func (c *Config) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if c.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(c.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.New("unsupported proxy scheme: " + u.Scheme)
+	}
+	return http.ProxyURL(u), nil
+}
+
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + c.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+// 根据设置创建HTTP客户端
+func NewHTTPClient(c *Config) (*http.Client, error) {
+	for host, site := range c.Sites {
+		if err := site.check(); err != nil {
+			return nil, errors.New(host + ": " + err.Error())
+		}
+	}
+	proxy, err := c.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	tlsConf, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConf,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &http.Client{
+		Transport: &siteTransport{base: transport, config: c},
+		Timeout:   c.Timeout,
+	}, nil
+}
+
+// 为请求加上User-Agent及站点的header和cookie
+type siteTransport struct {
+	base   http.RoundTripper
+	config *Config
+}
+
+func (t *siteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// 主机名不区分大小写，配置中的键也是小写
+	site, ok := t.config.Sites[strings.ToLower(r.URL.Host)]
+	if !ok {
+		site, ok = t.config.Sites[strings.ToLower(r.URL.Hostname())]
+	}
+	if !ok && t.config.UserAgent == "" {
+		return t.base.RoundTrip(r)
+	}
+
+	r = r.Clone(r.Context()) // RoundTripper不能修改原请求
+	if t.config.UserAgent != "" {
+		r.Header.Set("User-Agent", t.config.UserAgent)
+	}
+	for _, h := range site.Headers {
+		k, v, _ := splitPair(h)
+		// 保持配置中的写法，不转换为规范形式
+		r.Header.Del(k)
+		r.Header[k] = []string{v}
+	}
+	if len(site.Cookies) > 0 {
+		var cookies []string
+		for _, c := range site.Cookies {
+			k, v, _ := splitPair(c)
+			cookies = append(cookies, (&http.Cookie{Name: k, Value: v}).String())
+		}
+		if c := r.Header.Get("Cookie"); c != "" {
+			cookies = append([]string{c}, cookies...)
+		}
+		r.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	return t.base.RoundTrip(r)
+}
+
+// 设置了代理。UDP请求无法经过HTTP代理，为了不暴露真实地址不使用udp tracker
+func (c *Config) Proxied() bool {
+	return c.Proxy != ""
+}
+
+// peer连接使用的Dialer，ProxyPeers时经过socks5代理
+func (c *Config) PeerDialer() (Dialer, error) {
+	if !c.ProxyPeers {
+		return &net.Dialer{Timeout: 30 * time.Second}, nil
+	}
+	proxy := c.Proxy
+	if proxy == "" {
+		proxy = os.Getenv("ALL_PROXY")
+	}
+	if proxy == "" {
+		proxy = os.Getenv("HTTPS_PROXY")
+	}
+	return NewSOCKS5(proxy)
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/spf13/viper"
+)
+
+// 测试用的SOCKS5服务，只支持CONNECT和用户名密码认证
+func socksServer(t *testing.T, user, pass string) (string, func() int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.CheckError(err)
+	count := 0
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			count++
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 512)
+				io.ReadFull(c, buf[:2])
+				io.ReadFull(c, buf[:buf[1]])
+				if user != "" {
+					c.Write([]byte{5, 2})
+					io.ReadFull(c, buf[:2])
+					u := make([]byte, buf[1])
+					io.ReadFull(c, u)
+					io.ReadFull(c, buf[:1])
+					p := make([]byte, buf[0])
+					io.ReadFull(c, p)
+					if string(u) != user || string(p) != pass {
+						c.Write([]byte{1, 1})
+						return
+					}
+					c.Write([]byte{1, 0})
+				} else {
+					c.Write([]byte{5, 0})
+				}
+
+				io.ReadFull(c, buf[:4])
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(c, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(c, buf[:1])
+					n := int(buf[0])
+					io.ReadFull(c, buf[:n])
+					host = string(buf[:n])
+				}
+				io.ReadFull(c, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+				if err != nil {
+					c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+				go io.Copy(target, c)
+				io.Copy(c, target)
+			}(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String(), func() int { return count }
+}
+
+func TestSOCKS5(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.CheckError(err)
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	addr, _ := socksServer(t, "user", "secret")
+	d, err := NewSOCKS5("socks5://user:secret@" + addr)
+	utils.CheckError(err)
+	c, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	io.ReadFull(c, buf)
+	c.Close()
+	if string(buf) != "ping" {
+		t.Errorf("echo %q", buf)
+	}
+
+	d.Password = "wrong"
+	if _, err := d.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Error("bad password accepted")
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	var got *http.Request
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer ts.Close()
+
+	// 不信任自签名证书
+	client, err := NewHTTPClient(&Config{})
+	utils.CheckError(err)
+	if _, err := client.Get(ts.URL); err == nil {
+		t.Error("self-signed certificate accepted")
+	}
+
+	// 使用CA文件
+	f, err := ioutil.TempFile("", "ca")
+	utils.CheckError(err)
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	f.Close()
+
+	// 和命令行一样从配置文件读取，cookie名字区分大小写
+	v := viper.New()
+	v.SetConfigType("yaml")
+	utils.CheckError(v.ReadConfig(strings.NewReader(`
+network:
+  user_agent: whonet/test
+  trackers:
+    127.0.0.1:
+      headers:
+        - X-PassKey=abc=
+      cookies:
+        - UID=42
+`)))
+	conf := &Config{}
+	utils.CheckError(v.UnmarshalKey("network", conf))
+	proxy, count := socksServer(t, "", "")
+	conf.Proxy = "socks5://" + proxy
+	conf.CAFile = f.Name()
+	client, err = NewHTTPClient(conf)
+	utils.CheckError(err)
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got.UserAgent() != "whonet/test" || got.Header.Get("X-Passkey") != "abc=" {
+		t.Errorf("headers %v", got.Header)
+	}
+	if c, err := got.Cookie("UID"); err != nil || c.Value != "42" {
+		t.Errorf("cookie %v", got.Header.Get("Cookie"))
+	}
+	if count() != 1 {
+		t.Errorf("proxy not used")
+	}
+
+	conf.Sites["127.0.0.1"] = Site{Cookies: []string{"uid"}}
+	if _, err := NewHTTPClient(conf); err == nil {
+		t.Error("invalid cookie accepted")
+	}
+}
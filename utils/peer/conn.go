@@ -0,0 +1,226 @@
+package peer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	BlockSize         = 16 * 1024 // 请求的标准块大小
+	DefaultMaxMessage = 256 * 1024
+)
+
+// 对net.Conn的封装，负责消息的读写
+type Conn struct {
+	net.Conn
+	MaxMessage int // 超过这个长度的消息视为错误
+
+	r     *bufio.Reader
+	buf   []byte // 读缓冲，消息内容指向这里
+	state bool   // 已经收到过have、bitfield等表示对方拥有的piece的消息
+
+	// 双方握手中的保留位
+	local, remote Reserved
+
+	wmu  sync.Mutex
+	wbuf [17]byte
+
+	// 统计，包括协议开销
+	readBytes, writeBytes int64
+	lastRead, lastWrite   time.Time
+	statsMu               sync.Mutex
+}
+
+func NewConn(c net.Conn) *Conn {
+	return &Conn{
+		Conn:       c,
+		MaxMessage: DefaultMaxMessage,
+		r:          bufio.NewReaderSize(c, 32*1024),
+	}
+}
+
+// 主动连接时的握手：发送自己的握手，读取对方握手并检查info_hash
+func (c *Conn) Handshake(h *Handshake) (*Handshake, error) {
+	if err := c.WriteHandshake(h); err != nil {
+		return nil, err
+	}
+	other, err := c.ReadHandshake()
+	if err != nil {
+		return nil, err
+	}
+	if other.InfoHash != h.InfoHash {
+		return nil, ErrInfoHash
+	}
+	return other, nil
+}
+
+func (c *Conn) WriteHandshake(h *Handshake) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	err := WriteHandshake(c.Conn, h)
+	c.local = h.Reserved
+	c.count(0, HandshakeSize)
+	return err
+}
+
+func (c *Conn) ReadHandshake() (*Handshake, error) {
+	h, err := ReadHandshake(c.r)
+	if err == nil {
+		c.remote = h.Reserved
+	}
+	c.count(HandshakeSize, 0)
+	return h, err
+}
+
+// 双方是否都支持某个扩展
+func (c *Conn) Supports(bit int) bool {
+	return c.local.Has(bit) && c.remote.Has(bit)
+}
+
+// 读取一条消息。消息中的切片指向内部缓冲，下次调用ReadMessage后失效
+func (c *Conn) ReadMessage() (Message, error) {
+	var m Message
+	var lb [4]byte
+	if _, err := io.ReadFull(c.r, lb[:]); err != nil {
+		return m, err
+	}
+	n := int(binary.BigEndian.Uint32(lb[:]))
+	if n == 0 {
+		m.KeepAlive = true
+		c.count(4, 0)
+		return m, nil
+	}
+	if n > c.MaxMessage || n < 0 {
+		return m, ErrMessageSize
+	}
+
+	if cap(c.buf) < n {
+		c.buf = make([]byte, n)
+	}
+	b := c.buf[:n]
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return m, err
+	}
+	c.count(4+n, 0)
+
+	m.Id = MessageId(b[0])
+	if err := c.check(m.Id); err != nil {
+		return m, err
+	}
+	return m, m.parse(b[1:])
+}
+
+// 检查消息是否符合协商结果和顺序。bitfield之前可以有扩展握手等消息，
+// 但不能有其他表示拥有的piece的消息
+func (c *Conn) check(id MessageId) error {
+	fast := c.Supports(BitFast)
+	if isFastMessage(id) && !fast {
+		return ErrNotNegotiated
+	}
+	if id == MsgExtended && !c.Supports(BitExtension) {
+		return ErrNotNegotiated
+	}
+	switch id {
+	case MsgBitfield, MsgHaveAll, MsgHaveNone:
+		if c.state {
+			return ErrBitfieldOrder
+		}
+		c.state = true
+	case MsgHave:
+		c.state = true
+	}
+	return nil
+}
+
+// 写一条消息，piece等数据部分直接写出不复制
+func (c *Conn) WriteMessage(m *Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	head, data := m.header(c.wbuf[:])
+	var err error
+	if len(data) == 0 {
+		_, err = c.Conn.Write(head)
+	} else {
+		bufs := net.Buffers{head, data}
+		_, err = bufs.WriteTo(c.Conn)
+	}
+	c.count(0, len(head)+len(data))
+	return err
+}
+
+func (c *Conn) count(read, written int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	now := time.Now()
+	if read > 0 {
+		c.readBytes += int64(read)
+		c.lastRead = now
+	}
+	if written > 0 {
+		c.writeBytes += int64(written)
+		c.lastWrite = now
+	}
+}
+
+// 读写的总字节数，包括协议开销
+func (c *Conn) Stats() (read, written int64) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.readBytes, c.writeBytes
+}
+
+// 最后一次读写的时间
+func (c *Conn) LastActive() (read, written time.Time) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.lastRead, c.lastWrite
+}
+
+func (c *Conn) KeepAlive() error {
+	return c.WriteMessage(&Message{KeepAlive: true})
+}
+
+func (c *Conn) Choke() error {
+	return c.WriteMessage(&Message{Id: MsgChoke})
+}
+
+func (c *Conn) Unchoke() error {
+	return c.WriteMessage(&Message{Id: MsgUnchoke})
+}
+
+func (c *Conn) Interested() error {
+	return c.WriteMessage(&Message{Id: MsgInterested})
+}
+
+func (c *Conn) NotInterested() error {
+	return c.WriteMessage(&Message{Id: MsgNotInterested})
+}
+
+func (c *Conn) Have(index uint32) error {
+	return c.WriteMessage(&Message{Id: MsgHave, Index: index})
+}
+
+func (c *Conn) Bitfield(b []byte) error {
+	return c.WriteMessage(&Message{Id: MsgBitfield, Bitfield: b})
+}
+
+func (c *Conn) Request(index, begin, length uint32) error {
+	return c.WriteMessage(&Message{Id: MsgRequest, Index: index, Begin: begin, Length: length})
+}
+
+func (c *Conn) Piece(index, begin uint32, block []byte) error {
+	return c.WriteMessage(&Message{Id: MsgPiece, Index: index, Begin: begin, Block: block})
+}
+
+func (c *Conn) Cancel(index, begin, length uint32) error {
+	return c.WriteMessage(&Message{Id: MsgCancel, Index: index, Begin: begin, Length: length})
+}
+
+func (c *Conn) Port(port uint16) error {
+	return c.WriteMessage(&Message{Id: MsgPort, Port: port})
+}
@@ -0,0 +1,41 @@
+package peer
+
+import (
+	"encoding/binary"
+)
+
+// lt_donthave扩展：通知对方不再拥有某个piece
+const DontHaveName = "lt_donthave"
+
+type DontHave struct {
+	ext    *Extended
+	notify func(e *Extended, index uint32)
+}
+
+// 注册lt_donthave，收到消息时调用notify
+func RegisterDontHave(r *Registry, notify func(e *Extended, index uint32)) error {
+	return r.Register(DontHaveName, func(e *Extended) Handler {
+		return &DontHave{ext: e, notify: notify}
+	})
+}
+
+func (d *DontHave) OnHandshake(h *ExtendedHandshake) error {
+	return nil
+}
+
+func (d *DontHave) OnMessage(payload []byte) error {
+	if len(payload) != 4 {
+		return ErrMessageShort
+	}
+	if d.notify != nil {
+		d.notify(d.ext, binary.BigEndian.Uint32(payload))
+	}
+	return nil
+}
+
+// 通知对方我们不再拥有这个piece
+func (d *DontHave) Send(index uint32) error {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], index)
+	return d.ext.Send(DontHaveName, b[:])
+}
@@ -0,0 +1,307 @@
+package peer
+
+//
+// Extension Protocol
+// 参考 http://www.bittorrent.org/beps/bep_0010.html
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/openqt/whonet/utils/bencode"
+)
+
+const (
+	MsgExtended MessageId = 20
+
+	extHandshakeId = 0
+	DefaultReqq    = 250
+)
+
+var ErrUnsupported = errors.New("peer: extension not supported by remote")
+
+func init() {
+	messageNames[MsgExtended] = "extended"
+}
+
+// 扩展握手
+type ExtendedHandshake struct {
+	M            map[string]int // 扩展名到消息id，id为0表示不支持
+	V            string         // 客户端名称和版本
+	P            int            // 监听端口
+	YourIP       net.IP
+	Reqq         int
+	MetadataSize int
+
+	// 其他字段，编码时一并写出；解析时保存全部内容
+	Extra map[string]interface{}
+}
+
+func (h *ExtendedHandshake) Encode() []byte {
+	d := make(map[string]interface{})
+	for k, v := range h.Extra {
+		d[k] = v
+	}
+	m := make(map[string]interface{})
+	for name, id := range h.M {
+		m[name] = id
+	}
+	d["m"] = m
+	if h.V != "" {
+		d["v"] = h.V
+	}
+	if h.P > 0 {
+		d["p"] = h.P
+	}
+	if h.YourIP != nil {
+		ip := h.YourIP.To4()
+		if ip == nil {
+			ip = h.YourIP.To16()
+		}
+		d["yourip"] = string(ip)
+	}
+	if h.Reqq > 0 {
+		d["reqq"] = h.Reqq
+	}
+	if h.MetadataSize > 0 {
+		d["metadata_size"] = h.MetadataSize
+	}
+	return []byte(bencode.NewEncoder().Encode(d))
+}
+
+func ParseExtendedHandshake(b []byte) (*ExtendedHandshake, error) {
+	val, err := bencode.NewDecoder().TryDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("peer: extended handshake is not a dict")
+	}
+
+	h := &ExtendedHandshake{M: make(map[string]int), Extra: d}
+	if m, ok := d["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if n, ok := id.(int); ok && n >= 0 && n < 256 {
+				h.M[name] = n
+			}
+		}
+	}
+	h.V, _ = d["v"].(string)
+	h.P, _ = d["p"].(int)
+	h.Reqq, _ = d["reqq"].(int)
+	h.MetadataSize, _ = d["metadata_size"].(int)
+	if ip, ok := d["yourip"].(string); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		h.YourIP = net.IP(ip)
+	}
+	return h, nil
+}
+
+// 单个连接上的扩展处理
+type Handler interface {
+	// 收到对方的扩展握手，对方可能不支持本扩展
+	OnHandshake(h *ExtendedHandshake) error
+	// 收到本扩展的消息
+	OnMessage(payload []byte) error
+}
+
+// 可选接口，在发送扩展握手前填写自己的字段
+type HandshakeFiller interface {
+	FillHandshake(h *ExtendedHandshake)
+}
+
+// 为每个连接创建Handler
+type Factory func(e *Extended) Handler
+
+type registered struct {
+	name    string
+	id      int
+	factory Factory
+}
+
+// 扩展注册表
+type Registry struct {
+	mu   sync.RWMutex
+	exts []registered
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// 注册扩展，本地消息id按注册顺序从1开始分配
+func (r *Registry) Register(name string, factory Factory) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.exts {
+		if e.name == name {
+			return fmt.Errorf("peer: extension %s already registered", name)
+		}
+	}
+	if len(r.exts) >= 255 {
+		return errors.New("peer: too many extensions")
+	}
+	r.exts = append(r.exts, registered{name: name, id: len(r.exts) + 1, factory: factory})
+	return nil
+}
+
+// 已注册的扩展名
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var names []string
+	for _, e := range r.exts {
+		names = append(names, e.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 连接上的扩展状态
+type Extended struct {
+	Conn   *Conn
+	Local  *ExtendedHandshake
+	Remote *ExtendedHandshake // 收到对方握手之前为nil
+
+	mu       sync.RWMutex
+	handlers map[int]Handler    // 以本地消息id为键
+	names    map[string]Handler // 以扩展名为键
+	ids      map[string]int
+}
+
+// 为连接创建所有已注册扩展的Handler
+func (r *Registry) NewExtended(c *Conn) *Extended {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e := &Extended{
+		Conn:     c,
+		handlers: make(map[int]Handler),
+		names:    make(map[string]Handler),
+		ids:      make(map[string]int),
+	}
+	for _, ext := range r.exts {
+		h := ext.factory(e)
+		if h == nil {
+			continue // 扩展可以选择不在这个连接上启用
+		}
+		e.handlers[ext.id] = h
+		e.names[ext.name] = h
+		e.ids[ext.name] = ext.id
+	}
+	return e
+}
+
+// 发送扩展握手，base中的M由注册表填写
+func (e *Extended) Handshake(base ExtendedHandshake) error {
+	if !e.Conn.Supports(BitExtension) {
+		return ErrNotNegotiated
+	}
+	h := base
+	h.M = make(map[string]int)
+	e.mu.RLock()
+	for name, id := range e.ids {
+		h.M[name] = id
+		if f, ok := e.names[name].(HandshakeFiller); ok {
+			f.FillHandshake(&h)
+		}
+	}
+	e.mu.RUnlock()
+	if h.Reqq == 0 {
+		h.Reqq = DefaultReqq
+	}
+
+	e.mu.Lock()
+	e.Local = &h
+	e.mu.Unlock()
+	return e.write(extHandshakeId, h.Encode())
+}
+
+// 处理MsgExtended消息
+func (e *Extended) Handle(payload []byte) error {
+	if !e.Conn.Supports(BitExtension) {
+		return ErrNotNegotiated
+	}
+	if len(payload) == 0 {
+		return ErrMessageShort
+	}
+	id, data := int(payload[0]), payload[1:]
+
+	if id == extHandshakeId {
+		h, err := ParseExtendedHandshake(data)
+		if err != nil {
+			return err
+		}
+		e.mu.Lock()
+		// 后续的握手可以只更新部分字段
+		if e.Remote != nil {
+			for name, n := range e.Remote.M {
+				if _, ok := h.M[name]; !ok {
+					h.M[name] = n
+				}
+			}
+		}
+		e.Remote = h
+		handlers := make([]Handler, 0, len(e.handlers))
+		for _, hd := range e.handlers {
+			handlers = append(handlers, hd)
+		}
+		e.mu.Unlock()
+
+		for _, hd := range handlers {
+			if err := hd.OnHandshake(h); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	e.mu.RLock()
+	h := e.handlers[id]
+	e.mu.RUnlock()
+	if h == nil {
+		return fmt.Errorf("peer: unknown extended message %d", id)
+	}
+	return h.OnMessage(data)
+}
+
+// 对方是否支持某个扩展
+func (e *Extended) RemoteSupports(name string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.Remote != nil && e.Remote.M[name] > 0
+}
+
+// 取得扩展在这个连接上的Handler
+func (e *Extended) Handler(name string) Handler {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.names[name]
+}
+
+// 向对方发送扩展消息，使用对方握手中的消息id
+func (e *Extended) Send(name string, payload []byte) error {
+	e.mu.RLock()
+	id := 0
+	if e.Remote != nil {
+		id = e.Remote.M[name]
+	}
+	e.mu.RUnlock()
+	if id <= 0 {
+		return ErrUnsupported
+	}
+	return e.write(id, payload)
+}
+
+func (e *Extended) write(id int, payload []byte) error {
+	b := make([]byte, 1+len(payload))
+	b[0] = byte(id)
+	copy(b[1:], payload)
+	return e.Conn.WriteMessage(&Message{Id: MsgExtended, Payload: b})
+}
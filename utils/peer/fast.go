@@ -0,0 +1,207 @@
+package peer
+
+//
+// Fast Extension
+// 参考 http://www.bittorrent.org/beps/bep_0006.html
+//
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	MsgSuggest     MessageId = 0x0D
+	MsgHaveAll     MessageId = 0x0E
+	MsgHaveNone    MessageId = 0x0F
+	MsgReject      MessageId = 0x10
+	MsgAllowedFast MessageId = 0x11
+
+	// 默认的allowed fast集合大小
+	AllowedFastCount = 10
+)
+
+var (
+	ErrNotNegotiated = errors.New("peer: extension not negotiated")
+	ErrBitfieldOrder = errors.New("peer: bitfield after other piece state messages")
+)
+
+func init() {
+	messageNames[MsgSuggest] = "suggest piece"
+	messageNames[MsgHaveAll] = "have all"
+	messageNames[MsgHaveNone] = "have none"
+	messageNames[MsgReject] = "reject request"
+	messageNames[MsgAllowedFast] = "allowed fast"
+}
+
+func isFastMessage(id MessageId) bool {
+	return id >= MsgSuggest && id <= MsgAllowedFast
+}
+
+func (c *Conn) HaveAll() error {
+	return c.writeFast(&Message{Id: MsgHaveAll})
+}
+
+func (c *Conn) HaveNone() error {
+	return c.writeFast(&Message{Id: MsgHaveNone})
+}
+
+func (c *Conn) Suggest(index uint32) error {
+	return c.writeFast(&Message{Id: MsgSuggest, Index: index})
+}
+
+func (c *Conn) Reject(index, begin, length uint32) error {
+	return c.writeFast(&Message{Id: MsgReject, Index: index, Begin: begin, Length: length})
+}
+
+func (c *Conn) AllowedFast(index uint32) error {
+	return c.writeFast(&Message{Id: MsgAllowedFast, Index: index})
+}
+
+func (c *Conn) writeFast(m *Message) error {
+	if !c.Supports(BitFast) {
+		return ErrNotNegotiated
+	}
+	return c.WriteMessage(m)
+}
+
+// 计算allowed fast集合，IPv4取/24网段；IPv6规范未定义，这里取/48网段
+func AllowedFastSet(k int, ip net.IP, infoHash [20]byte, numPieces int) []uint32 {
+	if numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	var x []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	} else {
+		x = append(x, ip.To16()[:6]...)
+		x = append(x, make([]byte, 10)...)
+	}
+	x = append(x, infoHash[:]...)
+
+	var set []uint32
+	seen := make(map[uint32]bool)
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces)
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// 对方的请求
+type Request struct {
+	Index, Begin, Length uint32
+}
+
+// 对方发来的请求队列，处理choke时的规则：
+// 没有Fast Extension时choke隐式取消所有请求；有Fast Extension时必须逐个reject
+type Uploads struct {
+	Fast bool
+
+	mu      sync.Mutex
+	choked  bool
+	allowed map[uint32]bool // 我们发给对方的allowed fast
+	pending []Request
+}
+
+func NewUploads(fast bool) *Uploads {
+	return &Uploads{Fast: fast, choked: true, allowed: make(map[uint32]bool)}
+}
+
+// 允许对方在choke状态下请求这个piece
+func (u *Uploads) Allow(index uint32) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.allowed[index] = true
+}
+
+// 加入请求，返回false时请求不被接受，Fast时需要reject。
+// 队列最多DefaultReqq个，和扩展握手中通知对方的reqq一致
+func (u *Uploads) Add(r Request) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.choked && !u.allowed[r.Index] || len(u.pending) >= DefaultReqq {
+		return false
+	}
+	u.pending = append(u.pending, r)
+	return true
+}
+
+// 取消请求，返回是否在队列中；Fast时取消的请求也需要reject
+func (u *Uploads) Cancel(r Request) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, p := range u.pending {
+		if p == r {
+			u.pending = append(u.pending[:i], u.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// choke对方，返回需要reject的请求；没有Fast时请求直接丢弃
+func (u *Uploads) Choke() []Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.choked = true
+
+	var rejected, kept []Request
+	for _, r := range u.pending {
+		if u.allowed[r.Index] {
+			kept = append(kept, r)
+		} else {
+			rejected = append(rejected, r)
+		}
+	}
+	u.pending = kept
+	if !u.Fast {
+		return nil
+	}
+	return rejected
+}
+
+func (u *Uploads) Unchoke() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.choked = false
+}
+
+func (u *Uploads) Choked() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.choked
+}
+
+// 取出下一个请求
+func (u *Uploads) Next() (Request, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.pending) == 0 {
+		return Request{}, false
+	}
+	r := u.pending[0]
+	u.pending = u.pending[1:]
+	return r, true
+}
+
+// 队列中的请求数
+func (u *Uploads) Len() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.pending)
+}
@@ -0,0 +1,85 @@
+package peer
+
+//
+// Peer wire协议
+// 参考 http://www.bittorrent.org/beps/bep_0003.html#peer-protocol
+//
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/openqt/whonet/utils"
+)
+
+const (
+	Protocol      = "BitTorrent protocol"
+	HandshakeSize = 1 + len(Protocol) + 8 + 20 + 20 // 68字节
+)
+
+var LOG = utils.GetLogger()
+
+var (
+	ErrProtocol     = errors.New("peer: invalid protocol string")
+	ErrInfoHash     = errors.New("peer: info hash mismatch")
+	ErrMessageSize  = errors.New("peer: message too large")
+	ErrMessageShort = errors.New("peer: invalid message length")
+)
+
+// 保留位，编号参考BEP 4：reserved[7]的最低位为第0位
+type Reserved [8]byte
+
+const (
+	BitDHT       = 0  // BEP 5
+	BitFast      = 2  // BEP 6
+	BitExtension = 20 // BEP 10
+)
+
+func (r *Reserved) Set(bit int) {
+	r[7-bit/8] |= 1 << uint(bit%8)
+}
+
+func (r Reserved) Has(bit int) bool {
+	return r[7-bit/8]&(1<<uint(bit%8)) != 0
+}
+
+// 握手消息：协议字符串、保留位、info_hash和peer_id
+type Handshake struct {
+	Reserved Reserved
+	InfoHash [20]byte
+	PeerId   [20]byte
+}
+
+// 编码为68字节
+func (h *Handshake) Bytes() []byte {
+	b := make([]byte, 0, HandshakeSize)
+	b = append(b, byte(len(Protocol)))
+	b = append(b, Protocol...)
+	b = append(b, h.Reserved[:]...)
+	b = append(b, h.InfoHash[:]...)
+	b = append(b, h.PeerId[:]...)
+	return b
+}
+
+func WriteHandshake(w io.Writer, h *Handshake) error {
+	_, err := w.Write(h.Bytes())
+	return err
+}
+
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	var b [HandshakeSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	if int(b[0]) != len(Protocol) || !bytes.Equal(b[1:1+len(Protocol)], []byte(Protocol)) {
+		return nil, ErrProtocol
+	}
+
+	h := new(Handshake)
+	n := 1 + len(Protocol)
+	copy(h.Reserved[:], b[n:n+8])
+	copy(h.InfoHash[:], b[n+8:n+28])
+	copy(h.PeerId[:], b[n+28:n+48])
+	return h, nil
+}
@@ -0,0 +1,178 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type MessageId byte
+
+const (
+	MsgChoke         MessageId = 0
+	MsgUnchoke       MessageId = 1
+	MsgInterested    MessageId = 2
+	MsgNotInterested MessageId = 3
+	MsgHave          MessageId = 4
+	MsgBitfield      MessageId = 5
+	MsgRequest       MessageId = 6
+	MsgPiece         MessageId = 7
+	MsgCancel        MessageId = 8
+	MsgPort          MessageId = 9 // BEP 5
+)
+
+var messageNames = map[MessageId]string{
+	MsgChoke:         "choke",
+	MsgUnchoke:       "unchoke",
+	MsgInterested:    "interested",
+	MsgNotInterested: "not interested",
+	MsgHave:          "have",
+	MsgBitfield:      "bitfield",
+	MsgRequest:       "request",
+	MsgPiece:         "piece",
+	MsgCancel:        "cancel",
+	MsgPort:          "port",
+}
+
+func (id MessageId) String() string {
+	if s, ok := messageNames[id]; ok {
+		return s
+	}
+	return fmt.Sprintf("message(%d)", byte(id))
+}
+
+// 一条消息。Bitfield、Block和Payload指向连接的读缓冲，在下次读取前有效
+type Message struct {
+	KeepAlive bool // 长度为0的消息，没有Id
+
+	Id     MessageId
+	Index  uint32 // have/request/piece/cancel及fast消息
+	Begin  uint32 // request/piece/cancel
+	Length uint32 // request/cancel
+	Port   uint16
+
+	Bitfield []byte
+	Block    []byte // piece的数据
+	Payload  []byte // 其他消息的原始内容
+}
+
+func (m *Message) String() string {
+	if m.KeepAlive {
+		return "keep-alive"
+	}
+	switch m.Id {
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		return fmt.Sprintf("%s(%d)", m.Id, m.Index)
+	case MsgRequest, MsgCancel, MsgReject:
+		return fmt.Sprintf("%s(%d, %d, %d)", m.Id, m.Index, m.Begin, m.Length)
+	case MsgPiece:
+		return fmt.Sprintf("piece(%d, %d, [%d])", m.Index, m.Begin, len(m.Block))
+	case MsgBitfield:
+		return fmt.Sprintf("bitfield([%d])", len(m.Bitfield))
+	case MsgPort:
+		return fmt.Sprintf("port(%d)", m.Port)
+	}
+	return m.Id.String()
+}
+
+// 解析消息内容，payload不含长度前缀和消息id
+func (m *Message) parse(payload []byte) error {
+	need := func(n int) error {
+		if len(payload) != n {
+			return fmt.Errorf("%v: %s", ErrMessageShort, m.Id)
+		}
+		return nil
+	}
+
+	switch m.Id {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		return need(0)
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		if err := need(4); err != nil {
+			return err
+		}
+		m.Index = binary.BigEndian.Uint32(payload)
+	case MsgBitfield:
+		m.Bitfield = payload
+	case MsgRequest, MsgCancel, MsgReject:
+		if err := need(12); err != nil {
+			return err
+		}
+		m.Index = binary.BigEndian.Uint32(payload)
+		m.Begin = binary.BigEndian.Uint32(payload[4:])
+		m.Length = binary.BigEndian.Uint32(payload[8:])
+	case MsgPiece:
+		if len(payload) < 8 {
+			return fmt.Errorf("%v: %s", ErrMessageShort, m.Id)
+		}
+		m.Index = binary.BigEndian.Uint32(payload)
+		m.Begin = binary.BigEndian.Uint32(payload[4:])
+		m.Block = payload[8:]
+	case MsgPort:
+		if err := need(2); err != nil {
+			return err
+		}
+		m.Port = binary.BigEndian.Uint16(payload)
+	default:
+		m.Payload = payload
+	}
+	return nil
+}
+
+// 消息编码后的长度，不含长度前缀
+func (m *Message) size() int {
+	if m.KeepAlive {
+		return 0
+	}
+	switch m.Id {
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		return 5
+	case MsgBitfield:
+		return 1 + len(m.Bitfield)
+	case MsgRequest, MsgCancel, MsgReject:
+		return 13
+	case MsgPiece:
+		return 9 + len(m.Block)
+	case MsgPort:
+		return 3
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		return 1
+	}
+	return 1 + len(m.Payload)
+}
+
+// 消息在线路上的长度，包括长度前缀
+func (m *Message) WireSize() int {
+	return 4 + m.size()
+}
+
+// 把长度前缀和消息头写入b，返回消息头和需要另外写出的数据
+func (m *Message) header(b []byte) ([]byte, []byte) {
+	binary.BigEndian.PutUint32(b, uint32(m.size()))
+	if m.KeepAlive {
+		return b[:4], nil
+	}
+	b[4] = byte(m.Id)
+
+	switch m.Id {
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		binary.BigEndian.PutUint32(b[5:], m.Index)
+		return b[:9], nil
+	case MsgRequest, MsgCancel, MsgReject:
+		binary.BigEndian.PutUint32(b[5:], m.Index)
+		binary.BigEndian.PutUint32(b[9:], m.Begin)
+		binary.BigEndian.PutUint32(b[13:], m.Length)
+		return b[:17], nil
+	case MsgPiece:
+		binary.BigEndian.PutUint32(b[5:], m.Index)
+		binary.BigEndian.PutUint32(b[9:], m.Begin)
+		return b[:13], m.Block
+	case MsgPort:
+		binary.BigEndian.PutUint16(b[5:], m.Port)
+		return b[:7], nil
+	case MsgBitfield:
+		return b[:5], m.Bitfield
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		return b[:5], nil
+	}
+	return b[:5], m.Payload
+}
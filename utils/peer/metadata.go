@@ -0,0 +1,482 @@
+package peer
+
+//
+// 元数据交换 ut_metadata
+// 参考 http://www.bittorrent.org/beps/bep_0009.html
+//
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/network"
+)
+
+const (
+	MetadataName      = "ut_metadata"
+	MetadataPieceSize = 16 * 1024
+	MaxMetadataSize   = 16 * 1024 * 1024
+
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+
+	// 请求超过这个时间没有回应，可以向其他peer请求同一块
+	metadataTimeout = 30 * time.Second
+)
+
+var (
+	ErrBadMetadata = errors.New("peer: metadata does not match info hash")
+	ErrBanned      = errors.New("peer: peer is banned")
+	ErrRejected    = errors.New("peer: metadata request rejected")
+	ErrNoMetadata  = errors.New("peer: no peer provided the metadata")
+)
+
+// 一个种子的元数据，在多个连接间共享
+type Metadata struct {
+	InfoHash [20]byte
+
+	mu       sync.Mutex
+	data     []byte
+	size     int
+	have     []bool
+	pending  map[int]time.Time
+	from     []string // 每块的来源IP
+	complete bool
+	done     chan struct{}
+
+	strikes  map[string]int // 以IP为键
+	banned   map[string]bool
+	handlers map[*MetadataHandler]bool // 正在下载的连接
+
+	registry *Registry
+}
+
+func newMetadata(infoHash [20]byte) *Metadata {
+	m := &Metadata{
+		InfoHash: infoHash,
+		pending:  make(map[int]time.Time),
+		done:     make(chan struct{}),
+		strikes:  make(map[string]int),
+		banned:   make(map[string]bool),
+		handlers: make(map[*MetadataHandler]bool),
+		registry: NewRegistry(),
+	}
+	RegisterMetadata(m.registry, m)
+	return m
+}
+
+// 等待下载的元数据
+func NewMetadata(infoHash [20]byte) *Metadata {
+	return newMetadata(infoHash)
+}
+
+// 已有的元数据，用于向其他peer提供
+func NewMetadataFrom(info []byte) *Metadata {
+	m := newMetadata(sha1.Sum(info))
+	m.data = info
+	m.size = len(info)
+	m.complete = true
+	close(m.done)
+	return m
+}
+
+func (m *Metadata) Complete() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.complete
+}
+
+// 完整的元数据，未完成时为nil
+func (m *Metadata) Bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.complete {
+		return nil
+	}
+	return m.data
+}
+
+// 元数据下载完成时关闭
+func (m *Metadata) Done() <-chan struct{} {
+	return m.done
+}
+
+// 地址的IP是否因为提供错误数据被禁止，换端口重新连接也没有用
+func (m *Metadata) Banned(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.banned[addrIP(addr)]
+}
+
+// host:port中的主机部分，没有端口时为原字符串
+func addrIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (m *Metadata) addHandler(x *MetadataHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[x] = true
+}
+
+func (m *Metadata) removeHandler(x *MetadataHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.handlers, x)
+}
+
+// 校验失败后所有块需要重新下载。空闲的连接不会再收到数据，
+// 要在所有连接上重新请求；被禁止的连接直接关闭
+func (m *Metadata) restart() {
+	m.mu.Lock()
+	var list []*MetadataHandler
+	for x := range m.handlers {
+		list = append(list, x)
+	}
+	m.mu.Unlock()
+	for _, x := range list {
+		if m.Banned(x.ext.Conn.RemoteAddr().String()) {
+			x.ext.Conn.Close()
+			continue
+		}
+		if err := x.requestNext(); err != nil {
+			x.ext.Conn.Close()
+		}
+	}
+}
+
+func (m *Metadata) numPieces() int {
+	return (m.size + MetadataPieceSize - 1) / MetadataPieceSize
+}
+
+// 设置对方声明的大小，返回是否与已知大小一致
+func (m *Metadata) setSize(size int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size <= 0 || size > MaxMetadataSize {
+		return false
+	}
+	if m.size == 0 {
+		m.size = size
+		m.data = make([]byte, size)
+		m.have = make([]bool, m.numPieces())
+		m.from = make([]string, m.numPieces())
+	}
+	return m.size == size
+}
+
+// 选择下一块：优先没有请求过的，其次是请求超时的
+func (m *Metadata) next() (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.complete {
+		return 0, false
+	}
+	now := time.Now()
+	for i, ok := range m.have {
+		if ok {
+			continue
+		}
+		if t, ok := m.pending[i]; !ok || now.Sub(t) > metadataTimeout {
+			m.pending[i] = now
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// 第i块的数据
+func (m *Metadata) piece(i int) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.complete || i < 0 || i >= m.numPieces() {
+		return nil
+	}
+	end := (i + 1) * MetadataPieceSize
+	if end > m.size {
+		end = m.size
+	}
+	return m.data[i*MetadataPieceSize : end]
+}
+
+// 保存收到的一块，所有块收齐后校验info_hash
+func (m *Metadata) put(i int, data []byte, from string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.complete {
+		return nil
+	}
+	if i < 0 || i >= len(m.have) {
+		return fmt.Errorf("peer: metadata piece %d out of range", i)
+	}
+	want := MetadataPieceSize
+	if i == len(m.have)-1 {
+		want = m.size - i*MetadataPieceSize
+	}
+	if len(data) != want {
+		return fmt.Errorf("peer: metadata piece %d has %d bytes, want %d", i, len(data), want)
+	}
+
+	copy(m.data[i*MetadataPieceSize:], data)
+	m.have[i] = true
+	m.from[i] = addrIP(from)
+	delete(m.pending, i)
+	for _, ok := range m.have {
+		if !ok {
+			return nil
+		}
+	}
+
+	if sha1.Sum(m.data) == m.InfoHash {
+		m.complete = true
+		close(m.done)
+		return nil
+	}
+
+	// 校验失败：只有一个来源时直接禁止，否则每个来源记一次，两次后禁止
+	sources := make(map[string]bool)
+	for i := range m.have {
+		sources[m.from[i]] = true
+		m.have[i] = false
+	}
+	for ip := range sources {
+		m.strikes[ip]++
+		if len(sources) == 1 || m.strikes[ip] >= 2 {
+			m.banned[ip] = true
+		}
+	}
+	return ErrBadMetadata
+}
+
+// 在注册表中加入ut_metadata，所有连接共享同一个元数据
+func RegisterMetadata(r *Registry, m *Metadata) error {
+	return r.Register(MetadataName, func(e *Extended) Handler {
+		return &MetadataHandler{ext: e, m: m}
+	})
+}
+
+// 单个连接上的ut_metadata
+type MetadataHandler struct {
+	ext  *Extended
+	m    *Metadata
+	size int // 对方声明的大小
+}
+
+func (x *MetadataHandler) FillHandshake(h *ExtendedHandshake) {
+	if data := x.m.Bytes(); data != nil {
+		h.MetadataSize = len(data)
+	}
+}
+
+func (x *MetadataHandler) OnHandshake(h *ExtendedHandshake) error {
+	if x.m.Complete() || h.MetadataSize == 0 {
+		return nil
+	}
+	if !x.m.setSize(h.MetadataSize) {
+		return nil // 大小不一致的peer不用来下载
+	}
+	x.size = h.MetadataSize
+	x.m.addHandler(x)
+	return x.requestNext()
+}
+
+// 每个连接同时只请求一块
+func (x *MetadataHandler) requestNext() error {
+	if x.size == 0 || !x.ext.RemoteSupports(MetadataName) {
+		return nil
+	}
+	i, ok := x.m.next()
+	if !ok {
+		return nil
+	}
+	return x.send(metadataRequest, i, nil)
+}
+
+func (x *MetadataHandler) send(msgType, piece int, data []byte) error {
+	d := map[string]interface{}{"msg_type": msgType, "piece": piece}
+	if msgType == metadataData {
+		d["total_size"] = x.m.size
+	}
+	b := append([]byte(bencode.NewEncoder().Encode(d)), data...)
+	return x.ext.Send(MetadataName, b)
+}
+
+func (x *MetadataHandler) OnMessage(payload []byte) error {
+	dec := bencode.NewDecoder()
+	val, err := dec.TryDecode(payload)
+	if err != nil {
+		return err
+	}
+	d, ok := val.(map[string]interface{})
+	if !ok {
+		return errors.New("peer: ut_metadata message is not a dict")
+	}
+	msgType, ok1 := d["msg_type"].(int)
+	piece, ok2 := d["piece"].(int)
+	if !ok1 || !ok2 {
+		return errors.New("peer: ut_metadata message without msg_type or piece")
+	}
+
+	switch msgType {
+	case metadataRequest:
+		if data := x.m.piece(piece); data != nil {
+			return x.send(metadataData, piece, data)
+		}
+		return x.send(metadataReject, piece, nil)
+	case metadataData:
+		if x.size == 0 {
+			return nil // 没有请求过
+		}
+		if total, _ := d["total_size"].(int); total != x.size {
+			return fmt.Errorf("peer: metadata total size %d, want %d", total, x.size)
+		}
+		addr := x.ext.Conn.RemoteAddr().String()
+		if err := x.m.put(piece, payload[dec.Pos():], addr); err == ErrBadMetadata {
+			x.m.restart()
+			if x.m.Banned(addr) {
+				return err
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return x.requestNext()
+	case metadataReject:
+		return ErrRejected
+	}
+	return nil // 忽略未知类型
+}
+
+// 在已完成握手的连接上交换元数据。下载时在元数据完整或出错时返回；
+// 元数据已完整时只提供服务，直到连接断开
+func (m *Metadata) Exchange(ctx context.Context, c *Conn) error {
+	if !c.Supports(BitExtension) {
+		return ErrNotNegotiated
+	}
+	if m.Banned(c.RemoteAddr().String()) {
+		return ErrBanned
+	}
+
+	fetching := !m.Complete()
+	var done <-chan struct{}
+	if fetching {
+		done = m.done
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		case <-stop:
+			return
+		}
+		c.Close()
+	}()
+
+	e := m.registry.NewExtended(c)
+	if x, ok := e.Handler(MetadataName).(*MetadataHandler); ok {
+		defer m.removeHandler(x)
+	}
+	if err := e.Handshake(ExtendedHandshake{}); err != nil {
+		return err
+	}
+	for {
+		msg, err := c.ReadMessage()
+		if err == nil && !msg.KeepAlive && msg.Id == MsgExtended {
+			err = e.Handle(msg.Payload)
+		}
+		if fetching && m.Complete() {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+}
+
+// 连接多个peer下载元数据，同时最多conns个连接；每个peer最多使用timeout时间
+func (m *Metadata) Fetch(ctx context.Context, dialer network.Dialer, addrs []string,
+	peerId [20]byte, conns int, timeout time.Duration) ([]byte, error) {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if conns <= 0 {
+		conns = 1
+	}
+
+	var h Handshake
+	h.Reserved.Set(BitExtension)
+	h.InfoHash = m.InfoHash
+	h.PeerId = peerId
+
+	fetch := func(addr string) error {
+		if m.Banned(addr) {
+			return ErrBanned
+		}
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		nc, err := dialer.DialContext(pctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer nc.Close()
+		if deadline, ok := pctx.Deadline(); ok {
+			nc.SetDeadline(deadline)
+		}
+
+		c := NewConn(nc)
+		if _, err := c.Handshake(&h); err != nil {
+			return err
+		}
+		return m.Exchange(pctx, c)
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr := range queue {
+				if err := fetch(addr); err != nil && !m.Complete() {
+					LOG.Debugf("Metadata from %s: %v", addr, err)
+				}
+			}
+		}()
+	}
+
+loop:
+	for _, addr := range addrs {
+		select {
+		case queue <- addr:
+		case <-m.done:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if data := m.Bytes(); data != nil {
+		return data, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, ErrNoMetadata
+}
@@ -0,0 +1,759 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/tracker"
+)
+
+func pipe() (*Conn, *Conn) {
+	a, b := net.Pipe()
+	return NewConn(a), NewConn(b)
+}
+
+func TestHandshake(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var ha, hb Handshake
+	copy(ha.InfoHash[:], "ABCDEFGHIJKLMNOPQRST")
+	copy(ha.PeerId[:], "-WN0100-aaaaaaaaaaaa")
+	ha.Reserved.Set(BitExtension)
+	hb = ha
+	copy(hb.PeerId[:], "-WN0100-bbbbbbbbbbbb")
+
+	if len(ha.Bytes()) != HandshakeSize || ha.Reserved[5] != 0x10 {
+		t.Fatalf("handshake %x", ha.Bytes())
+	}
+
+	done := make(chan error)
+	go func() {
+		h, err := b.ReadHandshake()
+		if err == nil && h.PeerId != ha.PeerId {
+			t.Errorf("peer id %q", h.PeerId)
+		}
+		if err == nil {
+			err = b.WriteHandshake(&hb)
+		}
+		done <- err
+	}()
+
+	h, err := a.Handshake(&ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if h.PeerId != hb.PeerId || !h.Reserved.Has(BitExtension) || h.Reserved.Has(BitFast) {
+		t.Errorf("handshake %+v", h)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+
+	block := bytes.Repeat([]byte{0xAB}, BlockSize)
+	msgs := []Message{
+		{KeepAlive: true},
+		{Id: MsgBitfield, Bitfield: []byte{0xff, 0x80}},
+		{Id: MsgChoke},
+		{Id: MsgUnchoke},
+		{Id: MsgInterested},
+		{Id: MsgNotInterested},
+		{Id: MsgHave, Index: 1234},
+		{Id: MsgRequest, Index: 1, Begin: BlockSize, Length: BlockSize},
+		{Id: MsgPiece, Index: 1, Begin: BlockSize, Block: block},
+		{Id: MsgCancel, Index: 1, Begin: BlockSize, Length: BlockSize},
+		{Id: MsgPort, Port: 6881},
+		{Id: 0x42, Payload: []byte("unknown")},
+		{Id: 0xff, Payload: []byte("not a keep-alive")},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range msgs {
+			if err := a.WriteMessage(&msgs[i]); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	for _, want := range msgs {
+		m, err := b.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.KeepAlive != want.KeepAlive || m.String() != want.String() || m.Index != want.Index || m.Begin != want.Begin ||
+			m.Length != want.Length || m.Port != want.Port ||
+			!bytes.Equal(m.Bitfield, want.Bitfield) || !bytes.Equal(m.Block, want.Block) ||
+			!bytes.Equal(m.Payload, want.Payload) {
+			t.Errorf("%v != %v", &m, &want)
+		}
+	}
+
+	<-done
+	read, _ := b.Stats()
+	_, written := a.Stats()
+	if read != written {
+		t.Errorf("stats %d != %d", read, written)
+	}
+}
+
+func TestMessageErrors(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+	b.MaxMessage = 1024
+
+	go func() {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], 3)
+		a.Conn.Write(append(hdr[:], byte(MsgHave), 0, 0)) // 长度错误
+		binary.BigEndian.PutUint32(hdr[:], 2048)
+		a.Conn.Write(hdr[:]) // 超过最大长度
+	}()
+
+	if _, err := b.ReadMessage(); err == nil {
+		t.Error("short have accepted")
+	}
+	if _, err := b.ReadMessage(); err != ErrMessageSize {
+		t.Errorf("oversized message: %v", err)
+	}
+}
+
+func TestAllowedFastSet(t *testing.T) {
+	var hash [20]byte
+	for i := range hash {
+		hash[i] = 0xaa
+	}
+	// BEP 6 中的例子
+	ip := net.ParseIP("80.4.4.200")
+	want := []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	set := AllowedFastSet(9, ip, hash, 1313)
+	for i := range want {
+		if set[i] != want[i] {
+			t.Fatalf("allowed fast %v != %v", set, want)
+		}
+	}
+	if s := AllowedFastSet(7, ip, hash, 1313); len(s) != 7 || s[6] != 1188 {
+		t.Errorf("allowed fast %v", s)
+	}
+}
+
+func TestFastNegotiation(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var h Handshake
+	h.Reserved.Set(BitFast)
+	done := make(chan struct{})
+	go func() {
+		a.WriteHandshake(&h)
+		close(done)
+	}()
+	b.ReadHandshake()
+	<-done
+	if a.Supports(BitFast) || b.Supports(BitFast) {
+		t.Fatal("fast negotiated by one side")
+	}
+	if err := a.HaveAll(); err != ErrNotNegotiated {
+		t.Errorf("have all: %v", err)
+	}
+
+	go a.Conn.Write([]byte{0, 0, 0, 1, byte(MsgHaveNone)})
+	if _, err := b.ReadMessage(); err != ErrNotNegotiated {
+		t.Errorf("have none: %v", err)
+	}
+}
+
+func TestFastMessages(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var h Handshake
+	h.Reserved.Set(BitFast)
+	go func() {
+		a.WriteHandshake(&h)
+		a.ReadHandshake()
+		a.HaveNone()
+		a.Suggest(3)
+		a.Reject(1, 0, BlockSize)
+		a.AllowedFast(7)
+		a.HaveAll()
+	}()
+	b.ReadHandshake()
+	b.WriteHandshake(&h)
+	want := []string{"have none", "suggest piece(3)", "reject request(1, 0, 16384)", "allowed fast(7)"}
+	for _, w := range want {
+		m, err := b.ReadMessage()
+		if err != nil || m.String() != w {
+			t.Errorf("%v %v != %s", &m, err, w)
+		}
+	}
+	if _, err := b.ReadMessage(); err != ErrBitfieldOrder {
+		t.Errorf("late have all: %v", err)
+	}
+}
+
+func TestBitfieldAfterExtended(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var h Handshake
+	h.Reserved.Set(BitExtension)
+	go func() {
+		a.WriteHandshake(&h)
+		a.ReadHandshake()
+		a.WriteMessage(&Message{Id: MsgExtended, Payload: []byte{0, 'd', 'e'}})
+		a.WriteMessage(&Message{Id: MsgBitfield, Bitfield: []byte{0x80}})
+		a.WriteMessage(&Message{Id: MsgHave, Index: 1})
+		a.WriteMessage(&Message{Id: MsgBitfield, Bitfield: []byte{0xc0}})
+	}()
+	b.ReadHandshake()
+	b.WriteHandshake(&h)
+	for _, w := range []string{"extended", "bitfield([1])", "have(1)"} {
+		m, err := b.ReadMessage()
+		if err != nil || m.String() != w {
+			t.Errorf("%v %v != %s", &m, err, w)
+		}
+	}
+	if _, err := b.ReadMessage(); err != ErrBitfieldOrder {
+		t.Errorf("bitfield after have: %v", err)
+	}
+}
+
+func TestUploads(t *testing.T) {
+	u := NewUploads(true)
+	u.Allow(5)
+	if u.Add(Request{1, 0, BlockSize}) {
+		t.Error("request accepted while choked")
+	}
+	if !u.Add(Request{5, 0, BlockSize}) {
+		t.Error("allowed fast request refused")
+	}
+
+	u.Unchoke()
+	u.Add(Request{1, 0, BlockSize})
+	u.Add(Request{2, 0, BlockSize})
+	if !u.Cancel(Request{2, 0, BlockSize}) || u.Len() != 2 {
+		t.Errorf("cancel, pending %d", u.Len())
+	}
+
+	rejected := u.Choke()
+	if len(rejected) != 1 || rejected[0].Index != 1 || u.Len() != 1 {
+		t.Errorf("rejected %v, pending %d", rejected, u.Len())
+	}
+
+	u = NewUploads(false)
+	u.Unchoke()
+	u.Add(Request{1, 0, BlockSize})
+	if rejected := u.Choke(); rejected != nil || u.Len() != 0 {
+		t.Errorf("choke without fast: %v", rejected)
+	}
+
+	// 队列满时不再接受
+	u.Unchoke()
+	for i := 0; i < DefaultReqq; i++ {
+		if !u.Add(Request{1, uint32(i) * BlockSize, BlockSize}) {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	if u.Add(Request{2, 0, BlockSize}) {
+		t.Error("request accepted beyond reqq")
+	}
+	u.Next()
+	if !u.Add(Request{2, 0, BlockSize}) {
+		t.Error("request refused after next")
+	}
+}
+
+// 测试用的扩展，记录收到的消息
+type echoExt struct {
+	ext      *Extended
+	received []string
+	remote   bool
+}
+
+func (x *echoExt) FillHandshake(h *ExtendedHandshake) {
+	h.MetadataSize = 1234
+}
+
+func (x *echoExt) OnHandshake(h *ExtendedHandshake) error {
+	x.remote = h.M["x_echo"] > 0
+	return nil
+}
+
+func (x *echoExt) OnMessage(payload []byte) error {
+	x.received = append(x.received, string(payload))
+	return nil
+}
+
+func TestExtended(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var h Handshake
+	h.Reserved.Set(BitExtension)
+
+	// 双方注册顺序不同，消息id也不同
+	ra, rb := NewRegistry(), NewRegistry()
+	var echo *echoExt
+	var dontHave []uint32
+	ra.Register("x_echo", func(e *Extended) Handler { return &echoExt{ext: e} })
+	RegisterDontHave(ra, nil)
+	RegisterDontHave(rb, func(e *Extended, index uint32) { dontHave = append(dontHave, index) })
+	rb.Register("x_echo", func(e *Extended) Handler { echo = &echoExt{ext: e}; return echo })
+	if err := rb.Register("x_echo", nil); err == nil {
+		t.Error("duplicate extension registered")
+	}
+
+	ea, eb := ra.NewExtended(a), rb.NewExtended(b)
+	done := make(chan error, 2)
+	go func() {
+		a.WriteHandshake(&h)
+		a.ReadHandshake()
+		ea.Handshake(ExtendedHandshake{V: "whonet", YourIP: net.ParseIP("10.0.0.1")})
+		// 收到对方握手后才能发送扩展消息
+		m, err := a.ReadMessage()
+		if err == nil {
+			err = ea.Handle(m.Payload)
+		}
+		if err == nil {
+			err = ea.Send("x_echo", []byte("hello"))
+		}
+		if err == nil {
+			err = ea.Handler(DontHaveName).(*DontHave).Send(42)
+		}
+		done <- err
+	}()
+	b.ReadHandshake()
+	b.WriteHandshake(&h)
+	go func() {
+		done <- eb.Handshake(ExtendedHandshake{V: "other"})
+	}()
+
+	for i := 0; i < 3; i++ {
+		m, err := b.ReadMessage()
+		if err != nil || m.Id != MsgExtended {
+			t.Fatalf("%v %v", &m, err)
+		}
+		if err := eb.Handle(m.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if eb.Remote.V != "whonet" || eb.Remote.MetadataSize != 1234 || eb.Remote.Reqq != DefaultReqq ||
+		!eb.Remote.YourIP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("remote handshake %+v", eb.Remote)
+	}
+	if eb.Remote.M["x_echo"] != 1 || eb.Local.M["x_echo"] != 2 {
+		t.Errorf("ids %v %v", eb.Remote.M, eb.Local.M)
+	}
+	if !echo.remote || len(echo.received) != 1 || echo.received[0] != "hello" {
+		t.Errorf("echo %+v", echo)
+	}
+	if len(dontHave) != 1 || dontHave[0] != 42 {
+		t.Errorf("dont have %v", dontHave)
+	}
+	if !ea.RemoteSupports(DontHaveName) || ea.RemoteSupports("ut_pex") {
+		t.Error("remote supports")
+	}
+	if err := ea.Send("ut_pex", nil); err != ErrUnsupported {
+		t.Errorf("send unsupported: %v", err)
+	}
+}
+
+// 在本地地址上提供元数据，ban以IP为单位，不同的peer使用不同的回环地址
+func serveMetadata(t *testing.T, ip string, m *Metadata) string {
+	l, err := net.Listen("tcp", ip+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := NewConn(nc)
+				defer c.Close()
+				h, err := c.ReadHandshake()
+				if err != nil {
+					return
+				}
+				h.Reserved = Reserved{}
+				h.Reserved.Set(BitExtension)
+				c.WriteHandshake(h)
+				m.Exchange(context.Background(), c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMetadata(t *testing.T) {
+	pieces := make([]byte, 2000*20)
+	rand.Read(pieces)
+	info := []byte(bencode.NewEncoder().Encode(map[string]interface{}{
+		"name": "test", "piece length": 16384, "length": 2000 * 16384, "pieces": string(pieces),
+	}))
+	hash := sha1.Sum(info)
+
+	// 大小相同但内容错误的元数据
+	corrupt := append([]byte(nil), info...)
+	corrupt[len(corrupt)-10] ^= 0xff
+	bad := NewMetadataFrom(corrupt)
+	bad.InfoHash = hash
+
+	good := serveMetadata(t, "127.0.0.1", NewMetadataFrom(info))
+	liar := serveMetadata(t, "127.0.0.2", bad)
+
+	var peerId [20]byte
+	copy(peerId[:], "-WN0100-metadatatest")
+	ctx := context.Background()
+
+	m := NewMetadata(hash)
+	if _, err := m.Fetch(ctx, nil, []string{liar}, peerId, 1, 5*time.Second); err != ErrNoMetadata {
+		t.Fatalf("fetch from bad peer: %v", err)
+	}
+	if !m.Banned(liar) {
+		t.Error("bad peer not banned")
+	}
+
+	data, err := m.Fetch(ctx, nil, []string{liar, good}, peerId, 2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, info) || !m.Complete() || m.Banned(good) {
+		t.Errorf("metadata %d bytes, want %d", len(data), len(info))
+	}
+	select {
+	case <-m.Done():
+	default:
+		t.Error("done not closed")
+	}
+}
+
+// 指定对方地址的连接
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// 连接到提供src的peer，完成扩展握手，返回本地一方
+func metadataPeer(t *testing.T, m, src *Metadata, remote string) (*Conn, *Extended) {
+	na, nb := net.Pipe()
+	addr, _ := net.ResolveTCPAddr("tcp", remote)
+	a, b := NewConn(addrConn{na, addr}), NewConn(nb)
+	t.Cleanup(func() { a.Close(); b.Close() })
+	var h Handshake
+	h.Reserved.Set(BitExtension)
+	go func() {
+		b.ReadHandshake()
+		b.WriteHandshake(&h)
+		src.Exchange(context.Background(), b)
+	}()
+	if _, err := a.Handshake(&h); err != nil {
+		t.Fatal(err)
+	}
+
+	e := m.registry.NewExtended(a)
+	done := make(chan error, 1)
+	go func() { done <- e.Handshake(ExtendedHandshake{}) }()
+	msg, err := a.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Handle(msg.Payload); err != nil {
+		t.Fatal(err)
+	}
+	return a, e
+}
+
+func TestMetadataRestart(t *testing.T) {
+	pieces := make([]byte, 2000*20)
+	rand.Read(pieces)
+	info := []byte(bencode.NewEncoder().Encode(map[string]interface{}{
+		"name": "test", "piece length": 16384, "length": 2000 * 16384, "pieces": string(pieces),
+	}))
+	corrupt := append([]byte(nil), info...)
+	corrupt[len(corrupt)-10] ^= 0xff
+
+	m := NewMetadata(sha1.Sum(info))
+	step := func(c *Conn, e *Extended) error {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+		return e.Handle(msg.Payload)
+	}
+
+	// 全部的块都向liar请求，good连接后没有可以请求的块
+	liar, el := metadataPeer(t, m, NewMetadataFrom(corrupt), "10.0.0.1:1000")
+	for i := 0; i < 2; i++ {
+		if err := step(liar, el); err != nil {
+			t.Fatal(err)
+		}
+	}
+	good, eg := metadataPeer(t, m, NewMetadataFrom(info), "10.0.0.2:1000")
+	if err := step(liar, el); err != ErrBadMetadata {
+		t.Fatalf("corrupt metadata: %v", err)
+	}
+	if !m.Banned("10.0.0.1:2000") || m.Banned("10.0.0.2:1000") {
+		t.Error("ban by ip")
+	}
+
+	// 空闲的连接重新请求所有的块
+	good.SetDeadline(time.Now().Add(5 * time.Second))
+	for !m.Complete() {
+		if err := step(good, eg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(m.Bytes(), info) {
+		t.Error("metadata differs")
+	}
+}
+
+func TestPex(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var h Handshake
+	h.Reserved.Set(BitExtension)
+
+	var found []PexPeer
+	pa := NewPex(torrent.InfoStruct{}, nil)
+	pb := NewPex(torrent.InfoStruct{}, func(from *Extended, peers []PexPeer) { found = append(found, peers...) })
+	pb.Interval = 0
+	ra, rb := NewRegistry(), NewRegistry()
+	RegisterPex(ra, pa)
+	RegisterPex(rb, pb)
+	ea, eb := ra.NewExtended(a), rb.NewExtended(b)
+
+	v4 := PexPeer{Peer: tracker.Peer{IP: net.ParseIP("1.2.3.4"), Port: 6881}, Flags: PexSeed | PexUTP}
+	v6 := PexPeer{Peer: tracker.Peer{IP: net.ParseIP("2001:db8::1"), Port: 51413}, Flags: PexEncryption}
+	pa.Connected(v4)
+	pa.Connected(v6)
+
+	now := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.WriteHandshake(&h)
+		a.ReadHandshake()
+		ea.Handshake(ExtendedHandshake{})
+		if m, err := a.ReadMessage(); err == nil {
+			ea.Handle(m.Payload)
+		}
+		pa.Tick(now)
+		pa.Tick(now.Add(time.Second)) // 一分钟内不再发送
+		pa.Disconnected(v4.Peer)
+		pa.Tick(now.Add(PexInterval))
+	}()
+	b.ReadHandshake()
+	b.WriteHandshake(&h)
+	go eb.Handshake(ExtendedHandshake{})
+
+	var payloads []string
+	for i := 0; i < 3; i++ {
+		m, err := b.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			payloads = append(payloads, string(m.Payload[1:]))
+		}
+		eb.Handle(m.Payload)
+	}
+	<-done
+
+	if len(found) != 2 {
+		t.Fatalf("found %v", found)
+	}
+	for _, p := range found {
+		want := v4
+		if p.IsIPv6() {
+			want = v6
+		}
+		if !p.IP.Equal(want.IP) || p.Port != want.Port || p.Flags != want.Flags {
+			t.Errorf("peer %v flags %x", p.Peer, p.Flags)
+		}
+	}
+	dropped := bencode.NewDecoder().Decode([]byte(payloads[1])).(map[string]interface{})
+	if dropped["dropped"] != string(v4.Compact()) || dropped["added"] != "" {
+		t.Errorf("second message %q", payloads[1])
+	}
+
+	// 私有种子不启用PEX
+	private := 1
+	rp := NewRegistry()
+	RegisterPex(rp, NewPex(torrent.InfoStruct{Private: &private}, nil))
+	if rp.NewExtended(a).Handler(PexName) != nil {
+		t.Error("pex enabled for private torrent")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	p := NewPipeline(8, false)
+	now := time.Now()
+	if p.Want() != 0 {
+		t.Fatal("requests while choked")
+	}
+	p.Unchoked(now)
+	if p.Want() != InitialDepth {
+		t.Fatalf("want %d", p.Want())
+	}
+
+	// 慢启动：每收到一块深度加一，不超过reqq
+	var index uint32
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			p.Sent(Request{index, 0, BlockSize}, now)
+			index++
+		}
+	}
+	send(p.Want())
+	for i := uint32(0); i < index; i++ {
+		now = now.Add(50 * time.Millisecond)
+		if !p.Received(Request{i, 0, BlockSize}, now) {
+			t.Fatal("block not pending")
+		}
+	}
+	if p.Depth() != 8 || p.Want() != 8 {
+		t.Errorf("depth %d, want %d", p.Depth(), p.Want())
+	}
+	if p.Received(Request{100, 0, BlockSize}, now) {
+		t.Error("unrequested block accepted")
+	}
+
+	// 带宽高时深度增大，受reqq限制
+	p.SetReqq(1000)
+	for k := 0; k < 20; k++ {
+		start := index
+		send(p.Want())
+		for i := start; i < index; i++ {
+			now = now.Add(time.Millisecond)
+			p.Received(Request{i, 0, BlockSize}, now.Add(100*time.Millisecond))
+		}
+		now = now.Add(time.Second)
+	}
+	if p.Depth() <= 8 || p.Depth() > MaxDepth || p.RTT() == 0 || p.Rate() == 0 {
+		t.Errorf("depth %d, rtt %v, rate %.0f", p.Depth(), p.RTT(), p.Rate())
+	}
+
+	// 没有Fast Extension时choke取消所有请求
+	send(3)
+	if freed := p.Choked(); len(freed) != 3 || p.Len() != 0 || p.Want() != 0 {
+		t.Errorf("freed %v", freed)
+	}
+
+	f := NewPipeline(0, true)
+	f.Unchoked(now)
+	f.Sent(Request{1, 0, BlockSize}, now)
+	f.Sent(Request{2, 0, BlockSize}, now)
+	if freed := f.Choked(); freed != nil || !f.Rejected(Request{1, 0, BlockSize}) {
+		t.Error("fast choke must wait for reject")
+	}
+
+	// 超时和snub
+	if expired := f.Expire(now.Add(DefaultRequestTimeout)); len(expired) != 1 || f.Snubbed() {
+		t.Errorf("expired %v", expired)
+	}
+	f.Unchoked(now)
+	f.Sent(Request{3, 0, BlockSize}, now)
+	if expired := f.Expire(now.Add(DefaultSnubTimeout)); len(expired) != 1 || !f.Snubbed() || f.Want() != 1 {
+		t.Errorf("expired %v, snubbed %v", expired, f.Snubbed())
+	}
+	f.Sent(Request{4, 0, BlockSize}, now)
+	f.Received(Request{4, 0, BlockSize}, now.Add(time.Second))
+	if f.Snubbed() {
+		t.Error("still snubbed after data")
+	}
+	if freed := f.Close(); len(freed) != 0 {
+		t.Errorf("freed %v", freed)
+	}
+}
+
+func TestPexSelf(t *testing.T) {
+	// 接受的连接：对方的地址是临时端口，监听端口在扩展握手中
+	na, nb := net.Pipe()
+	remote, _ := net.ResolveTCPAddr("tcp", "10.0.0.2:40000")
+	a, b := NewConn(addrConn{na, remote}), NewConn(nb)
+	defer a.Close()
+	defer b.Close()
+	var h Handshake
+	h.Reserved.Set(BitExtension)
+
+	pa := NewPex(torrent.InfoStruct{}, nil)
+	ra, rb := NewRegistry(), NewRegistry()
+	RegisterPex(ra, pa)
+	RegisterPex(rb, NewPex(torrent.InfoStruct{}, nil))
+	ea, eb := ra.NewExtended(a), rb.NewExtended(b)
+
+	self := PexPeer{Peer: tracker.Peer{IP: net.ParseIP("10.0.0.2"), Port: 6881}}
+	other := PexPeer{Peer: tracker.Peer{IP: net.ParseIP("10.0.0.3"), Port: 6881}}
+	pa.Connected(self)
+	pa.Connected(other)
+
+	go func() {
+		b.ReadHandshake()
+		b.WriteHandshake(&h)
+		eb.Handshake(ExtendedHandshake{P: 6881})
+	}()
+	if _, err := a.Handshake(&h); err != nil {
+		t.Fatal(err)
+	}
+	go ea.Handshake(ExtendedHandshake{})
+	m, err := a.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ea.Handle(m.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	go pa.Tick(time.Now())
+	m, err = b.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := bencode.NewDecoder().Decode(m.Payload[1:]).(map[string]interface{})
+	if msg["added"] != string(other.Compact()) {
+		t.Errorf("added %q", msg["added"])
+	}
+}
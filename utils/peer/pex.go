@@ -0,0 +1,246 @@
+package peer
+
+//
+// Peer Exchange ut_pex
+// 参考 http://www.bittorrent.org/beps/bep_0011.html
+//
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/openqt/whonet/utils/tracker"
+)
+
+const (
+	PexName = "ut_pex"
+
+	// added.f中的标志
+	PexEncryption = 0x01
+	PexSeed       = 0x02
+	PexUTP        = 0x04
+	PexHolepunch  = 0x08
+	PexReachable  = 0x10
+
+	// 规范要求每分钟最多一条消息，每条最多50个added和50个dropped
+	PexInterval = time.Minute
+	PexMaxPeers = 50
+)
+
+// PEX交换的peer地址和标志
+type PexPeer struct {
+	tracker.Peer
+	Flags byte
+}
+
+// 一个种子的PEX状态，在所有连接间共享
+type Pex struct {
+	Disabled bool
+	Interval time.Duration
+	// 收到新的peer地址，交给连接管理
+	OnPeers func(from *Extended, peers []PexPeer)
+
+	mu    sync.Mutex
+	peers map[string]PexPeer // 当前连接的peer
+	conns map[*Extended]*PexHandler
+}
+
+// 私有种子自动禁用PEX
+func NewPex(info torrent.InfoStruct, onPeers func(from *Extended, peers []PexPeer)) *Pex {
+	return &Pex{
+		Disabled: info.IsPrivate(),
+		Interval: PexInterval,
+		OnPeers:  onPeers,
+		peers:    make(map[string]PexPeer),
+		conns:    make(map[*Extended]*PexHandler),
+	}
+}
+
+// 在注册表中加入ut_pex，禁用时不在任何连接上启用
+func RegisterPex(r *Registry, p *Pex) error {
+	return r.Register(PexName, func(e *Extended) Handler {
+		if p.Disabled {
+			return nil
+		}
+		h := &PexHandler{ext: e, pex: p, sent: make(map[string]bool)}
+		p.mu.Lock()
+		p.conns[e] = h
+		p.mu.Unlock()
+		return h
+	})
+}
+
+// 与peer建立了连接，地址应为对方的监听地址
+func (p *Pex) Connected(peer PexPeer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers[peer.String()] = peer
+}
+
+func (p *Pex) Disconnected(peer tracker.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.peers, peer.String())
+}
+
+// 连接关闭，不再向它发送消息
+func (p *Pex) Close(e *Extended) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, e)
+}
+
+// 向到期的连接发送PEX消息，由种子的定时任务调用
+func (p *Pex) Tick(now time.Time) {
+	p.mu.Lock()
+	peers := make(map[string]PexPeer, len(p.peers))
+	for k, v := range p.peers {
+		peers[k] = v
+	}
+	var handlers []*PexHandler
+	for _, h := range p.conns {
+		handlers = append(handlers, h)
+	}
+	p.mu.Unlock()
+
+	for _, h := range handlers {
+		if err := h.update(now, peers); err != nil {
+			LOG.Debugf("PEX to %s: %v", h.ext.Conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// 单个连接上的ut_pex
+type PexHandler struct {
+	ext *Extended
+	pex *Pex
+
+	mu       sync.Mutex
+	sent     map[string]bool // 已经告诉对方的peer
+	listen   string          // 对方扩展握手中的监听地址，不告诉对方它自己
+	lastSent time.Time
+	lastRecv time.Time
+}
+
+func (x *PexHandler) OnHandshake(h *ExtendedHandshake) error {
+	if h.P <= 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(x.ext.Conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	p := tracker.Peer{IP: net.ParseIP(host), Port: h.P}
+	x.mu.Lock()
+	x.listen = p.String()
+	x.mu.Unlock()
+	return nil
+}
+
+func (x *PexHandler) OnMessage(payload []byte) error {
+	now := time.Now()
+	x.mu.Lock()
+	// 对方发送过于频繁时忽略，留出一些时间误差
+	early := !x.lastRecv.IsZero() && now.Sub(x.lastRecv) < x.pex.Interval/2
+	if !early {
+		x.lastRecv = now
+	}
+	x.mu.Unlock()
+	if early {
+		return nil
+	}
+
+	val, err := bencode.NewDecoder().TryDecode(payload)
+	if err != nil {
+		return err
+	}
+	d, ok := val.(map[string]interface{})
+	if !ok {
+		return errors.New("peer: ut_pex message is not a dict")
+	}
+
+	var peers []PexPeer
+	for _, v := range []struct {
+		key   string
+		iplen int
+	}{{"added", net.IPv4len}, {"added6", net.IPv6len}} {
+		added, _ := d[v.key].(string)
+		flags, _ := d[v.key+".f"].(string)
+		for i, p := range tracker.ParseCompact([]byte(added), v.iplen) {
+			if p.Port == 0 {
+				continue
+			}
+			pp := PexPeer{Peer: p}
+			if i < len(flags) {
+				pp.Flags = flags[i]
+			}
+			peers = append(peers, pp)
+		}
+	}
+	if len(peers) > 0 && x.pex.OnPeers != nil {
+		x.pex.OnPeers(x.ext, peers)
+	}
+	return nil
+}
+
+// 发送与上次相比的变化
+func (x *PexHandler) update(now time.Time, peers map[string]PexPeer) error {
+	if !x.ext.RemoteSupports(PexName) {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.lastSent.IsZero() && now.Sub(x.lastSent) < x.pex.Interval {
+		return nil
+	}
+
+	// 主动连接时对方的地址就是监听地址，接受的连接端口是临时的，按握手中的端口排除
+	self := x.ext.Conn.RemoteAddr().String()
+	var added, added6, addedF, added6F, dropped, dropped6 []byte
+	var nadded, ndropped int
+	for key, p := range peers {
+		if x.sent[key] || key == self || key == x.listen || nadded >= PexMaxPeers {
+			continue
+		}
+		if p.IsIPv6() {
+			added6 = append(added6, p.Compact()...)
+			added6F = append(added6F, p.Flags)
+		} else {
+			added = append(added, p.Compact()...)
+			addedF = append(addedF, p.Flags)
+		}
+		x.sent[key] = true
+		nadded++
+	}
+	for key := range x.sent {
+		if _, ok := peers[key]; ok || ndropped >= PexMaxPeers {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(key)
+		p := tracker.Peer{IP: net.ParseIP(host)}
+		p.Port, _ = strconv.Atoi(port)
+		if p.IsIPv6() {
+			dropped6 = append(dropped6, p.Compact()...)
+		} else {
+			dropped = append(dropped, p.Compact()...)
+		}
+		delete(x.sent, key)
+		ndropped++
+	}
+	if nadded == 0 && ndropped == 0 {
+		return nil
+	}
+
+	msg := map[string]interface{}{
+		"added": string(added), "added.f": string(addedF),
+		"added6": string(added6), "added6.f": string(added6F),
+		"dropped": string(dropped), "dropped6": string(dropped6),
+	}
+	x.lastSent = now
+	return x.ext.Send(PexName, []byte(bencode.NewEncoder().Encode(msg)))
+}
@@ -0,0 +1,320 @@
+package peer
+
+//
+// 向对方发出的请求队列。队列深度按测得的带宽和延迟调整，
+// 使链路上始终有足够的请求，同时不超过对方的reqq
+//
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MinDepth     = 2
+	MaxDepth     = 500
+	InitialDepth = 4
+
+	// 队列中的请求能维持多长时间的传输
+	DefaultQueueTime = 3 * time.Second
+	// 单个请求的最短超时，实际超时还和RTT有关
+	DefaultRequestTimeout = 20 * time.Second
+	// 有未完成请求但这么久没收到数据，认为被对方冷落(snub)
+	DefaultSnubTimeout = 60 * time.Second
+)
+
+type pending struct {
+	Request
+	sent time.Time
+}
+
+type Pipeline struct {
+	Fast           bool // 有Fast Extension时choke不取消请求，等待reject
+	QueueTime      time.Duration
+	RequestTimeout time.Duration
+	SnubTimeout    time.Duration
+
+	mu        sync.Mutex
+	reqq      int
+	choked    bool
+	snubbed   bool
+	slowStart bool
+	depth     int
+	pending   []pending
+
+	srtt, rttvar time.Duration
+	rate         float64 // 字节/秒
+	bytes        int64   // 当前统计周期收到的字节
+	period       time.Time
+	waiting      time.Time // 开始等待数据的时间
+}
+
+// reqq为对方扩展握手中的值，0时使用默认值
+func NewPipeline(reqq int, fast bool) *Pipeline {
+	p := &Pipeline{
+		Fast:           fast,
+		QueueTime:      DefaultQueueTime,
+		RequestTimeout: DefaultRequestTimeout,
+		SnubTimeout:    DefaultSnubTimeout,
+		choked:         true,
+		slowStart:      true,
+		depth:          InitialDepth,
+	}
+	p.SetReqq(reqq)
+	return p
+}
+
+// 对方的扩展握手可能在连接建立之后才到
+func (p *Pipeline) SetReqq(reqq int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if reqq <= 0 {
+		reqq = DefaultReqq
+	}
+	p.reqq = reqq
+}
+
+// 当前允许的队列深度
+func (p *Pipeline) Depth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limit()
+}
+
+func (p *Pipeline) limit() int {
+	if p.snubbed {
+		return 1
+	}
+	d := p.depth
+	if d > p.reqq {
+		d = p.reqq
+	}
+	if d > MaxDepth {
+		d = MaxDepth
+	}
+	return d
+}
+
+// 现在还可以发出多少个请求
+func (p *Pipeline) Want() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.choked {
+		return 0
+	}
+	if n := p.limit() - len(p.pending); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// 被对方choke时还可以发出多少个allowed fast请求，没有Fast Extension时为0
+func (p *Pipeline) WantAllowed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.Fast || !p.choked {
+		return 0
+	}
+	if n := p.limit() - len(p.pending); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// 未完成的请求数
+func (p *Pipeline) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
+
+// 测得的下载速度，字节/秒
+func (p *Pipeline) Rate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+func (p *Pipeline) RTT() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.srtt
+}
+
+func (p *Pipeline) Snubbed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.snubbed
+}
+
+// 记录发出的请求
+func (p *Pipeline) Sent(r Request, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending) == 0 {
+		p.waiting = now
+	}
+	if p.period.IsZero() {
+		p.period = now
+	}
+	p.pending = append(p.pending, pending{r, now})
+}
+
+func (p *Pipeline) remove(r Request) (pending, bool) {
+	for i, x := range p.pending {
+		if x.Request == r {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			return x, true
+		}
+	}
+	return pending{}, false
+}
+
+// 收到数据，返回是否是我们请求的块
+func (p *Pipeline) Received(r Request, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	x, ok := p.remove(r)
+	if !ok {
+		return false
+	}
+	p.snubbed = false
+	p.waiting = now
+
+	// RTT的估计同TCP(RFC 6298)，包含在对方队列中的等待时间
+	rtt := now.Sub(x.sent)
+	if p.srtt == 0 {
+		p.srtt, p.rttvar = rtt, rtt/2
+	} else {
+		diff := p.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		p.rttvar = (3*p.rttvar + diff) / 4
+		p.srtt = (7*p.srtt + rtt) / 8
+	}
+
+	p.bytes += int64(r.Length)
+	if p.slowStart {
+		p.depth++ // 类似TCP慢启动，每收到一块深度加一
+	}
+	if elapsed := now.Sub(p.period); elapsed >= time.Second {
+		rate := float64(p.bytes) / elapsed.Seconds()
+		if p.slowStart && p.rate > 0 && rate < p.rate*1.1 {
+			p.slowStart = false // 速度不再增长
+		}
+		if p.rate == 0 {
+			p.rate = rate
+		} else {
+			p.rate = (p.rate + rate) / 2
+		}
+		p.bytes, p.period = 0, now
+		if !p.slowStart {
+			p.adjust()
+		}
+	}
+	return true
+}
+
+// 按带宽和延迟计算深度：队列中的数据能维持QueueTime加一个RTT
+func (p *Pipeline) adjust() {
+	d := int(p.rate*(p.QueueTime+p.srtt).Seconds()) / BlockSize
+	if d < MinDepth {
+		d = MinDepth
+	}
+	if d > MaxDepth {
+		d = MaxDepth
+	}
+	p.depth = d
+}
+
+// 对方拒绝了请求(Fast Extension)，返回是否是我们发出的请求
+func (p *Pipeline) Rejected(r Request) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.remove(r)
+	return ok
+}
+
+// 我们取消请求，例如endgame中别人已经送达
+func (p *Pipeline) Cancel(r Request) bool {
+	return p.Rejected(r)
+}
+
+// 对方choke了我们。没有Fast Extension时所有请求都被丢弃，
+// 返回的请求需要交还给picker
+func (p *Pipeline) Choked() []Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.choked = true
+	if p.Fast {
+		return nil
+	}
+	return p.drain()
+}
+
+func (p *Pipeline) Unchoked(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.choked = false
+	p.waiting = now
+}
+
+func (p *Pipeline) IsChoked() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.choked
+}
+
+// 连接断开，返回所有未完成的请求
+func (p *Pipeline) Close() []Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.drain()
+}
+
+func (p *Pipeline) drain() []Request {
+	list := make([]Request, len(p.pending))
+	for i, x := range p.pending {
+		list[i] = x.Request
+	}
+	p.pending = nil
+	return list
+}
+
+func (p *Pipeline) timeout() time.Duration {
+	t := p.srtt + 4*p.rttvar
+	if t < p.RequestTimeout {
+		t = p.RequestTimeout
+	}
+	return t
+}
+
+// 定时检查，返回超时的请求，调用者需要发送cancel并交还给picker。
+// 长时间没有数据时标记为snubbed，交还所有请求并把深度降为1
+func (p *Pipeline) Expire(now time.Time) []Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending) == 0 {
+		return nil
+	}
+
+	if !p.snubbed && now.Sub(p.waiting) >= p.SnubTimeout {
+		p.snubbed = true
+		p.slowStart = false
+		p.depth = MinDepth
+		return p.drain()
+	}
+
+	var expired []Request
+	kept := p.pending[:0]
+	for _, x := range p.pending {
+		if now.Sub(x.sent) >= p.timeout() {
+			expired = append(expired, x.Request)
+		} else {
+			kept = append(kept, x)
+		}
+	}
+	p.pending = kept
+	return expired
+}
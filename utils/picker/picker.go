@@ -0,0 +1,635 @@
+package picker
+
+//
+// piece选择：稀有优先、顺序/截止时间（流媒体）、文件优先级和endgame
+//
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils/bitfield"
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+const (
+	BlockSize = 16 * 1024
+
+	// 开始时随机选择的piece数量，尽快拿到可以交换的数据
+	DefaultRandomFirst = 4
+)
+
+type Mode int
+
+const (
+	RarestFirst Mode = iota
+	Sequential       // 按顺序下载，用于流媒体
+	Deadline         // 有截止时间的piece按时间先后优先，其余稀有优先
+)
+
+// 下载优先级，Skip表示不下载
+type Priority int
+
+const (
+	Skip   Priority = 0
+	Low    Priority = 1
+	Normal Priority = 4
+	High   Priority = 7
+)
+
+var priorityNames = map[Priority]string{Skip: "skip", Low: "low", Normal: "normal", High: "high"}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// 解析skip、low、normal或high
+func ParsePriority(s string) (Priority, error) {
+	for p, name := range priorityNames {
+		if strings.EqualFold(s, name) {
+			return p, nil
+		}
+	}
+	return Normal, fmt.Errorf("picker: unknown priority %q", s)
+}
+
+// 请求的数据块
+type Block struct {
+	Piece  int
+	Begin  int
+	Length int
+}
+
+// 需要取消的重复请求
+type Cancel struct {
+	Peer  string
+	Block Block
+}
+
+const (
+	blockFree = iota
+	blockRequested
+	blockReceived
+)
+
+type blockState struct {
+	state int
+	peers []string // 请求过这块的peer，endgame时可能有多个
+}
+
+// 正在下载的piece
+type pieceState struct {
+	blocks []blockState
+}
+
+// 文件在数据中的范围
+type fileRange struct {
+	offset, length int64
+}
+
+type Picker struct {
+	RandomFirst int
+
+	mu           sync.Mutex
+	pieceLength  int64
+	totalLength  int64
+	numPieces    int
+	files        []fileRange
+	filePriority []Priority
+	priority     []Priority // 由文件优先级计算
+	availability []int
+	have         *bitfield.Bitfield
+	rank         []int // 随机顺序，用于相同稀有度时打散
+	downloading  map[int]*pieceState
+	mode         Mode
+	deadlines    map[int]time.Time
+	endgame      bool
+}
+
+func New(info torrent.InfoStruct) *Picker {
+	p := &Picker{
+		RandomFirst: DefaultRandomFirst,
+		pieceLength: info.PieceLength,
+		totalLength: info.TotalLength(),
+		numPieces:   info.NumPieces(),
+		downloading: make(map[int]*pieceState),
+		deadlines:   make(map[int]time.Time),
+	}
+	if info.Length != nil {
+		p.files = []fileRange{{0, *info.Length}}
+	} else {
+		var offset int64
+		for _, f := range info.Files {
+			p.files = append(p.files, fileRange{offset, f.Length})
+			offset += f.Length
+		}
+	}
+	p.filePriority = make([]Priority, len(p.files))
+	for i := range p.filePriority {
+		p.filePriority[i] = Normal
+	}
+	p.priority = make([]Priority, p.numPieces)
+	p.availability = make([]int, p.numPieces)
+	p.have = bitfield.New(p.numPieces)
+	p.rank = rand.Perm(p.numPieces)
+	p.updatePriorities()
+	return p
+}
+
+func (p *Picker) NumPieces() int {
+	return p.numPieces
+}
+
+// 第i个piece的长度，最后一个可能较短
+func (p *Picker) PieceSize(i int) int {
+	if i == p.numPieces-1 {
+		return int(p.totalLength - int64(i)*p.pieceLength)
+	}
+	return int(p.pieceLength)
+}
+
+func (p *Picker) numBlocks(i int) int {
+	return (p.PieceSize(i) + BlockSize - 1) / BlockSize
+}
+
+func (p *Picker) block(i, j int) Block {
+	b := Block{Piece: i, Begin: j * BlockSize, Length: BlockSize}
+	if rest := p.PieceSize(i) - b.Begin; rest < BlockSize {
+		b.Length = rest
+	}
+	return b
+}
+
+// piece覆盖的文件，piece可能跨越多个文件
+func (p *Picker) PieceFiles(i int) []int {
+	start := int64(i) * p.pieceLength
+	end := start + int64(p.PieceSize(i))
+	var files []int
+	for f, r := range p.files {
+		if r.length > 0 && r.offset < end && r.offset+r.length > start {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// 文件覆盖的piece范围[first, last]，空文件返回-1
+func (p *Picker) FilePieces(f int) (first, last int) {
+	r := p.files[f]
+	if r.length == 0 {
+		return -1, -1
+	}
+	return int(r.offset / p.pieceLength), int((r.offset + r.length - 1) / p.pieceLength)
+}
+
+// piece的优先级取覆盖的文件中最高的
+func (p *Picker) updatePriorities() {
+	for i := range p.priority {
+		p.priority[i] = Skip
+	}
+	for f := range p.files {
+		first, last := p.FilePieces(f)
+		if first < 0 {
+			continue
+		}
+		for i := first; i <= last; i++ {
+			if p.filePriority[f] > p.priority[i] {
+				p.priority[i] = p.filePriority[f]
+			}
+		}
+	}
+}
+
+func (p *Picker) SetFilePriority(f int, prio Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filePriority[f] = prio
+	p.updatePriorities()
+	p.endgame = false
+}
+
+func (p *Picker) FilePriority(f int) Priority {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.filePriority[f]
+}
+
+// 选择下载的文件的总字节数和其中已经完成的字节数，不包括共用piece中其他文件的部分
+func (p *Picker) SelectedBytes() (total, have int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for f, r := range p.files {
+		if p.filePriority[f] == Skip || r.length == 0 {
+			continue
+		}
+		total += r.length
+		first, last := p.FilePieces(f)
+		for i := first; i <= last; i++ {
+			if !p.have.Get(i) {
+				continue
+			}
+			begin, end := int64(i)*p.pieceLength, int64(i+1)*p.pieceLength
+			if begin < r.offset {
+				begin = r.offset
+			}
+			if end > r.offset+r.length {
+				end = r.offset + r.length
+			}
+			have += end - begin
+		}
+	}
+	return total, have
+}
+
+func (p *Picker) PiecePriority(i int) Priority {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.priority[i]
+}
+
+func (p *Picker) SetMode(m Mode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mode = m
+}
+
+// 设置piece的截止时间，Deadline模式下按时间先后下载
+func (p *Picker) SetDeadline(i int, t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t.IsZero() {
+		delete(p.deadlines, i)
+	} else {
+		p.deadlines[i] = t
+	}
+}
+
+// 新连接的peer，has为它的bitfield
+func (p *Picker) AddPeer(has *bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := has.FirstSet(); i >= 0 && i < p.numPieces; i = has.NextSet(i + 1) {
+		p.availability[i]++
+	}
+}
+
+// peer断开，availability中减去它的piece
+func (p *Picker) RemovePeer(peer string, has *bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := has.FirstSet(); i >= 0 && i < p.numPieces; i = has.NextSet(i + 1) {
+		if p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+	p.release(peer)
+}
+
+// peer发来HAVE
+func (p *Picker) PeerHave(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i >= 0 && i < p.numPieces {
+		p.availability[i]++
+	}
+}
+
+func (p *Picker) Availability(i int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.availability[i]
+}
+
+// 我们是否已有这个piece
+func (p *Picker) Have(i int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.have.Get(i)
+}
+
+// 我们已有的piece
+func (p *Picker) Bitfield() *bitfield.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.have.Clone()
+}
+
+// 需要下载的piece，包括已有的
+func (p *Picker) Selected() *bitfield.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := bitfield.New(p.numPieces)
+	for i, prio := range p.priority {
+		if prio != Skip {
+			f.Set(i)
+		}
+	}
+	return f
+}
+
+// 标记已有的piece，例如恢复下载时
+func (p *Picker) SetHave(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.have.Set(i)
+	delete(p.downloading, i)
+	delete(p.deadlines, i)
+}
+
+// 重新校验时数据已经损坏，需要重新下载
+func (p *Picker) ClearHave(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.have.Clear(i)
+}
+
+func (p *Picker) NumHave() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.have.Count()
+}
+
+// 所有需要下载的piece都已完成
+func (p *Picker) Complete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := p.have.FirstClear(); i >= 0; i = p.have.NextClear(i + 1) {
+		if p.priority[i] != Skip {
+			return false
+		}
+	}
+	return true
+}
+
+// 是否处于endgame
+func (p *Picker) Endgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.endgame
+}
+
+// piece是否需要下载
+func (p *Picker) wanted(i int) bool {
+	return !p.have.Get(i) && p.priority[i] != Skip
+}
+
+// 为peer选择最多max个要请求的块。has为peer的bitfield
+func (p *Picker) Pick(peer string, has *bitfield.Bitfield, max int) []Block {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var blocks []Block
+	take := func(i int) {
+		st := p.downloading[i]
+		if st == nil {
+			st = &pieceState{blocks: make([]blockState, p.numBlocks(i))}
+			p.downloading[i] = st
+		}
+		for j := range st.blocks {
+			if len(blocks) >= max {
+				return
+			}
+			if b := &st.blocks[j]; b.state == blockFree {
+				b.state = blockRequested
+				b.peers = append(b.peers[:0], peer)
+				blocks = append(blocks, p.block(i, j))
+			}
+		}
+	}
+
+	// 先完成已经开始的piece，再选择新的piece
+	for _, i := range p.candidates(has, true) {
+		if len(blocks) >= max {
+			return blocks
+		}
+		take(i)
+	}
+	for _, i := range p.candidates(has, false) {
+		if len(blocks) >= max {
+			return blocks
+		}
+		take(i)
+	}
+	if len(blocks) > 0 {
+		return blocks
+	}
+
+	// 没有空闲的块时进入endgame，向多个peer请求剩余的块
+	if !p.endgame && p.allRequested() {
+		p.endgame = true
+	}
+	if p.endgame {
+		for _, i := range p.candidates(has, true) {
+			st := p.downloading[i]
+			for j := range st.blocks {
+				b := &st.blocks[j]
+				if len(blocks) >= max {
+					return blocks
+				}
+				if b.state == blockRequested && !contains(b.peers, peer) {
+					b.peers = append(b.peers, peer)
+					blocks = append(blocks, p.block(i, j))
+				}
+			}
+		}
+	}
+	return blocks
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 需要的piece中没有未请求的块
+func (p *Picker) allRequested() bool {
+	for i := 0; i < p.numPieces; i++ {
+		if !p.wanted(i) {
+			continue
+		}
+		st := p.downloading[i]
+		if st == nil {
+			return false
+		}
+		for _, b := range st.blocks {
+			if b.state == blockFree {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 候选piece，按选择顺序排列。started为true时只返回正在下载的piece
+func (p *Picker) candidates(has *bitfield.Bitfield, started bool) []int {
+	var list []int
+	for i := has.FirstSet(); i >= 0 && i < p.numPieces; i = has.NextSet(i + 1) {
+		if !p.wanted(i) {
+			continue
+		}
+		if _, ok := p.downloading[i]; ok != started {
+			continue
+		}
+		list = append(list, i)
+	}
+
+	random := p.mode == RarestFirst && p.have.Count() < p.RandomFirst && !started
+	sort.Slice(list, func(x, y int) bool {
+		a, b := list[x], list[y]
+		if p.mode == Deadline {
+			da, oka := p.deadlines[a]
+			db, okb := p.deadlines[b]
+			if oka != okb {
+				return oka
+			}
+			if oka && !da.Equal(db) {
+				return da.Before(db)
+			}
+		}
+		if p.priority[a] != p.priority[b] {
+			return p.priority[a] > p.priority[b]
+		}
+		switch {
+		case p.mode == Sequential:
+			return a < b
+		case random:
+		case p.availability[a] != p.availability[b]:
+			return p.availability[a] < p.availability[b]
+		}
+		return p.rank[a] < p.rank[b]
+	})
+	return list
+}
+
+// 收到一个块，返回piece是否已收齐和需要取消的重复请求
+func (p *Picker) Received(peer string, b Block) (bool, []Cancel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.downloading[b.Piece]
+	if st == nil || b.Begin%BlockSize != 0 || b.Begin/BlockSize >= len(st.blocks) {
+		return false, nil
+	}
+	bs := &st.blocks[b.Begin/BlockSize]
+	if bs.state == blockReceived {
+		return false, nil
+	}
+
+	var cancels []Cancel
+	for _, other := range bs.peers {
+		if other != peer {
+			cancels = append(cancels, Cancel{Peer: other, Block: b})
+		}
+	}
+	bs.state = blockReceived
+	bs.peers = nil
+
+	for _, x := range st.blocks {
+		if x.state != blockReceived {
+			return false, cancels
+		}
+	}
+	return true, cancels
+}
+
+// piece校验结果，失败时重新下载
+func (p *Picker) Hashed(i int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.downloading, i)
+	if ok {
+		p.have.Set(i)
+		delete(p.deadlines, i)
+	} else {
+		p.endgame = false
+	}
+}
+
+// 正在下载的piece中已经收到的块，用于快速恢复。已经收齐等待校验的piece不包括在内
+func (p *Picker) Unfinished() map[int]*bitfield.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make(map[int]*bitfield.Bitfield)
+	for i, st := range p.downloading {
+		f := bitfield.New(len(st.blocks))
+		for j, b := range st.blocks {
+			if b.state == blockReceived {
+				f.Set(j)
+			}
+		}
+		if !f.None() && !f.All() {
+			result[i] = f
+		}
+	}
+	return result
+}
+
+// 恢复已经收到的块
+func (p *Picker) SetUnfinished(i int, received *bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.have.Get(i) || received.Len() != p.numBlocks(i) || received.All() {
+		return
+	}
+	st := &pieceState{blocks: make([]blockState, received.Len())}
+	for j := range st.blocks {
+		if received.Get(j) {
+			st.blocks[j].state = blockReceived
+		}
+	}
+	p.downloading[i] = st
+}
+
+// 请求被拒绝或取消，块可以重新分配
+func (p *Picker) Abort(peer string, b Block) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.downloading[b.Piece]
+	if st == nil || b.Begin/BlockSize >= len(st.blocks) {
+		return
+	}
+	p.abort(&st.blocks[b.Begin/BlockSize], peer)
+}
+
+func (p *Picker) abort(b *blockState, peer string) {
+	if b.state != blockRequested {
+		return
+	}
+	for k, other := range b.peers {
+		if other == peer {
+			b.peers = append(b.peers[:k], b.peers[k+1:]...)
+			break
+		}
+	}
+	if len(b.peers) == 0 {
+		b.state = blockFree
+		p.endgame = false
+	}
+}
+
+// 释放peer的所有请求，用于choke和断开连接
+func (p *Picker) Release(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.release(peer)
+}
+
+func (p *Picker) release(peer string) {
+	for _, st := range p.downloading {
+		for j := range st.blocks {
+			if contains(st.blocks[j].peers, peer) {
+				p.abort(&st.blocks[j], peer)
+			}
+		}
+	}
+}
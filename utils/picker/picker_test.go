@@ -0,0 +1,280 @@
+package picker
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openqt/whonet/utils/bitfield"
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+func makeInfo(pieceLength int64, lengths ...int64) torrent.InfoStruct {
+	info := torrent.InfoStruct{Name: "test", PieceLength: pieceLength}
+	var total int64
+	for i, n := range lengths {
+		info.Files = append(info.Files, torrent.FileStruct{Length: n, Path: []string{fmt.Sprintf("f%d", i)}})
+		total += n
+	}
+	pieces := int((total + pieceLength - 1) / pieceLength)
+	info.Pieces.O = strings.Repeat("x", pieces*20)
+	return info
+}
+
+func bits(n int, has func(int) bool) *bitfield.Bitfield {
+	f := bitfield.New(n)
+	for i := 0; i < n; i++ {
+		if has(i) {
+			f.Set(i)
+		}
+	}
+	return f
+}
+
+func all(n int) *bitfield.Bitfield {
+	return bitfield.Full(n)
+}
+
+// 收到所有请求的块并通过校验
+func finish(p *Picker, peer string, blocks []Block) []int {
+	var done []int
+	for _, b := range blocks {
+		if ok, _ := p.Received(peer, b); ok {
+			p.Hashed(b.Piece, true)
+			done = append(done, b.Piece)
+		}
+	}
+	return done
+}
+
+func TestBlocks(t *testing.T) {
+	p := New(makeInfo(2*BlockSize, 2*BlockSize+100))
+	if p.NumPieces() != 2 || p.PieceSize(1) != 100 {
+		t.Fatalf("pieces %d, last %d", p.NumPieces(), p.PieceSize(1))
+	}
+	p.AddPeer(all(2))
+	blocks := p.Pick("a", all(2), 10)
+	if len(blocks) != 3 {
+		t.Fatalf("blocks %v", blocks)
+	}
+	for _, b := range blocks {
+		if b.Piece == 1 && b.Length != 100 {
+			t.Errorf("last block %v", b)
+		}
+	}
+	finish(p, "a", blocks)
+	if !p.Complete() || p.NumHave() != 2 {
+		t.Error("not complete")
+	}
+}
+
+func TestRarestFirst(t *testing.T) {
+	const n = 64
+	p := New(makeInfo(BlockSize, n*BlockSize))
+	p.RandomFirst = 0
+
+	// 合成的群：piece i有 i%8+1 个peer拥有
+	for k := 0; k < 8; k++ {
+		k := k
+		p.AddPeer(bits(n, func(i int) bool { return i%8 >= k }))
+	}
+	seeder := all(n)
+	blocks := p.Pick("s", seeder, 8)
+	for _, b := range blocks {
+		if b.Piece%8 != 0 {
+			t.Errorf("piece %d (availability %d) is not rarest", b.Piece, p.Availability(b.Piece))
+		}
+	}
+
+	// 断开后availability减少
+	p.RemovePeer("x", bits(n, func(i int) bool { return i%8 >= 7 }))
+	if p.Availability(7) != 7 || p.Availability(0) != 1 {
+		t.Errorf("availability %d %d", p.Availability(7), p.Availability(0))
+	}
+	p.PeerHave(0)
+	if p.Availability(0) != 2 {
+		t.Errorf("availability %d", p.Availability(0))
+	}
+}
+
+func TestRandomFirst(t *testing.T) {
+	const n = 256
+	p := New(makeInfo(BlockSize, n*BlockSize))
+	p.AddPeer(all(n))
+	p.AddPeer(bits(n, func(i int) bool { return i >= n/2 }))
+
+	// 开始时不按稀有度选择
+	first := p.Pick("a", all(n), DefaultRandomFirst)
+	finish(p, "a", first)
+	if p.NumHave() != DefaultRandomFirst {
+		t.Fatalf("have %d", p.NumHave())
+	}
+	for _, b := range p.Pick("a", all(n), 16) {
+		if b.Piece >= n/2 {
+			t.Errorf("piece %d is not rarest", b.Piece)
+		}
+	}
+}
+
+func TestSequential(t *testing.T) {
+	const n = 32
+	p := New(makeInfo(BlockSize, n*BlockSize))
+	p.SetMode(Sequential)
+	p.AddPeer(all(n))
+	for i, b := range p.Pick("a", all(n), n) {
+		if b.Piece != i {
+			t.Fatalf("block %d is piece %d", i, b.Piece)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	const n = 32
+	p := New(makeInfo(BlockSize, n*BlockSize))
+	p.SetMode(Deadline)
+	p.AddPeer(all(n))
+	now := time.Now()
+	p.SetDeadline(20, now.Add(2*time.Second))
+	p.SetDeadline(10, now.Add(time.Second))
+	blocks := p.Pick("a", all(n), 3)
+	if blocks[0].Piece != 10 || blocks[1].Piece != 20 {
+		t.Errorf("blocks %v", blocks)
+	}
+}
+
+func TestFilePriority(t *testing.T) {
+	// 三个文件，piece 1跨越文件0和1，piece 3跨越文件1和2
+	p := New(makeInfo(BlockSize, BlockSize+100, 2*BlockSize, BlockSize))
+	if got := p.PieceFiles(1); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("piece files %v", got)
+	}
+	if first, last := p.FilePieces(1); first != 1 || last != 3 {
+		t.Errorf("file pieces %d %d", first, last)
+	}
+
+	p.SetFilePriority(0, Skip)
+	p.SetFilePriority(2, Skip)
+	if p.PiecePriority(0) != Skip || p.PiecePriority(1) != Normal || p.PiecePriority(3) != Normal {
+		t.Error("boundary pieces must follow the wanted file")
+	}
+	p.SetFilePriority(1, High)
+	p.SetFilePriority(0, Low)
+
+	n := p.NumPieces()
+	p.AddPeer(all(n))
+	p.RandomFirst = 0
+	blocks := p.Pick("a", all(n), n)
+	if len(blocks) != n-1 || blocks[0].Piece < 1 || blocks[0].Piece > 3 {
+		t.Fatalf("blocks %v", blocks)
+	}
+	for _, b := range blocks {
+		if b.Piece == 4 {
+			t.Error("skipped piece requested")
+		}
+	}
+	finish(p, "a", blocks)
+	if !p.Complete() || p.Have(4) {
+		t.Error("selected pieces not complete")
+	}
+	if s := p.Selected().Ranges(); s != "0-3" || p.Bitfield().Ranges() != "0-3" {
+		t.Errorf("selected %s, have %s", s, p.Bitfield())
+	}
+	// 文件2不需要，piece 3中属于它的部分不算
+	if total, have := p.SelectedBytes(); total != 3*BlockSize+100 || have != total {
+		t.Errorf("selected bytes %d %d", total, have)
+	}
+
+	if prio, err := ParsePriority("HIGH"); err != nil || prio != High || prio.String() != "high" {
+		t.Errorf("parse %v %v", prio, err)
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("unknown priority")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	p := New(makeInfo(BlockSize, 4*BlockSize))
+	p.AddPeer(all(4))
+	a := p.Pick("a", all(4), 4)
+	if len(a) != 4 {
+		t.Fatalf("blocks %v", a)
+	}
+	p.Release("a") // choke
+	if b := p.Pick("b", all(4), 4); len(b) != 4 {
+		t.Fatalf("released blocks not picked: %v", b)
+	}
+	p.Abort("b", a[0])
+	if c := p.Pick("c", all(4), 4); len(c) != 1 || c[0] != a[0] {
+		t.Fatalf("aborted block not picked: %v", c)
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	const n = 4
+	p := New(makeInfo(BlockSize, n*BlockSize))
+	p.AddPeer(all(n))
+	p.AddPeer(all(n))
+	a := p.Pick("a", all(n), n)
+	if p.Endgame() {
+		t.Fatal("endgame too early")
+	}
+	b := p.Pick("b", all(n), n)
+	if !p.Endgame() || len(b) != n {
+		t.Fatalf("endgame %v, blocks %v", p.Endgame(), b)
+	}
+	if again := p.Pick("b", all(n), n); len(again) != 0 {
+		t.Errorf("same block requested twice from b: %v", again)
+	}
+
+	done, cancels := p.Received("b", a[0])
+	if !done || len(cancels) != 1 || cancels[0].Peer != "a" || cancels[0].Block != a[0] {
+		t.Errorf("done %v, cancels %v", done, cancels)
+	}
+	p.Hashed(a[0].Piece, true)
+	if done, cancels := p.Received("a", a[0]); done || cancels != nil {
+		t.Error("duplicate block accepted")
+	}
+
+	// 校验失败重新下载
+	done, _ = p.Received("a", a[1])
+	p.Hashed(a[1].Piece, false)
+	if !done || p.Endgame() || p.Have(a[1].Piece) {
+		t.Error("failed piece not reset")
+	}
+	if c := p.Pick("c", all(n), n); len(c) != 1 || c[0] != a[1] {
+		t.Errorf("failed piece not picked: %v", c)
+	}
+}
+
+// 模拟从多个部分拥有数据的peer下载，直到完成
+func TestSwarm(t *testing.T) {
+	const n, peers = 200, 12
+	p := New(makeInfo(4*BlockSize, n*4*BlockSize-1000))
+	r := rand.New(rand.NewSource(1))
+	has := make([]*bitfield.Bitfield, peers)
+	for k := range has {
+		has[k] = bits(n, func(int) bool { return r.Intn(3) == 0 })
+		p.AddPeer(has[k])
+	}
+	has[0] = all(n)
+	p.AddPeer(has[0])
+
+	for round := 0; !p.Complete(); round++ {
+		if round > 10000 {
+			t.Fatal("swarm did not complete")
+		}
+		k := r.Intn(peers)
+		peer := fmt.Sprint(k)
+		blocks := p.Pick(peer, has[k], 1+r.Intn(16))
+		if r.Intn(10) == 0 {
+			p.Release(peer)
+			continue
+		}
+		finish(p, peer, blocks)
+	}
+	if p.NumHave() != n {
+		t.Errorf("have %d", p.NumHave())
+	}
+}
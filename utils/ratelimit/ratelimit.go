@@ -0,0 +1,119 @@
+package ratelimit
+
+//
+// 令牌桶限速。一份数据可能同时受全局、种子和peer几级限制，
+// 从每一级取出令牌，按等待最久的一级等待
+//
+
+import (
+	"sync"
+	"time"
+)
+
+// 速度很低时最少也能积累的令牌，一个piece块可以不等待发出
+const minBurst = 64 * 1024
+
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64 // 字节/秒，0表示不限制
+	tokens float64
+	last   time.Time
+}
+
+// rate为0时不限制
+func New(rate int64) *Limiter {
+	l := &Limiter{last: time.Now()}
+	l.SetRate(rate)
+	return l
+}
+
+// 运行中修改速度
+func (l *Limiter) SetRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	if burst := l.burst(); l.tokens > burst {
+		l.tokens = burst
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// 最多积累一秒的令牌
+func (l *Limiter) burst() float64 {
+	if l.rate < minBurst {
+		return minBurst
+	}
+	return float64(l.rate)
+}
+
+// 取出n个字节的令牌，返回需要等待的时间。令牌可以透支，之后的调用会等待更久
+func (l *Limiter) Take(n int, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		l.last = now
+		return 0
+	}
+	if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens += elapsed * float64(l.rate)
+		if burst := l.burst(); l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// 从所有limiter取出n个字节并等待，nil的limiter不限制。quit关闭时立即返回false
+func Wait(quit <-chan struct{}, n int, limiters ...*Limiter) bool {
+	now := time.Now()
+	var wait time.Duration
+	for _, l := range limiters {
+		if d := l.Take(n, now); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// 上传和下载两个方向
+type Pair struct {
+	Up, Down *Limiter
+}
+
+func NewPair(up, down int64) *Pair {
+	return &Pair{Up: New(up), Down: New(down)}
+}
+
+func (p *Pair) Set(up, down int64) {
+	p.Up.SetRate(up)
+	p.Down.SetRate(down)
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+	l := New(100000)
+	now := l.last
+	// 开始时没有令牌
+	if d := l.Take(50000, now); d != 500*time.Millisecond {
+		t.Errorf("wait %v", d)
+	}
+	// 透支的部分由之后的调用补上
+	if d := l.Take(50000, now.Add(500*time.Millisecond)); d != 500*time.Millisecond {
+		t.Errorf("wait %v", d)
+	}
+	// 最多积累一秒
+	now = now.Add(time.Hour)
+	if d := l.Take(100000, now); d != 0 {
+		t.Errorf("wait %v", d)
+	}
+	if d := l.Take(10000, now); d != 100*time.Millisecond {
+		t.Errorf("wait %v", d)
+	}
+
+	// 运行中取消限制
+	l.SetRate(0)
+	if d := l.Take(1<<30, now); d != 0 || l.Rate() != 0 {
+		t.Errorf("unlimited wait %v", d)
+	}
+	var nilLimiter *Limiter
+	if d := nilLimiter.Take(100, now); d != 0 {
+		t.Errorf("nil wait %v", d)
+	}
+}
+
+func TestWait(t *testing.T) {
+	fast, slow := New(1<<20), New(100000)
+	start := time.Now()
+	if !Wait(nil, 20000, fast, nil, slow) {
+		t.Fatal("wait failed")
+	}
+	// 按最慢的一级等待
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("waited %v", elapsed)
+	}
+
+	quit := make(chan struct{})
+	close(quit)
+	if Wait(quit, 1000000, slow) {
+		t.Error("wait not interrupted")
+	}
+}
@@ -0,0 +1,179 @@
+package resume
+
+//
+// 快速恢复：保存种子的下载进度，重启后不用重新校验全部数据。
+// 保存的文件大小和修改时间与当前不同时，只重新校验这些文件
+//
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/bitfield"
+	"github.com/spf13/afero"
+)
+
+const version = 1
+
+var ErrFormat = errors.New("resume: invalid data")
+
+// 保存时文件的状态，文件不存在时Size为-1
+type File struct {
+	Size  int64
+	Mtime int64 // UnixNano
+}
+
+// 没有下载完的piece中已经收到的块
+type Unfinished struct {
+	Piece  int
+	Blocks *bitfield.Bitfield
+}
+
+type Data struct {
+	InfoHash   string // 20字节
+	Have       *bitfield.Bitfield
+	Files      []File
+	Unfinished []Unfinished
+	Uploaded   int64
+	Downloaded int64
+	Peers      []string // 连接过的peer地址
+	Priorities []int    // 文件优先级
+}
+
+func bits(f *bitfield.Bitfield) map[string]interface{} {
+	return map[string]interface{}{"len": f.Len(), "bits": string(f.Bytes())}
+}
+
+func parseBits(v interface{}) (*bitfield.Bitfield, error) {
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrFormat
+	}
+	n, _ := d["len"].(int)
+	b, _ := d["bits"].(string)
+	return bitfield.FromBytes([]byte(b), n)
+}
+
+// 用bencode编码
+func (d *Data) Encode() []byte {
+	var files, unfinished, peers, prio []interface{}
+	for _, f := range d.Files {
+		files = append(files, map[string]interface{}{"size": f.Size, "mtime": f.Mtime})
+	}
+	for _, u := range d.Unfinished {
+		unfinished = append(unfinished, map[string]interface{}{"piece": u.Piece, "blocks": bits(u.Blocks)})
+	}
+	for _, p := range d.Peers {
+		peers = append(peers, p)
+	}
+	for _, p := range d.Priorities {
+		prio = append(prio, p)
+	}
+	m := map[string]interface{}{
+		"version":    version,
+		"info-hash":  d.InfoHash,
+		"have":       bits(d.Have),
+		"files":      files,
+		"unfinished": unfinished,
+		"uploaded":   d.Uploaded,
+		"downloaded": d.Downloaded,
+		"peers":      peers,
+		"priorities": prio,
+	}
+	return []byte(bencode.NewEncoder().Encode(m))
+}
+
+func Decode(b []byte) (*Data, error) {
+	val, err := bencode.NewDecoder().TryDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, ErrFormat
+	}
+	if v, _ := m["version"].(int); v != version {
+		return nil, ErrFormat
+	}
+	d := new(Data)
+	d.InfoHash, _ = m["info-hash"].(string)
+	if d.Have, err = parseBits(m["have"]); err != nil {
+		return nil, err
+	}
+	up, _ := m["uploaded"].(int)
+	down, _ := m["downloaded"].(int)
+	d.Uploaded, d.Downloaded = int64(up), int64(down)
+
+	files, _ := m["files"].([]interface{})
+	for _, v := range files {
+		f, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, ErrFormat
+		}
+		size, _ := f["size"].(int)
+		mtime, _ := f["mtime"].(int)
+		d.Files = append(d.Files, File{Size: int64(size), Mtime: int64(mtime)})
+	}
+	unfinished, _ := m["unfinished"].([]interface{})
+	for _, v := range unfinished {
+		u, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, ErrFormat
+		}
+		piece, _ := u["piece"].(int)
+		blocks, err := parseBits(u["blocks"])
+		if err != nil {
+			return nil, err
+		}
+		d.Unfinished = append(d.Unfinished, Unfinished{Piece: piece, Blocks: blocks})
+	}
+	peers, _ := m["peers"].([]interface{})
+	for _, v := range peers {
+		if s, ok := v.(string); ok {
+			d.Peers = append(d.Peers, s)
+		}
+	}
+	prio, _ := m["priorities"].([]interface{})
+	for _, v := range prio {
+		p, _ := v.(int)
+		d.Priorities = append(d.Priorities, p)
+	}
+	return d, nil
+}
+
+// 读取恢复文件，文件不存在时返回的错误满足os.IsNotExist
+func Load(fs afero.Fs, path string) (*Data, error) {
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(b)
+}
+
+// 先写入临时文件再改名，中途退出不会留下不完整的文件
+func Save(fs afero.Fs, path string, d *Data) error {
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d.Encode())
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = fs.Rename(tmp, path)
+	}
+	if err != nil {
+		fs.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package resume
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/openqt/whonet/utils/bitfield"
+	"github.com/spf13/afero"
+)
+
+func TestEncode(t *testing.T) {
+	have := bitfield.New(10)
+	have.Set(0)
+	have.Set(9)
+	blocks := bitfield.New(3)
+	blocks.Set(1)
+	d := &Data{
+		InfoHash:   "01234567890123456789",
+		Have:       have,
+		Files:      []File{{Size: 100, Mtime: 1540000000123456789}, {Size: -1}},
+		Unfinished: []Unfinished{{Piece: 4, Blocks: blocks}},
+		Uploaded:   1 << 40,
+		Downloaded: 12345,
+		Peers:      []string{"1.2.3.4:6881", "[::1]:80"},
+		Priorities: []int{4, 0},
+	}
+	got, err := Decode(d.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, d) {
+		t.Errorf("decoded %+v", got)
+	}
+
+	if _, err := Decode([]byte("d7:versioni2ee")); err != ErrFormat {
+		t.Errorf("version: %v", err)
+	}
+	if _, err := Decode([]byte("d4:haved4:bits1:\xff3:leni3ee7:versioni1ee")); err == nil {
+		t.Error("bad bitfield")
+	}
+}
+
+func TestSave(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if _, err := Load(fs, "/dir/x.resume"); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+	d := &Data{InfoHash: "x", Have: bitfield.Full(3)}
+	for i := 0; i < 2; i++ {
+		if err := Save(fs, "/dir/x.resume", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := Load(fs, "/dir/x.resume")
+	if err != nil || !got.Have.All() {
+		t.Errorf("load: %v", err)
+	}
+	if ok, _ := afero.Exists(fs, "/dir/x.resume.tmp"); ok {
+		t.Error("temporary file left")
+	}
+	if err := Save(afero.NewReadOnlyFs(fs), "/dir/x.resume", d); err == nil {
+		t.Error("saved on read-only fs")
+	}
+}
@@ -0,0 +1,511 @@
+package storage
+
+//
+// 把piece映射到磁盘上的文件，piece可能跨越多个文件。
+// 文件在第一次写入时创建；padding文件不保存，读出来是0；
+// 不需要的文件不创建，和需要的文件共用的piece中属于它的部分写入parts目录，每个piece一个文件。
+// 文件保存在afero.Fs中，可以换成内存、只读或限制在某个目录下的文件系统
+//
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/spf13/afero"
+)
+
+// 按piece读写数据
+type Interface interface {
+	PieceSize(i int) int
+	ReadBlock(piece, begin int, b []byte) error
+	WriteBlock(piece, begin int, b []byte) error
+	Verify(i int) bool
+	Close() error
+}
+
+var _ Interface = (*Storage)(nil)
+
+// 创建文件时如何分配空间
+type Allocation int
+
+const (
+	AllocNone   Allocation = iota // 随写入增长
+	AllocSparse                   // 设置为最终大小，不实际占用空间
+	AllocFull                     // 写入0占满空间
+)
+
+var allocationNames = []string{"none", "sparse", "full"}
+
+func (a Allocation) String() string {
+	if a >= 0 && int(a) < len(allocationNames) {
+		return allocationNames[a]
+	}
+	return fmt.Sprintf("allocation(%d)", int(a))
+}
+
+// 解析配置，为空时不预先分配
+func ParseAllocation(s string) (Allocation, error) {
+	if s == "" {
+		return AllocNone, nil
+	}
+	for i, name := range allocationNames {
+		if strings.EqualFold(s, name) {
+			return Allocation(i), nil
+		}
+	}
+	return AllocNone, fmt.Errorf("storage: unknown allocation %q", s)
+}
+
+// 数据中的一个文件
+type File struct {
+	Path    string // 本地路径
+	Offset  int64  // 在全部数据中的位置
+	Length  int64
+	Padding bool // 不保存，内容全是0
+	Skip    bool // 不需要，本地没有时数据写入parts目录
+
+	f        afero.File
+	writable bool
+	size     int64 // 打开后文件的当前大小
+}
+
+type Storage struct {
+	Fs         afero.Fs
+	Info       torrent.InfoStruct
+	Dir        string
+	Files      []*File
+	Allocation Allocation
+	PartsPath  string // 不需要的文件的数据，按piece分别保存
+
+	mu sync.Mutex
+}
+
+// 单文件保存为dir/name，多文件保存在dir/name目录下
+func New(info torrent.InfoStruct, dir string) *Storage {
+	return NewFs(afero.NewOsFs(), info, dir)
+}
+
+// 在文件系统fs中保存数据，dir是fs中的路径
+func NewFs(fs afero.Fs, info torrent.InfoStruct, dir string) *Storage {
+	name := sanitize(info.Name)
+	s := &Storage{Fs: fs, Info: info, Dir: dir}
+	s.PartsPath = s.StatePath("parts")
+	if info.Length != nil {
+		s.Files = []*File{{Path: filepath.Join(dir, name), Length: *info.Length}}
+		return s
+	}
+	var offset int64
+	for _, f := range info.Files {
+		parts := []string{dir, name}
+		for _, p := range f.Path {
+			parts = append(parts, sanitize(p))
+		}
+		if len(f.Path) == 0 {
+			parts = append(parts, "_")
+		}
+		s.Files = append(s.Files, &File{
+			Path:    filepath.Join(parts...),
+			Offset:  offset,
+			Length:  f.Length,
+			Padding: f.IsPadding(),
+		})
+		offset += f.Length
+	}
+	return s
+}
+
+// 数据目录中保存种子状态的隐藏文件，如.name.parts
+func (s *Storage) StatePath(ext string) string {
+	return filepath.Join(s.Dir, "."+sanitize(s.Info.Name)+"."+ext)
+}
+
+// 把torrent中的一级路径变成安全的文件名，不能包含分隔符，不能是.或..
+func sanitize(name string) string {
+	bad := "/\x00"
+	if runtime.GOOS == "windows" {
+		bad = `/\<>:"|?*` + "\x00"
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if c < 0x20 || strings.IndexByte(bad, c) >= 0 || c == filepath.Separator {
+			b[i] = '_'
+		}
+	}
+	name = string(b)
+	if runtime.GOOS == "windows" {
+		name = strings.TrimRight(name, ". ")
+	}
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// 设置文件是否需要。重新需要时，从parts目录取回它和相邻文件共用的piece中的数据
+func (s *Storage) SetSkip(i int, skip bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.Files[i]
+	if f.Skip == skip {
+		return nil
+	}
+	f.Skip = skip
+	if skip || f.Padding || f.Length == 0 {
+		return nil
+	}
+	if _, err := s.Fs.Stat(f.Path); !os.IsNotExist(err) {
+		return nil // 文件中已有数据，保持不变
+	}
+	// 只有首尾的piece可能在parts目录中
+	pl := s.Info.PieceLength
+	first := f.Offset / pl * pl
+	last := (f.Offset + f.Length - 1) / pl * pl
+	for _, start := range []int64{first, last} {
+		begin, end := start, start+pl
+		if begin < f.Offset {
+			begin = f.Offset
+		}
+		if end > f.Offset+f.Length {
+			end = f.Offset + f.Length
+		}
+		b := make([]byte, end-begin)
+		if s.readParts(b, begin) == nil {
+			if err := s.writeFile(f, b, begin-f.Offset); err != nil {
+				return err
+			}
+		}
+		if first == last {
+			break
+		}
+	}
+	return nil
+}
+
+// 创建文件并按设置分配空间
+func (s *Storage) create(path string, length int64) (afero.File, error) {
+	if err := s.Fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	fp, err := s.Fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	switch s.Allocation {
+	case AllocSparse:
+		err = fp.Truncate(length)
+	case AllocFull:
+		err = fill(fp, length)
+	}
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return fp, nil
+}
+
+// 从文件末尾写0直到length
+func fill(fp afero.File, length int64) error {
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	zero := make([]byte, 1<<20)
+	for off := fi.Size(); off < length; {
+		n := length - off
+		if n > int64(len(zero)) {
+			n = int64(len(zero))
+		}
+		if _, err := fp.WriteAt(zero[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// 打开文件，读取时只读打开，写入时不存在则创建
+func (s *Storage) open(f *File, write bool) (afero.File, error) {
+	if f.f != nil && (f.writable || !write) {
+		return f.f, nil
+	}
+	var (
+		fp  afero.File
+		err error
+	)
+	if write {
+		fp, err = s.Fs.OpenFile(f.Path, os.O_RDWR, 0)
+		if os.IsNotExist(err) {
+			fp, err = s.create(f.Path, f.Length)
+		}
+	} else {
+		fp, err = s.Fs.OpenFile(f.Path, os.O_RDONLY, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if f.f != nil {
+		f.f.Close()
+	}
+	f.f, f.writable, f.size = fp, write, fi.Size()
+	return fp, nil
+}
+
+func (s *Storage) writeFile(f *File, b []byte, off int64) error {
+	fp, err := s.open(f, true)
+	if err != nil {
+		return err
+	}
+	// MemMapFs在文件末尾之后写入会丢掉原来的数据，先扩展到off
+	if off > f.size {
+		if err := fp.Truncate(off); err != nil {
+			return err
+		}
+	}
+	if _, err := fp.WriteAt(b, off); err != nil {
+		return err
+	}
+	if end := off + int64(len(b)); end > f.size {
+		f.size = end
+	}
+	return nil
+}
+
+// 读满b，有的afero实现读到末尾时不返回错误
+func readAt(fp afero.File, b []byte, off int64) error {
+	n, err := fp.ReadAt(b, off)
+	if n == len(b) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parts目录中第i个piece的文件
+func (s *Storage) partPath(i int64) string {
+	return filepath.Join(s.PartsPath, strconv.FormatInt(i, 10))
+}
+
+// 对全部数据中的[off, off+len(b))按piece分段调用fn，off是在piece中的位置
+func (s *Storage) eachPiece(b []byte, off int64, fn func(i int64, b []byte, off int64) error) error {
+	pl := s.Info.PieceLength
+	for len(b) > 0 {
+		i := off / pl
+		n := (i+1)*pl - off
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		if err := fn(i, b[:n], off-i*pl); err != nil {
+			return err
+		}
+		b, off = b[n:], off+n
+	}
+	return nil
+}
+
+// 读取parts目录中的数据，off是在全部数据中的位置
+func (s *Storage) readParts(b []byte, off int64) error {
+	return s.eachPiece(b, off, func(i int64, b []byte, off int64) error {
+		fp, err := s.Fs.Open(s.partPath(i))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		return readAt(fp, b, off)
+	})
+}
+
+// 写入parts目录。每个文件不超过一个piece，不会因为扩展文件占用全部数据大小的空间；
+// 只有首尾的piece会写入，用完就关闭
+func (s *Storage) writeParts(b []byte, off int64) error {
+	return s.eachPiece(b, off, func(i int64, b []byte, off int64) error {
+		f := &File{Path: s.partPath(i)}
+		err := s.writeFile(f, b, off)
+		if f.f != nil {
+			if e := f.f.Close(); err == nil {
+				err = e
+			}
+		}
+		return err
+	})
+}
+
+// 不需要且本地没有的文件，数据在parts目录中
+func (s *Storage) inParts(f *File) bool {
+	if !f.Skip || f.f != nil {
+		return false
+	}
+	_, err := s.Fs.Stat(f.Path)
+	return os.IsNotExist(err)
+}
+
+// 对[off, off+len(b))覆盖的每个文件调用fn
+func (s *Storage) each(b []byte, off int64, fn func(f *File, b []byte, off int64) error) error {
+	for _, f := range s.Files {
+		if len(b) == 0 {
+			break
+		}
+		if off >= f.Offset+f.Length || f.Length == 0 {
+			continue
+		}
+		n := f.Offset + f.Length - off
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		if err := fn(f, b[:n], off-f.Offset); err != nil {
+			return err
+		}
+		b, off = b[n:], off+n
+	}
+	if len(b) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (s *Storage) ReadAt(b []byte, off int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.each(b, off, func(f *File, b []byte, off int64) error {
+		if f.Padding {
+			for i := range b {
+				b[i] = 0
+			}
+			return nil
+		}
+		if s.inParts(f) {
+			return s.readParts(b, f.Offset+off)
+		}
+		fp, err := s.open(f, false)
+		if err != nil {
+			return err
+		}
+		return readAt(fp, b, off)
+	})
+}
+
+func (s *Storage) WriteAt(b []byte, off int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.each(b, off, func(f *File, b []byte, off int64) error {
+		if f.Padding {
+			return nil
+		}
+		if s.inParts(f) {
+			return s.writeParts(b, f.Offset+off)
+		}
+		return s.writeFile(f, b, off)
+	})
+}
+
+// 第i个piece的长度
+func (s *Storage) PieceSize(i int) int {
+	total := s.Info.TotalLength()
+	if rest := total - int64(i)*s.Info.PieceLength; rest < s.Info.PieceLength {
+		return int(rest)
+	}
+	return int(s.Info.PieceLength)
+}
+
+func (s *Storage) ReadBlock(piece, begin int, b []byte) error {
+	return s.ReadAt(b, int64(piece)*s.Info.PieceLength+int64(begin))
+}
+
+func (s *Storage) WriteBlock(piece, begin int, b []byte) error {
+	return s.WriteAt(b, int64(piece)*s.Info.PieceLength+int64(begin))
+}
+
+func (s *Storage) ReadPiece(i int) ([]byte, error) {
+	b := make([]byte, s.PieceSize(i))
+	return b, s.ReadBlock(i, 0, b)
+}
+
+// 校验第i个piece，数据不存在时返回false
+func (s *Storage) Verify(i int) bool {
+	b, err := s.ReadPiece(i)
+	if err != nil {
+		return false
+	}
+	h := sha1.Sum(b)
+	return string(h[:]) == s.Info.PieceHash(i)
+}
+
+// 检查需要的文件都存在且大小正确
+func (s *Storage) CheckSizes() error {
+	for _, f := range s.Files {
+		if f.Padding || f.Skip {
+			continue
+		}
+		fi, err := s.Fs.Stat(f.Path)
+		if err != nil {
+			return err
+		}
+		if fi.Size() != f.Length {
+			return fmt.Errorf("%s: size %d, expected %d", f.Path, fi.Size(), f.Length)
+		}
+	}
+	return nil
+}
+
+// 创建长度为0的文件，它们不属于任何piece，下载时不会被写入
+func (s *Storage) CreateEmpty() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.Files {
+		if f.Length == 0 && !f.Skip && !f.Padding {
+			if _, err := s.open(f, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 第i个文件在文件系统中的状态
+func (s *Storage) Stat(i int) (os.FileInfo, error) {
+	return s.Fs.Stat(s.Files[i].Path)
+}
+
+// 把打开的文件写入磁盘
+func (s *Storage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, f := range s.Files {
+		if f.f != nil && f.writable {
+			if e := f.f.Sync(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, f := range s.Files {
+		if f.f != nil {
+			if e := f.f.Close(); e != nil && err == nil {
+				err = e
+			}
+			f.f = nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openqt/whonet/utils/torrent"
+	"github.com/spf13/afero"
+)
+
+func TestPieces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whonet-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 两个piece，第一个跨越a和b，b为空文件
+	data := []byte("0123456789abcdef")
+	h1, h2 := sha1.Sum(data[:10]), sha1.Sum(data[10:])
+	info := torrent.InfoStruct{
+		Name:        "multi",
+		PieceLength: 10,
+		Files: []torrent.FileStruct{
+			{Length: 6, Path: []string{"a"}},
+			{Length: 0, Path: []string{"b"}},
+			{Length: 10, Path: []string{"sub", "c"}},
+		},
+	}
+	info.Pieces.O = string(h1[:]) + string(h2[:])
+
+	s := New(info, dir)
+	if s.Verify(0) {
+		t.Error("missing data verified")
+	}
+	if err := s.WriteBlock(0, 4, data[4:12]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBlock(0, 0, data[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Verify(0) || s.Verify(1) {
+		t.Error("verify")
+	}
+	if err := s.WriteBlock(1, 0, data[10:]); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Verify(1) || s.PieceSize(1) != 6 {
+		t.Error("last piece")
+	}
+	if err := s.WriteAt([]byte("x"), 16); err == nil {
+		t.Error("write past end")
+	}
+	if err := s.CreateEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	got, _ := ioutil.ReadFile(filepath.Join(dir, "multi", "sub", "c"))
+	if !bytes.Equal(got, data[6:]) {
+		t.Errorf("file c: %q", got)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "multi", "b")); err != nil || fi.Size() != 0 {
+		t.Errorf("empty file: %v", err)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	info := torrent.InfoStruct{
+		Name:        "..",
+		PieceLength: 4,
+		Files: []torrent.FileStruct{
+			{Length: 1, Path: []string{"..", "a/b"}},
+			{Length: 1, Path: []string{".", "c\x00"}},
+		},
+	}
+	s := New(info, "dir")
+	for i, want := range []string{"dir/_/_/a_b", "dir/_/_/c_"} {
+		if got := filepath.ToSlash(s.Files[i].Path); got != want {
+			t.Errorf("file %d: %s, expected %s", i, got, want)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whonet-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// piece 0跨越a、padding和b，a不需要
+	data := []byte("aaaa\x00\x00bbbbbb")
+	h1, h2 := sha1.Sum(data[:8]), sha1.Sum(data[8:])
+	info := torrent.InfoStruct{
+		Name:        "skip",
+		PieceLength: 8,
+		Files: []torrent.FileStruct{
+			{Length: 4, Path: []string{"a"}},
+			{Length: 2, Path: []string{".pad", "2"}, Attr: "p"},
+			{Length: 6, Path: []string{"b"}},
+		},
+	}
+	info.Pieces.O = string(h1[:]) + string(h2[:])
+
+	s := New(info, dir)
+	s.Allocation = AllocSparse
+	if err := s.SetSkip(0, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBlock(0, 0, data[:8]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBlock(1, 0, data[8:]); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Verify(0) || !s.Verify(1) {
+		t.Error("verify")
+	}
+	if err := s.CheckSizes(); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{"a", ".pad"} {
+		if _, err := os.Stat(filepath.Join(dir, "skip", name)); !os.IsNotExist(err) {
+			t.Errorf("%s created", name)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "skip", "b")); err != nil || fi.Size() != 6 {
+		t.Errorf("sparse file: %v", err)
+	}
+
+	// 重新需要时从parts目录取回数据
+	if err := s.SetSkip(0, false); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	got, _ := ioutil.ReadFile(filepath.Join(dir, "skip", "a"))
+	if string(got) != "aaaa" {
+		t.Errorf("file a: %q", got)
+	}
+	if !s.Verify(0) {
+		t.Error("verify after unskip")
+	}
+	s.Close()
+}
+
+func TestAllocation(t *testing.T) {
+	if a, err := ParseAllocation("Full"); err != nil || a != AllocFull || a.String() != "full" {
+		t.Errorf("parse: %v %v", a, err)
+	}
+	if _, err := ParseAllocation("huge"); err == nil {
+		t.Error("unknown allocation")
+	}
+
+	dir, err := ioutil.TempDir("", "whonet-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	length := int64(3 << 20)
+	info := torrent.InfoStruct{Name: "full", PieceLength: 1 << 20, Length: &length}
+	s := New(info, dir)
+	s.Allocation = AllocFull
+	if err := s.WriteAt([]byte("x"), 10); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if fi, err := os.Stat(filepath.Join(dir, "full")); err != nil || fi.Size() != length {
+		t.Errorf("full allocation: %v", err)
+	}
+}
+
+func TestFs(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	h1, h2 := sha1.Sum(data[:10]), sha1.Sum(data[10:])
+	length := int64(len(data))
+	info := torrent.InfoStruct{Name: "mem", PieceLength: 10, Length: &length}
+	info.Pieces.O = string(h1[:]) + string(h2[:])
+
+	// 乱序写入内存
+	mem := afero.NewMemMapFs()
+	s := NewFs(mem, info, "/data")
+	if err := s.WriteBlock(1, 0, data[10:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBlock(0, 0, data[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Verify(0) || !s.Verify(1) {
+		t.Error("verify")
+	}
+	s.Close()
+	if got, _ := afero.ReadFile(mem, "/data/mem"); !bytes.Equal(got, data) {
+		t.Errorf("memory file: %q", got)
+	}
+
+	// 只读：可以读取和校验，不能写入
+	ro := NewFs(afero.NewReadOnlyFs(mem), info, "/data")
+	if !ro.Verify(1) {
+		t.Error("read-only verify")
+	}
+	if err := ro.WriteBlock(0, 0, data[:1]); err == nil {
+		t.Error("read-only write")
+	}
+	ro.Close()
+
+	// 限制在目录下
+	bp := NewFs(afero.NewBasePathFs(mem, "/data"), info, "/")
+	if err := bp.CheckSizes(); err != nil || !bp.Verify(0) {
+		t.Errorf("base path: %v", err)
+	}
+	bp.Close()
+}
+
+func TestSkipTail(t *testing.T) {
+	// 最后一个文件很大且不需要，和a共用第一个piece，数据都在内存中
+	const pl = 16
+	tail := int64(50 << 30)
+	info := torrent.InfoStruct{
+		Name:        "tail",
+		PieceLength: pl,
+		Files: []torrent.FileStruct{
+			{Length: 10, Path: []string{"a"}},
+			{Length: tail, Path: []string{"b"}},
+		},
+	}
+	mem := afero.NewMemMapFs()
+	s := NewFs(mem, info, "/data")
+	if err := s.SetSkip(1, true); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("aaaaaaaaaabbbbbb")
+	if err := s.WriteBlock(0, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	last := int((10 + tail - 1) / pl)
+	if err := s.WriteBlock(last, 0, []byte("zz")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, pl)
+	if err := s.ReadBlock(0, 0, got); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %q: %v", got, err)
+	}
+	s.Close()
+
+	for _, i := range []int{0, last} {
+		fi, err := mem.Stat(s.partPath(int64(i)))
+		if err != nil || fi.Size() > pl {
+			t.Errorf("part of piece %d: %v", i, err)
+		}
+	}
+	if _, err := mem.Stat("/data/tail/b"); !os.IsNotExist(err) {
+		t.Error("skipped file created")
+	}
+}
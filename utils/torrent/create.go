@@ -0,0 +1,150 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openqt/whonet/utils/hasher"
+)
+
+// 根据数据大小选择piece长度，使piece数量在1500左右
+func PieceLengthFor(total int64) int64 {
+	length := int64(16 * 1024)
+	for length < 16*1024*1024 && total/length > 1500 {
+		length *= 2
+	}
+	return length
+}
+
+// 从本地文件或目录生成torrent，pieceLength为0时自动选择
+func Create(path string, pieceLength int64) (*TorrentStruct, error) {
+	return CreateWith(hasher.New(hasher.SHA1), path, pieceLength)
+}
+
+// 用h计算piece的hash，可以设置并行数和进度回调
+func CreateWith(h *hasher.Hasher, path string, pieceLength int64) (*TorrentStruct, error) {
+	path = filepath.Clean(path)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := new(TorrentStruct)
+	t.Info.Name = filepath.Base(path)
+
+	var files []string
+	if stat.IsDir() {
+		err = filepath.Walk(path, func(name string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				files = append(files, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s: no files", path)
+		}
+
+		for _, name := range files {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return nil, err
+			}
+			rel, _ := filepath.Rel(path, name)
+			t.Info.Files = append(t.Info.Files, FileStruct{
+				Length: fi.Size(),
+				Path:   strings.Split(filepath.ToSlash(rel), "/"),
+			})
+		}
+	} else {
+		files = []string{path}
+		length := stat.Size()
+		t.Info.Length = &length
+	}
+
+	if pieceLength <= 0 {
+		pieceLength = PieceLengthFor(t.Info.TotalLength())
+	}
+	t.Info.PieceLength = pieceLength
+
+	pieces, err := hashFiles(h, files, pieceLength, t.Info.TotalLength())
+	if err != nil {
+		return nil, err
+	}
+	t.Info.Pieces = Pieces{S: fmt.Sprintf("%X", pieces), O: pieces}
+
+	t.CreationDate = &Timestamp{time.Now()}
+	return t, nil
+}
+
+// 依次读取所有文件，计算每个piece的SHA1
+func hashFiles(h *hasher.Hasher, files []string, pieceLength, total int64) (string, error) {
+	r := &multiFile{names: files}
+	defer r.Close()
+	n := int((total + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, 0, n*sha1.Size)
+	var err error
+	ordered := *h
+	ordered.Ordered = true
+	ordered.All(context.Background(), hasher.NewReader(r, pieceLength, total), n, func(res hasher.Result) {
+		if res.Err != nil && err == nil {
+			err = res.Err
+		}
+		pieces = append(pieces, res.Sum...)
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(pieces), nil
+}
+
+// 把多个文件按顺序连接起来读取
+type multiFile struct {
+	names []string
+	f     *os.File
+}
+
+func (m *multiFile) Read(b []byte) (int, error) {
+	for {
+		if m.f == nil {
+			if len(m.names) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(m.names[0])
+			if err != nil {
+				return 0, err
+			}
+			m.f, m.names = f, m.names[1:]
+		}
+		n, err := m.f.Read(b)
+		if err == io.EOF {
+			m.f.Close()
+			m.f = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (m *multiFile) Close() error {
+	if m.f != nil {
+		return m.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/bencode"
+)
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whonet")
+	utils.CheckError(err)
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "data")
+	utils.CheckError(os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	utils.CheckError(ioutil.WriteFile(filepath.Join(root, "a.txt"), make([]byte, 40000), 0644))
+	utils.CheckError(ioutil.WriteFile(filepath.Join(root, "sub", "b.txt"), make([]byte, 10000), 0644))
+
+	tr, err := Create(root, 16384)
+	utils.CheckError(err)
+	if tr.Info.NumPieces() != 4 || tr.Info.TotalLength() != 50000 {
+		t.Errorf("pieces %d, length %d", tr.Info.NumPieces(), tr.Info.TotalLength())
+	}
+	if len(tr.Info.Files) != 2 || tr.Info.Files[1].Path[0] != "sub" {
+		t.Errorf("files %v", tr.Info.Files)
+	}
+
+	tr.Announce = "http://127.0.0.1:6969/announce"
+	s := bencode.NewEncoder().Encode(tr.ToMap())
+	loaded := NewTorrent([]byte(s))
+	if loaded.InfoHash() != tr.InfoHash() || loaded.Info.PieceHash(3) != tr.Info.PieceHash(3) {
+		t.Error("info hash changed after encode then decode")
+	}
+}
@@ -7,16 +7,19 @@ package torrent
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"github.com/openqt/whonet/utils"
 	"github.com/openqt/whonet/utils/bencode"
+	"strings"
 	"time"
 )
 
 type FileStruct struct {
 	Length int64    `json:"length"`
 	Path   []string `json:"path"`
+	Attr   string   `json:"attr,omitempty"` // BEP 47，p表示padding文件
 	//Md5sum string `json:",omitempty"`
 }
 
@@ -24,9 +27,20 @@ func (j FileStruct) ToMap() map[string]interface{} {
 	result := make(map[string]interface{})
 	result["length"] = j.Length
 	result["path"] = j.Path
+	if j.Attr != "" {
+		result["attr"] = j.Attr
+	}
 	return result
 }
 
+// padding文件只用于对齐，内容全是0，不需要保存
+func (j FileStruct) IsPadding() bool {
+	if strings.ContainsRune(j.Attr, 'p') {
+		return true
+	}
+	return len(j.Path) > 0 && strings.HasPrefix(j.Path[len(j.Path)-1], "_____padding_file_")
+}
+
 type InfoStruct struct {
 	Pieces      Pieces `json:"pieces"`
 	PieceLength int64  `json:"piece length"`
@@ -76,12 +90,31 @@ type TorrentStruct struct {
 	CreatedBy    *string    `json:"created by,omitempty"`
 	Comment      *string    `json:"comment,omitempty"`
 	Encoding     *string    `json:"encoding,omitempty"`
+
+	// 原始的info编码和其他未知字段，重新编码时保持不变
+	RawInfo string                 `json:"-"`
+	Extra   map[string]interface{} `json:"-"`
+}
+
+// 已知的顶层字段
+var knownKeys = map[string]bool{
+	"info": true, "announce": true, "announce-list": true, "creation date": true,
+	"created by": true, "comment": true, "encoding": true,
 }
 
 func (j TorrentStruct) ToMap() map[string]interface{} {
 	result := make(map[string]interface{})
-	result["info"] = j.Info.ToMap()
-	result["announce"] = j.Announce
+	for k, v := range j.Extra {
+		result[k] = v
+	}
+	if j.RawInfo != "" {
+		result["info"] = bencode.Raw(j.RawInfo)
+	} else {
+		result["info"] = j.Info.ToMap()
+	}
+	if j.Announce != "" {
+		result["announce"] = j.Announce
+	}
 	if j.AnnounceList != nil {
 		result["announce-list"] = j.AnnounceList
 	}
@@ -101,6 +134,58 @@ func (j TorrentStruct) ToMap() map[string]interface{} {
 	return result
 }
 
+// info字段的编码，ut_metadata交换的就是这部分内容
+func (j TorrentStruct) InfoBytes() string {
+	if j.RawInfo != "" {
+		return j.RawInfo
+	}
+	return bencode.NewEncoder().Encode(j.Info.ToMap())
+}
+
+// 计算info字段的SHA1，即info_hash（20字节二进制）
+func (j TorrentStruct) InfoHash() string {
+	h := sha1.Sum([]byte(j.InfoBytes()))
+	return string(h[:])
+}
+
+// 全部数据的长度
+func (j InfoStruct) TotalLength() int64 {
+	if j.Length != nil {
+		return *j.Length
+	}
+	var n int64
+	for _, f := range j.Files {
+		n += f.Length
+	}
+	return n
+}
+
+// 私有种子（BEP 27），只能通过tracker获取peer，不使用DHT和PEX
+func (j InfoStruct) IsPrivate() bool {
+	return j.Private != nil && *j.Private == 1
+}
+
+// piece的数量
+func (j InfoStruct) NumPieces() int {
+	return len(j.Pieces.O) / 20
+}
+
+// 第i个piece的SHA1
+func (j InfoStruct) PieceHash(i int) string {
+	return j.Pieces.O[i*20 : i*20+20]
+}
+
+// 所有tracker地址，按BEP 12分层；没有announce-list时使用announce
+func (j TorrentStruct) Trackers() [][]string {
+	if len(j.AnnounceList) > 0 {
+		return j.AnnounceList
+	}
+	if j.Announce != "" {
+		return [][]string{{j.Announce}}
+	}
+	return nil
+}
+
 type Pieces struct {
 	S string
 	O string `json:"-"` // 二进制原始内容，避免转义
@@ -111,7 +196,7 @@ func (j Pieces) MarshalJSON() ([]byte, error) {
 	var s string
 	const LEN = 40
 	s = fmt.Sprintf("[%d]", len(j.S)/LEN)
-	for i := 0; i < 3; i++ {
+	for i := 0; i < 3 && (i+1)*LEN <= len(j.S); i++ {
 		n := i * LEN
 		s += fmt.Sprintf(" %s", j.S[n:n+LEN])
 	}
@@ -156,6 +241,51 @@ func NewTorrent(data []byte) *TorrentStruct {
 
 	json.Unmarshal(buf.Bytes(), torrent)
 	torrent.Info.Pieces.O = dec.Pieces
+	torrent.RawInfo = dec.Info
+
+	if m, ok := val.(map[string]interface{}); ok {
+		// JSON会把无效的UTF-8换成U+FFFD，已知的字符串字段也使用解码出的原始值
+		if s, ok := m["announce"].(string); ok {
+			torrent.Announce = s
+		}
+		torrent.CreatedBy = rawString(m, "created by")
+		torrent.Comment = rawString(m, "comment")
+		torrent.Encoding = rawString(m, "encoding")
+		if list, ok := m["announce-list"].([]interface{}); ok {
+			torrent.AnnounceList = rawTiers(list)
+		}
+		for k, v := range m {
+			if !knownKeys[k] {
+				if torrent.Extra == nil {
+					torrent.Extra = make(map[string]interface{})
+				}
+				torrent.Extra[k] = v
+			}
+		}
+	}
 
 	return torrent
 }
+
+func rawString(m map[string]interface{}, key string) *string {
+	if s, ok := m[key].(string); ok {
+		return &s
+	}
+	return nil
+}
+
+// 解码出的announce-list，忽略不是字符串的地址
+func rawTiers(list []interface{}) [][]string {
+	tiers := make([][]string, 0, len(list))
+	for _, v := range list {
+		urls, _ := v.([]interface{})
+		tier := make([]string, 0, len(urls))
+		for _, u := range urls {
+			if s, ok := u.(string); ok {
+				tier = append(tier, s)
+			}
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers
+}
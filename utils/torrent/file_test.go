@@ -26,3 +26,13 @@ func TestFile(t *testing.T) {
 		}
 	}
 }
+
+func TestFileRaw(t *testing.T) {
+	// 无效的UTF-8和没有announce的种子重新编码后不变
+	info := "d6:lengthi1e4:name1:a12:piece lengthi1e6:pieces20:01234567890123456789e"
+	data := "d13:announce-listll2:\xff\xfeee7:comment2:\xff\xfe10:created by1:\xe94:info" + info + "e"
+	torrent := NewTorrent([]byte(data))
+	if s := bencode.NewEncoder().Encode(torrent.ToMap()); s != data {
+		t.Errorf("encoded %q", s)
+	}
+}
@@ -1,5 +1,13 @@
 package torrent
 
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Tracker请求参数
+// 参考 http://www.bittorrent.org/beps/bep_0003.html#trackers
 type GetStruct struct {
 	InfoHash   string `json:"info_hash"`
 	PeerId     string `json:"peer_id"`
@@ -11,11 +19,87 @@ type GetStruct struct {
 	NoPeerId   int    `json:"no_peer_id,omitempty"`
 	Event      string `json:"event,omitempty"`
 	IP         string `json:"ip,omitempty"`
-	NumWant    int    `json:"num_want,omitempty"`
+	NumWant    int    `json:"numwant,omitempty"`
 	Key        string `json:"key,omitempty"`
 	TrackerId  string `json:"trackerid,omitempty"`
 }
 
-func init() {
-	//
+// 生成GET请求的查询字符串，info_hash和peer_id为二进制内容，逐字节转义
+func (j GetStruct) Query() string {
+	v := url.Values{}
+	v.Set("info_hash", j.InfoHash)
+	v.Set("peer_id", j.PeerId)
+	v.Set("port", strconv.Itoa(j.Port))
+	// uploaded/downloaded/left 即使为0也必须发送
+	v.Set("uploaded", strconv.Itoa(j.Uploaded))
+	v.Set("downloaded", strconv.Itoa(j.Downloaded))
+	v.Set("left", strconv.Itoa(j.Left))
+	if j.Compact != 0 {
+		v.Set("compact", strconv.Itoa(j.Compact))
+	}
+	if j.NoPeerId != 0 {
+		v.Set("no_peer_id", strconv.Itoa(j.NoPeerId))
+	}
+	if j.Event != "" {
+		v.Set("event", j.Event)
+	}
+	if j.IP != "" {
+		v.Set("ip", j.IP)
+	}
+	v.Set("numwant", strconv.Itoa(j.NumWant))
+	if j.Key != "" {
+		v.Set("key", j.Key)
+	}
+	if j.TrackerId != "" {
+		v.Set("trackerid", j.TrackerId)
+	}
+	return v.Encode()
+}
+
+// 从查询参数解析请求，tracker服务端使用；numwant未指定时为-1
+func ParseGetStruct(v url.Values) (*GetStruct, error) {
+	j := &GetStruct{
+		InfoHash:  v.Get("info_hash"),
+		PeerId:    v.Get("peer_id"),
+		Event:     v.Get("event"),
+		IP:        v.Get("ip"),
+		Key:       v.Get("key"),
+		TrackerId: v.Get("trackerid"),
+		NumWant:   -1,
+	}
+	if len(j.InfoHash) != 20 {
+		return nil, fmt.Errorf("invalid info_hash")
+	}
+	if len(j.PeerId) != 20 {
+		return nil, fmt.Errorf("invalid peer_id")
+	}
+
+	ints := []struct {
+		name string
+		val  *int
+	}{
+		{"port", &j.Port},
+		{"uploaded", &j.Uploaded},
+		{"downloaded", &j.Downloaded},
+		{"left", &j.Left},
+		{"compact", &j.Compact},
+		{"no_peer_id", &j.NoPeerId},
+		{"numwant", &j.NumWant},
+	}
+	for _, i := range ints {
+		s := v.Get(i.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", i.name, s)
+		}
+		*i.val = n
+	}
+	if j.Port <= 0 || j.Port > 65535 {
+		return nil, fmt.Errorf("invalid port")
+	}
+
+	return j, nil
 }
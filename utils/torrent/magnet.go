@@ -0,0 +1,118 @@
+package torrent
+
+//
+// Magnet链接
+// 参考 http://www.bittorrent.org/beps/bep_0009.html#magnet-uri-format
+//
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/openqt/whonet/utils/bencode"
+)
+
+type Magnet struct {
+	InfoHash string   // 20字节二进制
+	Name     string   // dn
+	Trackers []string // tr
+	Peers    []string // x.pe，host:port
+}
+
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("magnet: not a magnet link: %s", uri)
+	}
+
+	q := u.Query()
+	m := &Magnet{Name: q.Get("dn"), Trackers: q["tr"], Peers: q["x.pe"]}
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		hash := xt[len("urn:btih:"):]
+		var b []byte
+		switch len(hash) {
+		case 40:
+			b, err = hex.DecodeString(hash)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("magnet: invalid info hash %s", hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.InfoHash = string(b)
+		break
+	}
+	if m.InfoHash == "" {
+		return nil, errors.New("magnet: missing urn:btih")
+	}
+	return m, nil
+}
+
+func (m *Magnet) String() string {
+	v := url.Values{}
+	if m.Name != "" {
+		v.Set("dn", m.Name)
+	}
+	for _, tr := range m.Trackers {
+		v.Add("tr", tr)
+	}
+	for _, pe := range m.Peers {
+		v.Add("x.pe", pe)
+	}
+	s := "magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(m.InfoHash))
+	if len(v) > 0 {
+		s += "&" + v.Encode()
+	}
+	return s
+}
+
+// 每个tracker单独一层，BEP 9没有定义层次
+func (m *Magnet) Tiers() [][]string {
+	var tiers [][]string
+	for _, tr := range m.Trackers {
+		tiers = append(tiers, []string{tr})
+	}
+	return tiers
+}
+
+// 用ut_metadata下载的info字典生成完整的种子，info保持原始编码
+func FromMetadata(info []byte, trackers []string) (*TorrentStruct, error) {
+	val, err := bencode.NewDecoder().TryDecode(info)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("torrent: info is not a dict")
+	}
+	for _, key := range []string{"name", "piece length", "pieces"} {
+		if _, ok := d[key]; !ok {
+			return nil, fmt.Errorf("torrent: info without %s", key)
+		}
+	}
+
+	t := map[string]interface{}{"info": bencode.Raw(info)}
+	if len(trackers) > 0 {
+		t["announce"] = trackers[0]
+	}
+	if len(trackers) > 1 {
+		var list []interface{}
+		for _, tr := range trackers {
+			list = append(list, []interface{}{tr})
+		}
+		t["announce-list"] = list
+	}
+	return NewTorrent([]byte(bencode.NewEncoder().Encode(t))), nil
+}
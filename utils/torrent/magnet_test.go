@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"github.com/openqt/whonet/utils/bencode"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	m, err := ParseMagnet("magnet:?xt=urn:btih:" + hash + "&dn=test&tr=http%3A%2F%2Fa%2Fannounce&tr=udp%3A%2F%2Fb%3A80&x.pe=1.2.3.4:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString([]byte(m.InfoHash)) != hash || m.Name != "test" ||
+		len(m.Trackers) != 2 || m.Trackers[1] != "udp://b:80" || m.Peers[0] != "1.2.3.4:6881" {
+		t.Errorf("magnet %+v", m)
+	}
+	if n, err := ParseMagnet(m.String()); err != nil || n.InfoHash != m.InfoHash || len(n.Trackers) != 2 {
+		t.Errorf("round trip %s: %v", m, err)
+	}
+
+	// base32编码
+	b32, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil || b32.InfoHash != m.InfoHash {
+		t.Errorf("base32 %v", err)
+	}
+
+	for _, bad := range []string{"http://x", "magnet:?dn=x", "magnet:?xt=urn:btih:1234"} {
+		if _, err := ParseMagnet(bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestFromMetadata(t *testing.T) {
+	info := bencode.NewEncoder().Encode(map[string]interface{}{
+		"name": "test", "piece length": 16384, "length": 100, "pieces": "ABCDEFGHIJKLMNOPQRST", "x-extra": "kept",
+	})
+	tor, err := FromMetadata([]byte(info), []string{"http://a/announce", "http://b/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新编码再解析，info_hash保持不变
+	again := NewTorrent([]byte(bencode.NewEncoder().Encode(tor.ToMap())))
+	hash := sha1.Sum([]byte(info))
+	if again.InfoHash() != string(hash[:]) || again.Info.Name != "test" ||
+		again.Info.NumPieces() != 1 || len(again.Trackers()) != 2 {
+		t.Errorf("torrent %+v", again)
+	}
+
+	if _, err := FromMetadata([]byte("d4:name4:teste"), nil); err == nil {
+		t.Error("incomplete info accepted")
+	}
+}
@@ -0,0 +1,417 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+const (
+	DefaultInterval = 30 * time.Minute
+	DefaultNumWant  = 50
+	MaxNumWant      = 200
+
+	// 失败重试的退避时间
+	MinBackoff = 15 * time.Second
+	MaxBackoff = 30 * time.Minute
+)
+
+// 单个torrent的announce循环，负责started/completed/stopped事件及定期announce
+type Announcer struct {
+	Tiers    [][]string // BEP 12 分层的tracker地址
+	InfoHash string
+	PeerId   string
+	Port     int
+	Key      string
+	Client   Requester
+
+	// 还需要多少个peer，用于调整numwant，为nil时使用DefaultNumWant
+	NeedPeers func() int
+	// 收到peer列表的回调
+	OnPeers func([]Peer)
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	uploaded   int64
+	downloaded int64
+	left       int64
+
+	mu          sync.Mutex
+	trackerId   string
+	interval    time.Duration
+	minInterval time.Duration
+	last        time.Time // 上次成功announce的时间
+	lastResp    *Response
+	lastErr     error
+	started     bool // started事件是否已送达
+	early       bool // Start之前调用了Completed，启动后补发
+
+	completed sync.Once
+	events    chan string
+	quit      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+// 根据torrent创建announce循环，left为剩余字节数
+func NewAnnouncer(t *torrent.TorrentStruct, peerId string, port int, left int64) *Announcer {
+	a := &Announcer{
+		Tiers:    shuffleTiers(t.Trackers()),
+		InfoHash: t.InfoHash(),
+		PeerId:   peerId,
+		Port:     port,
+		Key:      fmt.Sprintf("%08x", rand.Uint32()),
+		Client:   DefaultClient,
+		left:     left,
+	}
+	return a
+}
+
+// BEP 12 要求每一层内的tracker随机排列
+func shuffleTiers(tiers [][]string) [][]string {
+	var result [][]string
+	for _, tier := range tiers {
+		var t []string
+		for _, u := range tier {
+			if Supported(u) {
+				t = append(t, u)
+			}
+		}
+		rand.Shuffle(len(t), func(i, j int) { t[i], t[j] = t[j], t[i] })
+		if len(t) > 0 {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// 累计上传字节数
+func (a *Announcer) AddUploaded(n int64) {
+	atomic.AddInt64(&a.uploaded, n)
+}
+
+// 累计下载字节数
+func (a *Announcer) AddDownloaded(n int64) {
+	atomic.AddInt64(&a.downloaded, n)
+}
+
+// 设置剩余字节数
+func (a *Announcer) SetLeft(n int64) {
+	atomic.StoreInt64(&a.left, n)
+}
+
+// 当前的计数值
+func (a *Announcer) Stats() (uploaded, downloaded, left int64) {
+	return atomic.LoadInt64(&a.uploaded), atomic.LoadInt64(&a.downloaded), atomic.LoadInt64(&a.left)
+}
+
+// 最近一次的应答和错误
+func (a *Announcer) Last() (*Response, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastResp, a.lastErr
+}
+
+// 启动announce循环，首先发送started
+func (a *Announcer) Start() {
+	a.startOnce.Do(func() {
+		a.mu.Lock()
+		a.events = make(chan string, 4)
+		a.quit = make(chan struct{})
+		a.done = make(chan struct{})
+		completed := a.early
+		a.mu.Unlock()
+		go a.run(completed)
+	})
+}
+
+// 最后一个piece校验完成时调用，completed只发送一次
+func (a *Announcer) Completed() {
+	a.SetLeft(0)
+	a.completed.Do(func() {
+		a.mu.Lock()
+		a.early = a.events == nil
+		a.mu.Unlock()
+		a.send(EventCompleted)
+	})
+}
+
+// 需要更多peer时调用，在min interval允许的情况下立即announce
+func (a *Announcer) Reannounce() {
+	a.send(EventNone)
+}
+
+func (a *Announcer) send(event string) {
+	a.mu.Lock()
+	events, done := a.events, a.done
+	a.mu.Unlock()
+	if events == nil {
+		return
+	}
+	select {
+	case events <- event:
+	case <-done:
+	}
+}
+
+// 停止announce循环并发送stopped，最多等待timeout
+func (a *Announcer) Stop(timeout time.Duration) error {
+	var err error
+	a.stopOnce.Do(func() {
+		a.mu.Lock()
+		quit, done := a.quit, a.done
+		a.mu.Unlock()
+		if quit == nil {
+			return
+		}
+		close(quit)
+		<-done
+
+		a.mu.Lock()
+		started := a.started
+		a.mu.Unlock()
+		if !started {
+			return // tracker从未知道我们，无需stopped
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, err = a.announce(ctx, EventStopped)
+	})
+	return err
+}
+
+// wantCompleted为真时在started之后发送completed
+func (a *Announcer) run(wantCompleted bool) {
+	defer close(a.done)
+
+	pending := EventStarted
+	failures := 0
+	var retryAt time.Time // 失败后退避结束的时间，之前不announce
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-a.quit:
+			return
+		case ev := <-a.events:
+			if ev == EventCompleted {
+				// started未送达时，completed随后补发
+				if pending == EventStarted {
+					wantCompleted = true
+					continue
+				}
+				pending = ev
+			} else if wait := a.untilMinInterval(); wait > 0 {
+				if time.Until(retryAt) <= 0 {
+					resetTimer(timer, wait)
+				}
+				continue
+			}
+			// 退避期间等待定时器
+			if time.Until(retryAt) > 0 {
+				continue
+			}
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-a.quit:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		resp, err := a.announce(ctx, pending)
+		cancel()
+
+		if err != nil {
+			failures++
+			wait := a.backoff(failures)
+			var fe *FailureError
+			if errors.As(err, &fe) && fe.RetryIn != 0 {
+				if fe.RetryIn < 0 {
+					LOG.Warnf("Tracker refused permanently: %s", fe.Reason)
+					a.drain()
+					return
+				}
+				wait = fe.RetryIn
+			}
+			LOG.Debugf("Announce failed (%d): %v, retry in %v", failures, err, wait)
+			retryAt = time.Now().Add(wait)
+			resetTimer(timer, wait)
+			continue
+		}
+
+		failures = 0
+		retryAt = time.Time{}
+		if pending == EventStarted && atomic.LoadInt64(&a.left) == 0 {
+			// 作为做种开始的，不需要completed
+			a.completed.Do(func() {})
+		}
+		pending = EventNone
+		next := a.nextInterval()
+		if wantCompleted {
+			pending, wantCompleted, next = EventCompleted, false, 0
+		}
+		if a.OnPeers != nil && len(resp.Peers) > 0 {
+			a.OnPeers(resp.Peers)
+		}
+		resetTimer(timer, next)
+	}
+}
+
+// 不再announce，丢弃事件直到Stop，避免send阻塞
+func (a *Announcer) drain() {
+	for {
+		select {
+		case <-a.quit:
+			return
+		case <-a.events:
+		}
+	}
+}
+
+// 距离min interval结束还需等待的时间
+func (a *Announcer) untilMinInterval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last.IsZero() {
+		return 0
+	}
+	return time.Until(a.last.Add(a.minInterval))
+}
+
+func (a *Announcer) nextInterval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d := a.interval
+	if d <= 0 {
+		d = DefaultInterval
+	}
+	if d < a.minInterval {
+		d = a.minInterval
+	}
+	return d
+}
+
+// 指数退避
+func (a *Announcer) backoff(failures int) time.Duration {
+	min, max := a.MinBackoff, a.MaxBackoff
+	if min <= 0 {
+		min = MinBackoff
+	}
+	if max <= 0 {
+		max = MaxBackoff
+	}
+	d := min
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (a *Announcer) numWant(event string) int {
+	if event == EventStopped {
+		return 0
+	}
+	if a.NeedPeers == nil {
+		return DefaultNumWant
+	}
+	n := a.NeedPeers()
+	if n < 0 {
+		n = 0
+	}
+	if n > MaxNumWant {
+		n = MaxNumWant
+	}
+	return n
+}
+
+// 按层依次尝试tracker，成功的tracker移到本层最前面
+func (a *Announcer) announce(ctx context.Context, event string) (*Response, error) {
+	up, down, left := a.Stats()
+	numWant := a.numWant(event)
+	a.mu.Lock()
+	req := &torrent.GetStruct{
+		InfoHash:   a.InfoHash,
+		PeerId:     a.PeerId,
+		Port:       a.Port,
+		Uploaded:   int(up),
+		Downloaded: int(down),
+		Left:       int(left),
+		Compact:    1,
+		Event:      event,
+		NumWant:    numWant,
+		Key:        a.Key,
+		TrackerId:  a.trackerId,
+	}
+	a.mu.Unlock()
+
+	err := errors.New("no tracker available")
+	for _, tier := range a.Tiers {
+		for i, u := range tier {
+			var resp *Response
+			resp, err = a.Client.Announce(ctx, u, req)
+			if err == nil {
+				copy(tier[1:i+1], tier[0:i])
+				tier[0] = u
+				a.update(event, resp, nil)
+				return resp, nil
+			}
+			LOG.Debugf("Announce %s: %v", u, err)
+			if ctx.Err() != nil {
+				a.update(event, nil, err)
+				return nil, err
+			}
+		}
+	}
+	a.update(event, nil, err)
+	return nil, err
+}
+
+func (a *Announcer) update(event string, resp *Response, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastResp, a.lastErr = resp, err
+	if err != nil {
+		return
+	}
+	if resp.WarningMessage != "" {
+		LOG.Warnf("Tracker warning: %s", resp.WarningMessage)
+	}
+	if resp.TrackerId != "" {
+		a.trackerId = resp.TrackerId
+	}
+	if resp.Interval > 0 {
+		a.interval = resp.Interval
+	}
+	a.minInterval = resp.MinInterval
+	a.last = time.Now()
+	if event == EventStarted {
+		a.started = true
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
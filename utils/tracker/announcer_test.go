@@ -0,0 +1,209 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+type fakeTracker struct {
+	mu       sync.Mutex
+	requests []torrent.GetStruct
+	fail     int  // 前几次请求返回错误
+	refuse   bool // 返回retry in: never
+	resp     *Response
+}
+
+func (f *fakeTracker) Announce(ctx context.Context, tracker string, req *torrent.GetStruct) (*Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, *req)
+	if f.fail > 0 {
+		f.fail--
+		return nil, errors.New("unreachable")
+	}
+	if f.refuse {
+		return nil, &FailureError{Reason: "refused", RetryIn: -1}
+	}
+	return f.resp, nil
+}
+
+func (f *fakeTracker) events() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var evs []string
+	for _, r := range f.requests {
+		evs = append(evs, r.Event)
+	}
+	return evs
+}
+
+func newTestAnnouncer(f *fakeTracker, left int64) *Announcer {
+	return &Announcer{
+		Tiers:      [][]string{{"http://tracker.test/announce"}},
+		InfoHash:   "01234567890123456789",
+		PeerId:     "-WN0100-000000000000",
+		Port:       6881,
+		Client:     f,
+		MinBackoff: 10 * time.Millisecond,
+		left:       left,
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+func TestAnnouncerLifecycle(t *testing.T) {
+	f := &fakeTracker{resp: &Response{Interval: time.Hour}}
+	a := newTestAnnouncer(f, 100)
+	a.NeedPeers = func() int { return 500 }
+
+	a.Start()
+	waitFor(t, func() bool { return len(f.events()) == 1 })
+
+	a.AddDownloaded(100)
+	a.Completed()
+	a.Completed()
+	waitFor(t, func() bool { return len(f.events()) == 2 })
+
+	if err := a.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	evs := f.events()
+	want := []string{EventStarted, EventCompleted, EventStopped}
+	if len(evs) != len(want) {
+		t.Fatalf("events %v != %v", evs, want)
+	}
+	for i := range want {
+		if evs[i] != want[i] {
+			t.Errorf("events %v != %v", evs, want)
+		}
+	}
+	if f.requests[0].NumWant != MaxNumWant {
+		t.Errorf("numwant %d != %d", f.requests[0].NumWant, MaxNumWant)
+	}
+	if f.requests[1].Downloaded != 100 || f.requests[1].Left != 0 {
+		t.Errorf("counters not reported: %+v", f.requests[1])
+	}
+	if f.requests[2].NumWant != 0 {
+		t.Errorf("stopped numwant %d", f.requests[2].NumWant)
+	}
+}
+
+func TestAnnouncerBackoff(t *testing.T) {
+	f := &fakeTracker{fail: 3, resp: &Response{Interval: time.Hour}}
+	a := newTestAnnouncer(f, 0)
+
+	a.Start()
+	waitFor(t, func() bool { return len(f.events()) == 4 })
+	a.Completed() // 做种开始，不应发送completed
+	a.Stop(time.Second)
+
+	for i, ev := range f.events()[:4] {
+		if ev != EventStarted {
+			t.Errorf("request %d event %q, want started", i, ev)
+		}
+	}
+	if evs := f.events(); evs[len(evs)-1] != EventStopped || len(evs) != 5 {
+		t.Errorf("events %v", evs)
+	}
+	if d := a.backoff(4); d != 80*time.Millisecond {
+		t.Errorf("backoff %v", d)
+	}
+}
+
+func TestAnnouncerEarlyCompleted(t *testing.T) {
+	f := &fakeTracker{resp: &Response{Interval: time.Hour}}
+	a := newTestAnnouncer(f, 100)
+	a.Completed() // 启动前完成
+	a.Start()
+	waitFor(t, func() bool { return len(f.events()) == 2 })
+	a.Stop(time.Second)
+	if evs := f.events(); evs[0] != EventStarted || evs[1] != EventCompleted {
+		t.Errorf("events %v", evs)
+	}
+}
+
+func TestAnnouncerReannounceBackoff(t *testing.T) {
+	f := &fakeTracker{fail: 1, resp: &Response{Interval: time.Hour}}
+	a := newTestAnnouncer(f, 100)
+	a.MinBackoff = time.Hour
+	a.Start()
+	waitFor(t, func() bool { return len(f.events()) == 1 })
+	a.Reannounce()
+	a.Completed()
+	time.Sleep(50 * time.Millisecond)
+	if evs := f.events(); len(evs) != 1 {
+		t.Errorf("announced during backoff: %v", evs)
+	}
+	a.Stop(time.Second)
+}
+
+func TestAnnouncerRefused(t *testing.T) {
+	f := &fakeTracker{refuse: true}
+	a := newTestAnnouncer(f, 100)
+	a.Start()
+	waitFor(t, func() bool { return len(f.events()) == 1 })
+
+	// 不再announce，事件被丢弃而不是阻塞
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			a.Reannounce()
+		}
+		a.Completed()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("send blocked")
+	}
+	a.Stop(time.Second)
+	if evs := f.events(); len(evs) != 1 {
+		t.Errorf("events %v", evs)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	data := "d8:intervali1800e12:min intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe16:peers618:" +
+		"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e"
+	resp, err := ParseResponse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 30*time.Minute || resp.MinInterval != time.Minute {
+		t.Errorf("interval %v %v", resp.Interval, resp.MinInterval)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "127.0.0.1:6881" || resp.Peers[1].String() != "[::1]:6882" {
+		t.Errorf("peers %v", resp.Peers)
+	}
+
+	_, err = ParseResponse([]byte("d14:failure reason6:banned8:retry in5:nevere"))
+	var fe *FailureError
+	if !errors.As(err, &fe) || fe.RetryIn >= 0 || fe.Reason != "banned" {
+		t.Errorf("failure %v", err)
+	}
+}
+
+func TestNoUDP(t *testing.T) {
+	c := &Client{NoUDP: true}
+	if _, err := c.Announce(context.Background(), "udp://127.0.0.1:1/announce", &torrent.GetStruct{}); err != ErrUDPDisabled {
+		t.Errorf("announce: %v", err)
+	}
+	if _, err := c.Scrape(context.Background(), "udp://127.0.0.1:1/announce", nil); err != ErrUDPDisabled {
+		t.Errorf("scrape: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+const (
+	ProbeAuto     = "auto"     // 优先scrape，不支持时announce
+	ProbeScrape   = "scrape"   // 只scrape
+	ProbeAnnounce = "announce" // 只announce
+)
+
+// 单个tracker的检测结果
+type Health struct {
+	URL       string
+	Tier      int
+	Supported bool // 协议是否支持，不支持的tracker不做检测
+	Method    string
+	Latency   time.Duration
+	Err       error
+
+	Seeders    int
+	Leechers   int
+	Downloaded int
+	Peers      int // announce返回的peer数
+}
+
+// 是否可用
+func (h *Health) Alive() bool {
+	return h.Supported && h.Err == nil
+}
+
+// 检测torrent的所有tracker，最多concurrency个同时进行
+func (c *Client) ProbeAll(ctx context.Context, t *torrent.TorrentStruct, peerId string, mode string, concurrency int) []*Health {
+	var result []*Health
+	for i, tier := range t.Trackers() {
+		for _, u := range tier {
+			result = append(result, &Health{URL: u, Tier: i, Supported: Supported(u)})
+		}
+	}
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+
+	hash := t.InfoHash()
+	left := t.Info.TotalLength()
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, h := range result {
+		if !h.Supported {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(h *Health) {
+			defer wg.Done()
+			c.Probe(ctx, h, hash, peerId, left, mode)
+			<-sem
+		}(h)
+	}
+	wg.Wait()
+	return result
+}
+
+// 检测单个tracker，结果写入h
+func (c *Client) Probe(ctx context.Context, h *Health, infoHash, peerId string, left int64, mode string) {
+	start := time.Now()
+	defer func() { h.Latency = time.Since(start) }()
+
+	if mode != ProbeAnnounce {
+		h.Method = ProbeScrape
+		stats, err := c.Scrape(ctx, h.URL, []string{infoHash})
+		if err == nil {
+			st := stats[infoHash]
+			h.Seeders, h.Leechers, h.Downloaded = st.Complete, st.Incomplete, st.Downloaded
+			h.Err = nil
+			return
+		}
+		h.Err = err
+		if mode == ProbeScrape {
+			return
+		}
+		start = time.Now()
+	}
+
+	// 以stopped事件announce，tracker不会把我们加入swarm
+	h.Method = ProbeAnnounce
+	resp, err := c.Announce(ctx, h.URL, &torrent.GetStruct{
+		InfoHash: infoHash,
+		PeerId:   peerId,
+		Port:     6881,
+		Left:     int(left),
+		Compact:  1,
+		Event:    EventStopped,
+		NumWant:  DefaultNumWant,
+	})
+	h.Err = err
+	if err == nil {
+		h.Seeders, h.Leechers, h.Peers = resp.Complete, resp.Incomplete, len(resp.Peers)
+	}
+}
+
+// 去掉不可用的tracker，保留不支持检测的tracker；返回去掉的数量
+func Prune(t *torrent.TorrentStruct, health []*Health) int {
+	dead := make(map[string]bool)
+	for _, h := range health {
+		if h.Supported && h.Err != nil {
+			dead[h.URL] = true
+		}
+	}
+
+	removed := 0
+	listed := make(map[string]bool)
+	var tiers [][]string
+	for _, tier := range t.AnnounceList {
+		var alive []string
+		for _, u := range tier {
+			listed[u] = true
+			if dead[u] {
+				removed++
+			} else {
+				alive = append(alive, u)
+			}
+		}
+		if len(alive) > 0 {
+			tiers = append(tiers, alive)
+		}
+	}
+	if t.AnnounceList != nil {
+		t.AnnounceList = tiers
+	}
+
+	if dead[t.Announce] {
+		if !listed[t.Announce] {
+			removed++
+		}
+		t.Announce = ""
+		if len(tiers) > 0 {
+			t.Announce = tiers[0][0]
+		}
+	}
+	return removed
+}
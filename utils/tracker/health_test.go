@@ -0,0 +1,76 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+func TestProbeAndPrune(t *testing.T) {
+	data, err := ioutil.ReadFile("../../tests/puppy.torrent")
+	utils.CheckError(err)
+	tr := torrent.NewTorrent(data)
+	hash := tr.InfoHash()
+
+	hs := httptest.NewServer(NewServer(time.Minute, time.Second))
+	defer hs.Close()
+	dead := httptest.NewServer(nil)
+	dead.Close()
+
+	live := hs.URL + "/announce"
+	tr.Announce = dead.URL + "/announce"
+	tr.AnnounceList = [][]string{
+		{dead.URL + "/announce", live},
+		{"wss://tracker.test/announce"},
+		{dead.URL + "/x/announce"},
+	}
+	tr.Extra = map[string]interface{}{"url-list": []interface{}{"http://seed.test/"}}
+
+	client := &Client{HTTP: DefaultClient.HTTP, Timeout: time.Second}
+	health := client.ProbeAll(context.Background(), tr, utils.NewPeerId(), ProbeAuto, 4)
+	if len(health) != 4 {
+		t.Fatalf("health %d", len(health))
+	}
+	for _, h := range health {
+		alive := h.URL == live
+		if h.Alive() != alive {
+			t.Errorf("%s alive %v: %v", h.URL, h.Alive(), h.Err)
+		}
+	}
+	if health[1].Method != ProbeScrape {
+		t.Errorf("method %s", health[1].Method)
+	}
+
+	if n := Prune(tr, health); n != 2 {
+		t.Errorf("removed %d", n)
+	}
+	s := bencode.NewEncoder().Encode(tr.ToMap())
+	pruned := torrent.NewTorrent([]byte(s))
+	if pruned.InfoHash() != hash {
+		t.Error("info hash changed")
+	}
+	if pruned.Announce != live || len(pruned.AnnounceList) != 2 || pruned.Extra["url-list"] == nil {
+		t.Errorf("pruned %s %v %v", pruned.Announce, pruned.AnnounceList, pruned.Extra)
+	}
+
+	// 不在announce-list中的announce也计入去掉的数量
+	tr.Announce = "http://gone.test/announce"
+	bad := []*Health{{URL: tr.Announce, Supported: true, Err: errors.New("dead")}}
+	if n := Prune(tr, bad); n != 1 || tr.Announce != live {
+		t.Errorf("removed %d, announce %s", n, tr.Announce)
+	}
+
+	// 全部去掉后不写announce
+	tr.Announce, tr.AnnounceList = "http://gone.test/announce", nil
+	Prune(tr, bad)
+	if _, ok := tr.ToMap()["announce"]; ok {
+		t.Error("empty announce encoded")
+	}
+}
@@ -0,0 +1,432 @@
+package tracker
+
+//
+// 私有tracker：announce地址中带有每个用户的passkey，
+// 按用户和torrent记录上传下载量，并保存到本地文件
+//
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+var (
+	ErrUnknownPasskey = errors.New("unknown passkey")
+	ErrBanned         = errors.New("account banned")
+	ErrClientRefused  = errors.New("client not allowed")
+)
+
+// 用户在单个torrent上的统计
+type TorrentStats struct {
+	Uploaded   int64     `json:"uploaded"`
+	Downloaded int64     `json:"downloaded"`
+	Completed  int       `json:"completed"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// 用户账户
+type Account struct {
+	Name     string                   `json:"name"`
+	Passkey  string                   `json:"passkey"`
+	Banned   bool                     `json:"banned,omitempty"`
+	MinRatio float64                  `json:"min_ratio,omitempty"` // 下载量超过Grace后的最低分享率
+	Created  time.Time                `json:"created"`
+	Torrents map[string]*TorrentStats `json:"torrents,omitempty"` // 以十六进制info_hash为键
+}
+
+// 总上传和下载量
+func (a *Account) Totals() (uploaded, downloaded int64) {
+	for _, s := range a.Torrents {
+		uploaded += s.Uploaded
+		downloaded += s.Downloaded
+	}
+	return
+}
+
+// 分享率，没有下载时返回-1
+func (a *Account) Ratio() float64 {
+	up, down := a.Totals()
+	if down == 0 {
+		return -1
+	}
+	return float64(up) / float64(down)
+}
+
+// 本次会话上次报告的计数，用于计算增量
+type session struct {
+	uploaded, downloaded int64
+	seen                 time.Time // 超过peer的过期时间没有announce时清除
+}
+
+// 账户存储
+type Accounts struct {
+	Clients []string // 允许的客户端peer_id前缀，为空时不限制
+	Grace   int64    // 下载量低于这个值时不检查分享率
+
+	path     string
+	mu       sync.Mutex
+	users    map[string]*Account // 以passkey为键
+	sessions map[string]*session
+	dirty    bool
+	modTime  time.Time // 上次加载或保存时文件的修改时间和大小
+	size     int64
+}
+
+// 从文件加载账户，文件不存在时创建空的存储
+func LoadAccounts(path string) (*Accounts, error) {
+	s := &Accounts{
+		path:     path,
+		users:    make(map[string]*Account),
+		sessions: make(map[string]*session),
+	}
+	users, fi, err := readAccounts(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		s.users[u.Passkey] = u
+	}
+	s.stamp(fi)
+	return s, nil
+}
+
+// 读取账户文件，文件不存在时返回空
+func readAccounts(path string) ([]*Account, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var users []*Account
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, nil, err
+	}
+	return users, fi, nil
+}
+
+// 记录文件的状态，调用时持有锁
+func (s *Accounts) stamp(fi os.FileInfo) {
+	if fi == nil {
+		s.modTime, s.size = time.Time{}, 0
+		return
+	}
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+}
+
+// 文件被其他进程修改（例如服务运行时执行tracker user命令）时重新加载并合并：
+// 账户和设置以文件为准，统计以内存为准，文件中没有的账户保留
+func (s *Accounts) Reload() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	changed := !fi.ModTime().Equal(s.modTime) || fi.Size() != s.size
+	s.mu.Unlock()
+	if !changed {
+		return nil
+	}
+
+	users, fi, err := readAccounts(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range users {
+		if a := s.users[u.Passkey]; a != nil {
+			a.Name, a.Banned, a.MinRatio, a.Created = u.Name, u.Banned, u.MinRatio, u.Created
+			continue
+		}
+		s.users[u.Passkey] = u
+	}
+	s.stamp(fi)
+	return nil
+}
+
+// 合并文件中的改动后保存，先写临时文件再改名
+func (s *Accounts) Save() error {
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	users := s.list()
+	data, err := json.MarshalIndent(users, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".accounts")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.stamp(fi)
+	s.mu.Unlock()
+	return nil
+}
+
+// 有改动时保存
+func (s *Accounts) SaveIfDirty() error {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return s.Save()
+}
+
+// 生成随机passkey
+func NewPasskey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 添加用户
+func (s *Accounts) Add(name string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(name) != nil {
+		return nil, errors.New("account exists: " + name)
+	}
+	a := &Account{
+		Name:     name,
+		Passkey:  NewPasskey(),
+		Created:  time.Now(),
+		Torrents: make(map[string]*TorrentStats),
+	}
+	s.users[a.Passkey] = a
+	s.dirty = true
+	return a, nil
+}
+
+// 按名称或passkey查找用户
+func (s *Accounts) Get(key string) *Account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.find(key)
+}
+
+func (s *Accounts) find(key string) *Account {
+	if a := s.users[key]; a != nil {
+		return a
+	}
+	for _, a := range s.users {
+		if a.Name == key {
+			return a
+		}
+	}
+	return nil
+}
+
+// 封禁或解封用户
+func (s *Accounts) SetBanned(key string, banned bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.find(key)
+	if a == nil {
+		return ErrUnknownPasskey
+	}
+	a.Banned = banned
+	s.dirty = true
+	return nil
+}
+
+// 设置用户的最低分享率，0表示不检查
+func (s *Accounts) SetMinRatio(key string, ratio float64) error {
+	if ratio < 0 {
+		return errors.New("invalid ratio")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.find(key)
+	if a == nil {
+		return ErrUnknownPasskey
+	}
+	a.MinRatio = ratio
+	s.dirty = true
+	return nil
+}
+
+// 清除超过ttl没有announce的会话
+func (s *Accounts) Expire(now time.Time, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, last := range s.sessions {
+		if now.Sub(last.seen) > ttl {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// 按名称排序的用户列表
+func (s *Accounts) List() []*Account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list()
+}
+
+func (s *Accounts) list() []*Account {
+	var users []*Account
+	for _, a := range s.users {
+		users = append(users, a)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// 检查passkey是否有效
+func (s *Accounts) Check(passkey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.users[passkey]
+	if a == nil {
+		return ErrUnknownPasskey
+	}
+	if a.Banned {
+		return ErrBanned
+	}
+	return nil
+}
+
+// 检查请求是否允许，并记录上传下载的增量
+func (s *Accounts) Account(passkey string, req *torrent.GetStruct) error {
+	if !s.clientAllowed(req.PeerId) {
+		return ErrClientRefused
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.users[passkey]
+	if a == nil {
+		return ErrUnknownPasskey
+	}
+	if a.Banned {
+		return ErrBanned
+	}
+
+	hash := hex.EncodeToString([]byte(req.InfoHash))
+	st := a.Torrents[hash]
+	if st == nil {
+		st = &TorrentStats{}
+		if a.Torrents == nil {
+			a.Torrents = make(map[string]*TorrentStats)
+		}
+		a.Torrents[hash] = st
+	}
+
+	// 客户端报告的是本次会话的累计值，计数变小说明是新会话
+	key := passkey + req.InfoHash + req.PeerId
+	last := s.sessions[key]
+	if last == nil || req.Event == EventStarted {
+		last = &session{}
+	}
+	up, down := int64(req.Uploaded), int64(req.Downloaded)
+	if up < last.uploaded || down < last.downloaded {
+		last = &session{}
+	}
+	st.Uploaded += up - last.uploaded
+	st.Downloaded += down - last.downloaded
+	st.LastSeen = time.Now()
+	if req.Event == EventCompleted {
+		st.Completed++
+	}
+	if req.Event == EventStopped {
+		delete(s.sessions, key)
+	} else {
+		s.sessions[key] = &session{uploaded: up, downloaded: down, seen: time.Now()}
+	}
+	s.dirty = true
+
+	// 分享率不足时只允许做种
+	if a.MinRatio > 0 && req.Left > 0 && req.Event != EventStopped {
+		up, down := a.Totals()
+		if down > s.Grace && float64(up) < a.MinRatio*float64(down) {
+			return errors.New("ratio too low, seeding only")
+		}
+	}
+	return nil
+}
+
+func (s *Accounts) clientAllowed(peerId string) bool {
+	if len(s.Clients) == 0 {
+		return true
+	}
+	for _, prefix := range s.Clients {
+		if strings.HasPrefix(peerId, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 从路径 .../<passkey>/announce 中取出passkey
+func SplitPasskey(path string) (passkey, rest string) {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "", path
+	}
+	j := strings.LastIndex(path[:i], "/")
+	return path[j+1 : i], path[:j] + path[i:]
+}
+
+// 在announce地址中插入passkey：http://host/announce -> http://host/<passkey>/announce
+func PasskeyURL(announce, passkey string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 {
+		return "", errors.New("invalid announce url: " + announce)
+	}
+	u.Path = u.Path[:i] + "/" + passkey + u.Path[i:]
+	return u.String(), nil
+}
@@ -0,0 +1,130 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/openqt/whonet/utils/bencode"
+)
+
+// 向tracker查询torrent的统计信息
+func (c *Client) Scrape(ctx context.Context, tracker string, hashes []string) (map[string]ScrapeResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return c.scrapeHTTP(ctx, u, hashes)
+	case "udp":
+		if c.NoUDP {
+			return nil, ErrUDPDisabled
+		}
+		return scrapeUDP(ctx, u, hashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+}
+
+// 按约定将路径最后的announce替换为scrape
+func ScrapeURL(u *url.URL) (*url.URL, error) {
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return nil, errors.New("tracker does not support scrape")
+	}
+	s := *u
+	s.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	return &s, nil
+}
+
+func (c *Client) scrapeHTTP(ctx context.Context, u *url.URL, hashes []string) (map[string]ScrapeResult, error) {
+	su, err := ScrapeURL(u)
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	for _, h := range hashes {
+		v.Add("info_hash", h)
+	}
+
+	data, err := c.get(ctx, su, v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	val, err := bencode.NewDecoder().TryDecode(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, _ := val.(map[string]interface{})
+	if s, ok := dict["failure reason"].(string); ok {
+		return nil, &FailureError{Reason: s}
+	}
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid scrape response")
+	}
+
+	result := make(map[string]ScrapeResult)
+	for h, f := range files {
+		d, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var r ScrapeResult
+		r.Complete, _ = d["complete"].(int)
+		r.Downloaded, _ = d["downloaded"].(int)
+		r.Incomplete, _ = d["incomplete"].(int)
+		result[h] = r
+	}
+	return result, nil
+}
+
+func scrapeUDP(ctx context.Context, u *url.URL, hashes []string) (map[string]ScrapeResult, error) {
+	s, err := dialUDP(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	// 超过一个数据包的容量时分批发送
+	result := make(map[string]ScrapeResult)
+	for len(hashes) > 0 {
+		batch := hashes
+		if len(batch) > udpMaxScrape {
+			batch = batch[:udpMaxScrape]
+		}
+		hashes = hashes[len(batch):]
+
+		body := new(bytes.Buffer)
+		for _, h := range batch {
+			body.WriteString(h)
+		}
+		data, err := s.transact(ctx, actionScrape, body.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		for i, h := range batch {
+			if len(data) < (i+1)*12 {
+				break
+			}
+			b := data[i*12:]
+			result[h] = ScrapeResult{
+				Complete:   int(binary.BigEndian.Uint32(b)),
+				Downloaded: int(binary.BigEndian.Uint32(b[4:])),
+				Incomplete: int(binary.BigEndian.Uint32(b[8:])),
+			}
+		}
+	}
+	return result, nil
+}
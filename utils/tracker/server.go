@@ -0,0 +1,228 @@
+package tracker
+
+//
+// Tracker服务端，支持HTTP和UDP
+// 参考 http://www.bittorrent.org/beps/bep_0003.html#trackers
+//      http://www.bittorrent.org/beps/bep_0048.html (scrape)
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+// Tracker服务
+type Server struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	NumWant     int // 未指定numwant时返回的peer数
+	MaxNumWant  int
+	TrustIP     bool // 接受announce中的ip参数，例如在反向代理之后
+
+	Swarms   *Swarms
+	Accounts *Accounts // 不为nil时为私有模式
+}
+
+// 创建服务，peer过期时间为两倍announce间隔
+func NewServer(interval, minInterval time.Duration) *Server {
+	return &Server{
+		Interval:    interval,
+		MinInterval: minInterval,
+		NumWant:     DefaultNumWant,
+		MaxNumWant:  MaxNumWant,
+		Swarms:      NewSwarms(2 * interval),
+	}
+}
+
+// 定期清除过期peer，直到quit关闭
+func (s *Server) ExpireLoop(quit <-chan struct{}) {
+	ticker := time.NewTicker(s.Interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			s.Swarms.Expire(now)
+			if s.Accounts != nil {
+				s.Accounts.Expire(now, s.Swarms.TTL)
+			}
+		}
+	}
+}
+
+// 处理HTTP请求，路径以/announce或/scrape结尾
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		s.serveAnnounce(w, r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		s.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, err := torrent.ParseGetStruct(r.URL.Query())
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+	// 不允许的torrent不计入账户
+	if !s.Swarms.Allowed(req.InfoHash) {
+		writeFailure(w, ErrNotAllowed.Error())
+		return
+	}
+	if s.Accounts != nil {
+		passkey, _ := SplitPasskey(r.URL.Path)
+		if err := s.Accounts.Account(passkey, req); err != nil {
+			writeFailure(w, err.Error())
+			return
+		}
+	}
+
+	ip := s.remoteIP(r, req)
+	peers, stats, err := s.Swarms.Announce(req, ip, s.numWant(req.NumWant))
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	resp := map[string]interface{}{
+		"interval":     int(s.Interval / time.Second),
+		"min interval": int(s.MinInterval / time.Second),
+		"complete":     stats.Complete,
+		"incomplete":   stats.Incomplete,
+	}
+	if req.Compact == 1 {
+		var v4, v6 []byte
+		for _, p := range peers {
+			if p.IsIPv6() {
+				v6 = append(v6, p.Compact()...)
+			} else {
+				v4 = append(v4, p.Compact()...)
+			}
+		}
+		resp["peers"] = string(v4)
+		if len(v6) > 0 {
+			resp["peers6"] = string(v6)
+		}
+	} else {
+		var list []interface{}
+		for _, p := range peers {
+			d := map[string]interface{}{
+				"ip":   p.IP.String(),
+				"port": p.Port,
+			}
+			if req.NoPeerId == 0 {
+				d["peer id"] = p.Id
+			}
+			list = append(list, d)
+		}
+		resp["peers"] = list
+	}
+	writeBencode(w, resp)
+}
+
+func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request) {
+	if s.Accounts != nil {
+		passkey, _ := SplitPasskey(r.URL.Path)
+		if err := s.Accounts.Check(passkey); err != nil {
+			writeFailure(w, err.Error())
+			return
+		}
+	}
+	hashes := r.URL.Query()["info_hash"]
+	if len(hashes) == 0 {
+		hashes = s.Swarms.InfoHashes()
+	}
+
+	files := make(map[string]interface{})
+	for _, h := range hashes {
+		stats, ok := s.Swarms.Scrape(h)
+		if !ok {
+			continue
+		}
+		files[h] = map[string]interface{}{
+			"complete":   stats.Complete,
+			"downloaded": stats.Downloaded,
+			"incomplete": stats.Incomplete,
+		}
+	}
+	writeBencode(w, map[string]interface{}{"files": files})
+}
+
+// 客户端地址。ip参数可以冒充别人的地址，只在TrustIP或请求来自本机时使用
+func (s *Server) remoteIP(r *http.Request, req *torrent.GetStruct) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if s.TrustIP || remote != nil && remote.IsLoopback() {
+		if ip := net.ParseIP(req.IP); ip != nil {
+			return ip
+		}
+	}
+	return remote
+}
+
+func (s *Server) numWant(n int) int {
+	if n < 0 {
+		n = s.NumWant
+	}
+	if n > s.MaxNumWant {
+		n = s.MaxNumWant
+	}
+	return n
+}
+
+func writeBencode(w http.ResponseWriter, val interface{}) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(bencode.NewEncoder().Encode(val)))
+}
+
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, map[string]interface{}{"failure reason": reason})
+}
+
+// 从目录中的.torrent文件加载允许的info_hash
+func LoadAllowList(dir string) (map[string]bool, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.torrent"))
+	if err != nil {
+		return nil, err
+	}
+
+	allow := make(map[string]bool)
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseTorrent(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		allow[t.InfoHash()] = true
+	}
+	return allow, nil
+}
+
+// NewTorrent遇到错误数据会panic，这里转换为error
+func parseTorrent(data []byte) (t *torrent.TorrentStruct, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid torrent: %v", r)
+		}
+	}()
+	return torrent.NewTorrent(data), nil
+}
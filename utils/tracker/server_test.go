@@ -0,0 +1,331 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+func startServer(t *testing.T, s *Server) (string, string, func()) {
+	hs := httptest.NewServer(s)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	utils.CheckError(err)
+	go s.ServeUDP(conn)
+	return hs.URL + "/announce", "udp://" + conn.LocalAddr().String() + "/announce", func() {
+		hs.Close()
+		conn.Close()
+	}
+}
+
+func TestServerEndToEnd(t *testing.T) {
+	s := NewServer(time.Minute, 10*time.Second)
+	httpURL, udpURL, stop := startServer(t, s)
+	defer stop()
+
+	ctx := context.Background()
+	hash := "ABCDEFGHIJKLMNOPQRST"
+	seeder := &torrent.GetStruct{InfoHash: hash, PeerId: "-WN0100-seeder000000", Port: 1001,
+		Left: 0, Compact: 1, Event: EventStarted, NumWant: 50}
+	leecher := &torrent.GetStruct{InfoHash: hash, PeerId: "-WN0100-leecher00000", Port: 1002,
+		Left: 100, Compact: 1, Event: EventStarted, NumWant: 50}
+
+	for i, u := range []string{udpURL, httpURL} {
+		hash = hash[:19] + strconv.Itoa(i)
+		seeder.InfoHash, leecher.InfoHash = hash, hash
+		resp, err := DefaultClient.Announce(ctx, u, seeder)
+		if err != nil {
+			t.Fatalf("%s: %v", u, err)
+		}
+		if len(resp.Peers) != 0 {
+			t.Errorf("%s: seeder got peers %v", u, resp.Peers)
+		}
+
+		resp, err = DefaultClient.Announce(ctx, u, leecher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Peers) != 1 || resp.Peers[0].Port != 1001 {
+			t.Errorf("%s: leecher got peers %v", u, resp.Peers)
+		}
+		if resp.Interval != time.Minute || resp.Complete != 1 || resp.Incomplete != 1 {
+			t.Errorf("%s: response %+v", u, resp)
+		}
+
+		stats, err := DefaultClient.Scrape(ctx, u, []string{hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats[hash] != (ScrapeResult{Complete: 1, Incomplete: 1}) {
+			t.Errorf("%s: scrape %+v", u, stats[hash])
+		}
+	}
+
+	// 非紧凑格式
+	leecher.Compact = 0
+	leecher.Event = EventCompleted
+	leecher.Left = 0
+	r, err := http.Get(httpURL + "?" + leecher.Query())
+	utils.CheckError(err)
+	data, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	resp, err := ParseResponse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 0 || resp.Complete != 2 {
+		t.Errorf("completed response %+v", resp)
+	}
+	if st, _ := s.Swarms.Scrape(hash); st.Downloaded != 1 {
+		t.Errorf("downloaded %d", st.Downloaded)
+	}
+
+	// 过期清除
+	s.Swarms.Expire(time.Now().Add(time.Hour))
+	if st, _ := s.Swarms.Scrape(hash); st.Complete != 0 {
+		t.Errorf("peers not expired: %+v", st)
+	}
+}
+
+func TestServerRemoteIP(t *testing.T) {
+	s := NewServer(time.Minute, 0)
+	req := &torrent.GetStruct{IP: "203.0.113.7"}
+	r := httptest.NewRequest("GET", "/announce", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if ip := s.remoteIP(r, req); ip.String() != "192.0.2.1" {
+		t.Errorf("ip parameter trusted: %v", ip)
+	}
+	s.TrustIP = true
+	if ip := s.remoteIP(r, req); ip.String() != "203.0.113.7" {
+		t.Errorf("trusted ip %v", ip)
+	}
+	s.TrustIP = false
+	r.RemoteAddr = "127.0.0.1:1234"
+	if ip := s.remoteIP(r, req); ip.String() != "203.0.113.7" {
+		t.Errorf("ip from loopback %v", ip)
+	}
+}
+
+func TestServerScrapeMany(t *testing.T) {
+	s := NewServer(time.Minute, 0)
+	_, udpURL, stop := startServer(t, s)
+	defer stop()
+
+	// 超过一个UDP请求的上限，分批发送
+	var hashes []string
+	for i := 0; i < 2*udpMaxScrape+1; i++ {
+		hashes = append(hashes, fmt.Sprintf("%020d", i))
+	}
+	stats, err := DefaultClient.Scrape(context.Background(), udpURL, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != len(hashes) {
+		t.Errorf("scraped %d of %d", len(stats), len(hashes))
+	}
+}
+
+func TestServerAllowList(t *testing.T) {
+	allow, err := LoadAllowList("../../tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allow) != 3 {
+		t.Fatalf("allow list size %d", len(allow))
+	}
+
+	s := NewServer(time.Minute, 10*time.Second)
+	s.Swarms.SetAllowList(allow)
+	httpURL, udpURL, stop := startServer(t, s)
+	defer stop()
+
+	var hash string
+	for h := range allow {
+		hash = h
+	}
+	req := &torrent.GetStruct{InfoHash: hash, PeerId: "-WN0100-000000000000", Port: 1001, Compact: 1}
+	for _, u := range []string{httpURL, udpURL} {
+		req.InfoHash = hash
+		if _, err := DefaultClient.Announce(context.Background(), u, req); err != nil {
+			t.Errorf("%s: %v", u, err)
+		}
+
+		req.InfoHash = "ABCDEFGHIJKLMNOPQRST"
+		_, err := DefaultClient.Announce(context.Background(), u, req)
+		var fe *FailureError
+		if !errors.As(err, &fe) || fe.Reason != ErrNotAllowed.Error() {
+			t.Errorf("%s: unexpected %v", u, err)
+		}
+	}
+}
+
+func TestServerPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whonet")
+	utils.CheckError(err)
+	defer os.RemoveAll(dir)
+
+	accounts, err := LoadAccounts(filepath.Join(dir, "accounts.json"))
+	utils.CheckError(err)
+	accounts.Clients = []string{"-WN"}
+	alice, _ := accounts.Add("alice")
+	bob, _ := accounts.Add("bob")
+	accounts.SetBanned("bob", true)
+
+	s := NewServer(time.Minute, 10*time.Second)
+	s.Accounts = accounts
+	httpURL, _, stop := startServer(t, s)
+	defer stop()
+
+	ctx := context.Background()
+	req := &torrent.GetStruct{InfoHash: "ABCDEFGHIJKLMNOPQRST", PeerId: "-WN0100-000000000000",
+		Port: 1001, Left: 100, Compact: 1, Event: EventStarted}
+	announce := func(passkey string) error {
+		u, err := PasskeyURL(httpURL, passkey)
+		utils.CheckError(err)
+		_, err = DefaultClient.Announce(ctx, u, req)
+		return err
+	}
+
+	if err := announce(alice.Passkey); err != nil {
+		t.Fatal(err)
+	}
+	req.Event, req.Uploaded, req.Downloaded = EventNone, 10, 20
+	announce(alice.Passkey)
+	req.Uploaded, req.Downloaded = 15, 30
+	announce(alice.Passkey)
+
+	for key, want := range map[string]error{
+		"0123456789abcdef0123456789abcdef": ErrUnknownPasskey,
+		bob.Passkey:                        ErrBanned,
+		"":                                 ErrUnknownPasskey,
+	} {
+		var fe *FailureError
+		if err := announce(key); !errors.As(err, &fe) || fe.Reason != want.Error() {
+			t.Errorf("passkey %q: %v", key, err)
+		}
+	}
+	req.PeerId = "-XX0100-000000000000"
+	if err := announce(alice.Passkey); err == nil {
+		t.Error("client not refused")
+	}
+	req.PeerId = "-WN0100-000000000000"
+
+	// 分享率0.5，下载量超过Grace后只允许做种
+	utils.CheckError(accounts.SetMinRatio("alice", 1))
+	accounts.Grace = 100
+	if err := announce(alice.Passkey); err != nil {
+		t.Errorf("refused within grace: %v", err)
+	}
+	accounts.Grace = 10
+	if err := announce(alice.Passkey); err == nil {
+		t.Error("low ratio not refused")
+	}
+	req.Left = 0
+	if err := announce(alice.Passkey); err != nil {
+		t.Errorf("seeding refused: %v", err)
+	}
+
+	// 不允许的torrent不计入
+	s.Swarms.SetAllowList(map[string]bool{req.InfoHash: true})
+	other := *req
+	other.InfoHash, other.Uploaded, other.Downloaded = "TSRQPONMLKJIHGFEDCBA", 1000, 1000
+	u, _ := PasskeyURL(httpURL, alice.Passkey)
+	if _, err := DefaultClient.Announce(ctx, u, &other); err == nil {
+		t.Error("torrent not in allow list accepted")
+	}
+
+	// 会话随peer一起过期
+	accounts.Expire(time.Now(), time.Minute)
+	if len(accounts.sessions) != 1 {
+		t.Errorf("%d sessions", len(accounts.sessions))
+	}
+	accounts.Expire(time.Now().Add(2*time.Minute), time.Minute)
+	if len(accounts.sessions) != 0 {
+		t.Errorf("sessions not expired: %d", len(accounts.sessions))
+	}
+
+	utils.CheckError(accounts.Save())
+	loaded, err := LoadAccounts(filepath.Join(dir, "accounts.json"))
+	utils.CheckError(err)
+	up, down := loaded.Get("alice").Totals()
+	if up != 15 || down != 30 {
+		t.Errorf("accounted %d/%d", up, down)
+	}
+	if !loaded.Get(bob.Passkey).Banned || loaded.Get("alice").MinRatio != 1 {
+		t.Error("ban or ratio not persisted")
+	}
+}
+
+// 服务运行时用另一个Accounts修改文件，相当于执行tracker user命令
+func TestServerPrivateEdit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whonet")
+	utils.CheckError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts.json")
+
+	accounts, err := LoadAccounts(path)
+	utils.CheckError(err)
+	alice, _ := accounts.Add("alice")
+	utils.CheckError(accounts.Save())
+
+	s := NewServer(time.Minute, 10*time.Second)
+	s.Accounts = accounts
+	httpURL, _, stop := startServer(t, s)
+	defer stop()
+
+	ctx := context.Background()
+	req := &torrent.GetStruct{InfoHash: "ABCDEFGHIJKLMNOPQRST", PeerId: "-WN0100-000000000000",
+		Port: 1001, Left: 100, Compact: 1, Event: EventStarted, Uploaded: 10, Downloaded: 20}
+	announce := func(passkey string) error {
+		u, err := PasskeyURL(httpURL, passkey)
+		utils.CheckError(err)
+		_, err = DefaultClient.Announce(ctx, u, req)
+		return err
+	}
+	if err := announce(alice.Passkey); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := LoadAccounts(path)
+	utils.CheckError(err)
+	carol, _ := cli.Add("carol")
+	utils.CheckError(cli.SetBanned("alice", true))
+	utils.CheckError(cli.Save())
+
+	utils.CheckError(accounts.Reload())
+	req.PeerId = "-WN0100-111111111111"
+	if err := announce(carol.Passkey); err != nil {
+		t.Errorf("new account refused: %v", err)
+	}
+	if err := announce(alice.Passkey); err == nil {
+		t.Error("ban not applied")
+	}
+
+	// 保存时不覆盖文件中的改动，统计以服务为准
+	utils.CheckError(cli.SetMinRatio("carol", 2))
+	utils.CheckError(cli.Save())
+	utils.CheckError(accounts.Save())
+	loaded, err := LoadAccounts(path)
+	utils.CheckError(err)
+	a, c := loaded.Get("alice"), loaded.Get("carol")
+	if a == nil || !a.Banned || c == nil || c.MinRatio != 2 {
+		t.Fatalf("edits lost: %+v %+v", a, c)
+	}
+	if up, down := a.Totals(); up != 10 || down != 20 {
+		t.Errorf("alice accounted %d/%d", up, down)
+	}
+	if up, down := c.Totals(); up != 10 || down != 20 {
+		t.Errorf("carol accounted %d/%d", up, down)
+	}
+}
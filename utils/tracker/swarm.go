@@ -0,0 +1,164 @@
+package tracker
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+var (
+	ErrNotAllowed = errors.New("torrent not allowed")
+)
+
+// swarm中的一个peer
+type peerEntry struct {
+	Peer
+	Seeder  bool
+	Expires time.Time
+}
+
+// 单个torrent的swarm
+type swarm struct {
+	peers      map[string]*peerEntry // 以peer_id为键
+	downloaded int                   // 完成下载的次数
+}
+
+// Scrape统计
+type ScrapeResult struct {
+	Complete   int // 做种数
+	Downloaded int // 完成次数
+	Incomplete int // 下载数
+}
+
+// 内存中的swarm表
+type Swarms struct {
+	TTL time.Duration // peer超过这个时间没有announce则被清除
+
+	mu       sync.RWMutex
+	torrents map[string]*swarm
+	allow    map[string]bool // 为nil时允许所有torrent
+}
+
+func NewSwarms(ttl time.Duration) *Swarms {
+	return &Swarms{
+		TTL:      ttl,
+		torrents: make(map[string]*swarm),
+	}
+}
+
+// 设置允许的info_hash列表，nil表示不限制
+func (s *Swarms) SetAllowList(allow map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allow = allow
+}
+
+// 判断info_hash是否允许
+func (s *Swarms) Allowed(infoHash string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.allow == nil || s.allow[infoHash]
+}
+
+// 处理announce请求，返回最多numwant个其他peer
+func (s *Swarms) Announce(req *torrent.GetStruct, ip net.IP, numWant int) ([]Peer, ScrapeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.allow != nil && !s.allow[req.InfoHash] {
+		return nil, ScrapeResult{}, ErrNotAllowed
+	}
+
+	sw := s.torrents[req.InfoHash]
+	if sw == nil {
+		sw = &swarm{peers: make(map[string]*peerEntry)}
+		s.torrents[req.InfoHash] = sw
+	}
+
+	if req.Event == EventStopped {
+		delete(sw.peers, req.PeerId)
+		return nil, sw.stats(), nil
+	}
+
+	if req.Event == EventCompleted {
+		if p := sw.peers[req.PeerId]; p == nil || !p.Seeder {
+			sw.downloaded++
+		}
+	}
+	me := &peerEntry{
+		Peer:    Peer{IP: ip, Port: req.Port, Id: req.PeerId},
+		Seeder:  req.Left == 0,
+		Expires: time.Now().Add(s.TTL),
+	}
+	sw.peers[req.PeerId] = me
+
+	var peers []Peer
+	for _, p := range sw.peers {
+		if p == me || (me.Seeder && p.Seeder) {
+			continue
+		}
+		peers = append(peers, p.Peer)
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > numWant {
+		peers = peers[:numWant]
+	}
+	return peers, sw.stats(), nil
+}
+
+// 查询单个torrent的统计，不允许的torrent返回false
+func (s *Swarms) Scrape(infoHash string) (ScrapeResult, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.allow != nil && !s.allow[infoHash] {
+		return ScrapeResult{}, false
+	}
+	sw := s.torrents[infoHash]
+	if sw == nil {
+		return ScrapeResult{}, true
+	}
+	return sw.stats(), true
+}
+
+// 所有已知torrent的info_hash
+func (s *Swarms) InfoHashes() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var hashes []string
+	for h := range s.torrents {
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+// 清除过期的peer和空的swarm
+func (s *Swarms) Expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, sw := range s.torrents {
+		for id, p := range sw.peers {
+			if now.After(p.Expires) {
+				delete(sw.peers, id)
+			}
+		}
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.torrents, h)
+		}
+	}
+}
+
+func (sw *swarm) stats() ScrapeResult {
+	r := ScrapeResult{Downloaded: sw.downloaded}
+	for _, p := range sw.peers {
+		if p.Seeder {
+			r.Complete++
+		} else {
+			r.Incomplete++
+		}
+	}
+	return r
+}
@@ -0,0 +1,258 @@
+package tracker
+
+//
+// Tracker客户端
+// 参考 http://www.bittorrent.org/beps/bep_0003.html#trackers
+//      http://www.bittorrent.org/beps/bep_0023.html (compact)
+//      http://www.bittorrent.org/beps/bep_0031.html (retry in)
+//
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openqt/whonet/utils"
+	"github.com/openqt/whonet/utils/bencode"
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+var LOG = utils.GetLogger()
+
+// 对端地址
+type Peer struct {
+	IP   net.IP
+	Port int
+	Id   string
+}
+
+func (p Peer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+}
+
+// Tracker应答
+type Response struct {
+	FailureReason  string
+	WarningMessage string
+	Interval       time.Duration
+	MinInterval    time.Duration
+	RetryIn        time.Duration // BEP 31，小于0表示不再重试
+	TrackerId      string
+	Complete       int
+	Incomplete     int
+	Peers          []Peer
+}
+
+// Tracker返回的失败信息
+type FailureError struct {
+	Reason  string
+	RetryIn time.Duration
+}
+
+func (e *FailureError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+// 发送announce请求的接口，方便替换实现
+type Requester interface {
+	Announce(ctx context.Context, tracker string, req *torrent.GetStruct) (*Response, error)
+}
+
+// 设置了代理时拒绝udp tracker
+var ErrUDPDisabled = errors.New("udp tracker disabled when using a proxy")
+
+// Tracker客户端，支持http(s)和udp
+type Client struct {
+	HTTP    *http.Client
+	Timeout time.Duration // 单次请求超时
+	NoUDP   bool          // HTTP经过代理时UDP会直接连接，暴露真实地址
+}
+
+var DefaultClient = &Client{
+	HTTP:    http.DefaultClient,
+	Timeout: 30 * time.Second,
+}
+
+// 向tracker发送announce请求
+func (c *Client) Announce(ctx context.Context, tracker string, req *torrent.GetStruct) (*Response, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return c.announceHTTP(ctx, u, req)
+	case "udp":
+		if c.NoUDP {
+			return nil, ErrUDPDisabled
+		}
+		return announceUDP(ctx, u, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+}
+
+func (c *Client) announceHTTP(ctx context.Context, u *url.URL, req *torrent.GetStruct) (*Response, error) {
+	data, err := c.get(ctx, u, req.Query())
+	if err != nil {
+		return nil, err
+	}
+	return ParseResponse(data)
+}
+
+// 发送GET请求，query追加在原有参数之后
+func (c *Client) get(ctx context.Context, u *url.URL, query string) ([]byte, error) {
+	s := u.String()
+	if u.RawQuery != "" {
+		s += "&" + query
+	} else {
+		s += "?" + query
+	}
+
+	r, err := http.NewRequest("GET", s, nil)
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(ctx)
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && len(data) == 0 {
+		return nil, fmt.Errorf("tracker http status: %s", resp.Status)
+	}
+	return data, nil
+}
+
+// 解析bencode格式的应答
+func ParseResponse(data []byte) (*Response, error) {
+	val, err := bencode.NewDecoder().TryDecode(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tracker response is not a dict")
+	}
+
+	resp := &Response{}
+	if s, ok := dict["failure reason"].(string); ok {
+		resp.FailureReason = s
+		switch r := dict["retry in"].(type) {
+		case int:
+			resp.RetryIn = time.Duration(r) * time.Minute
+		case string:
+			if r == "never" {
+				resp.RetryIn = -1
+			}
+		}
+		return resp, &FailureError{Reason: s, RetryIn: resp.RetryIn}
+	}
+
+	resp.WarningMessage, _ = dict["warning message"].(string)
+	resp.TrackerId, _ = dict["tracker id"].(string)
+	if n, ok := dict["interval"].(int); ok {
+		resp.Interval = time.Duration(n) * time.Second
+	}
+	if n, ok := dict["min interval"].(int); ok {
+		resp.MinInterval = time.Duration(n) * time.Second
+	}
+	resp.Complete, _ = dict["complete"].(int)
+	resp.Incomplete, _ = dict["incomplete"].(int)
+
+	switch peers := dict["peers"].(type) {
+	case string:
+		resp.Peers = append(resp.Peers, ParseCompact([]byte(peers), net.IPv4len)...)
+	case []interface{}:
+		for _, p := range peers {
+			d, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip := net.ParseIP(fmt.Sprint(d["ip"]))
+			port, _ := d["port"].(int)
+			if ip == nil || port <= 0 {
+				continue
+			}
+			id, _ := d["peer id"].(string)
+			resp.Peers = append(resp.Peers, Peer{IP: ip, Port: port, Id: id})
+		}
+	}
+	if peers6, ok := dict["peers6"].(string); ok {
+		resp.Peers = append(resp.Peers, ParseCompact([]byte(peers6), net.IPv6len)...)
+	}
+
+	return resp, nil
+}
+
+// 解析紧凑格式的地址列表，每项为IP加两字节端口
+func ParseCompact(b []byte, iplen int) []Peer {
+	var peers []Peer
+	size := iplen + 2
+	for i := 0; i+size <= len(b); i += size {
+		ip := make(net.IP, iplen)
+		copy(ip, b[i:i+iplen])
+		port := int(binary.BigEndian.Uint16(b[i+iplen:]))
+		peers = append(peers, Peer{IP: ip, Port: port})
+	}
+	return peers
+}
+
+// 生成紧凑格式的地址
+func (p Peer) Compact() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], uint16(p.Port))
+	return b
+}
+
+// 是否为IPv6地址
+func (p Peer) IsIPv6() bool {
+	return p.IP.To4() == nil
+}
+
+// 判断tracker地址是否支持
+func Supported(tracker string) bool {
+	for _, scheme := range []string{"http://", "https://", "udp://"} {
+		if strings.HasPrefix(tracker, scheme) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package tracker
+
+//
+// UDP Tracker协议
+// 参考 http://www.bittorrent.org/beps/bep_0015.html
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+const (
+	udpProtocolId = 0x41727101980
+
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+
+	udpMaxScrape = 74 // 一次scrape最多的info_hash数
+)
+
+var udpEvents = map[string]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// 一次UDP会话
+type udpSession struct {
+	conn   net.Conn
+	connId uint64
+	ipv6   bool
+}
+
+func dialUDP(ctx context.Context, u *url.URL) (*udpSession, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{conn: conn}
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		s.ipv6 = addr.IP.To4() == nil
+	}
+
+	resp, err := s.transact(ctx, actionConnect, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(resp) < 8 {
+		conn.Close()
+		return nil, errors.New("udp tracker: short connect response")
+	}
+	s.connId = binary.BigEndian.Uint64(resp)
+	return s, nil
+}
+
+func (s *udpSession) Close() error {
+	return s.conn.Close()
+}
+
+// 发送请求并等待应答，超时按 15*2^n 秒重传，返回去掉action和transaction_id后的内容
+func (s *udpSession) transact(ctx context.Context, action uint32, body []byte) ([]byte, error) {
+	tid := rand.Uint32()
+	req := new(bytes.Buffer)
+	if action == actionConnect {
+		binary.Write(req, binary.BigEndian, uint64(udpProtocolId))
+	} else {
+		binary.Write(req, binary.BigEndian, s.connId)
+	}
+	binary.Write(req, binary.BigEndian, action)
+	binary.Write(req, binary.BigEndian, tid)
+	req.Write(body)
+
+	buf := make([]byte, 2048)
+	for n := uint(0); n <= 8; n++ {
+		if _, err := s.conn.Write(req.Bytes()); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(15 * time.Second << n)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		s.conn.SetReadDeadline(deadline)
+
+		for {
+			m, err := s.conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if m < 8 || binary.BigEndian.Uint32(buf[4:]) != tid {
+				continue // 不是本次请求的应答
+			}
+			switch binary.BigEndian.Uint32(buf) {
+			case action:
+				return append([]byte(nil), buf[8:m]...), nil
+			case actionError:
+				return nil, &FailureError{Reason: string(buf[8:m])}
+			default:
+				return nil, errors.New("udp tracker: unexpected action")
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, errors.New("udp tracker: no response")
+}
+
+func announceUDP(ctx context.Context, u *url.URL, req *torrent.GetStruct) (*Response, error) {
+	s, err := dialUDP(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	body := new(bytes.Buffer)
+	body.WriteString(req.InfoHash)
+	body.WriteString(req.PeerId)
+	binary.Write(body, binary.BigEndian, int64(req.Downloaded))
+	binary.Write(body, binary.BigEndian, int64(req.Left))
+	binary.Write(body, binary.BigEndian, int64(req.Uploaded))
+	binary.Write(body, binary.BigEndian, udpEvents[req.Event])
+
+	var ip uint32
+	if v4 := net.ParseIP(req.IP).To4(); v4 != nil {
+		ip = binary.BigEndian.Uint32(v4)
+	}
+	binary.Write(body, binary.BigEndian, ip)
+	key, _ := strconv.ParseUint(req.Key, 16, 32)
+	binary.Write(body, binary.BigEndian, uint32(key))
+	binary.Write(body, binary.BigEndian, int32(req.NumWant))
+	binary.Write(body, binary.BigEndian, uint16(req.Port))
+	if body.Len() != 82 {
+		return nil, fmt.Errorf("udp tracker: invalid info_hash or peer_id")
+	}
+
+	data, err := s.transact(ctx, actionAnnounce, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 {
+		return nil, errors.New("udp tracker: short announce response")
+	}
+
+	resp := &Response{
+		Interval:   time.Duration(binary.BigEndian.Uint32(data)) * time.Second,
+		Incomplete: int(binary.BigEndian.Uint32(data[4:])),
+		Complete:   int(binary.BigEndian.Uint32(data[8:])),
+	}
+	iplen := net.IPv4len
+	if s.ipv6 {
+		iplen = net.IPv6len
+	}
+	resp.Peers = ParseCompact(data[12:], iplen)
+	return resp, nil
+}
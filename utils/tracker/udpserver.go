@@ -0,0 +1,138 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/openqt/whonet/utils/torrent"
+)
+
+// UDP服务，connection_id由地址和时间窗口计算，无需保存状态
+type udpServer struct {
+	*Server
+	secret []byte
+}
+
+// 在conn上处理UDP tracker请求，直到conn关闭
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	u := &udpServer{Server: s, secret: make([]byte, 20)}
+	rand.Read(u.secret)
+
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		if resp := u.handle(buf[:n], udpAddr); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// connection_id有效期为两分钟，以分钟为窗口
+func (u *udpServer) connId(addr *net.UDPAddr, window int64) uint64 {
+	mac := hmac.New(sha1.New, u.secret)
+	mac.Write([]byte(addr.String()))
+	binary.Write(mac, binary.BigEndian, window)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (u *udpServer) validConnId(addr *net.UDPAddr, id uint64) bool {
+	now := time.Now().Unix() / 60
+	return id == u.connId(addr, now) || id == u.connId(addr, now-1)
+}
+
+func (u *udpServer) handle(pkt []byte, addr *net.UDPAddr) []byte {
+	connId := binary.BigEndian.Uint64(pkt)
+	action := binary.BigEndian.Uint32(pkt[8:])
+	tid := binary.BigEndian.Uint32(pkt[12:])
+	body := pkt[16:]
+
+	out := new(bytes.Buffer)
+	reply := func(action uint32) {
+		binary.Write(out, binary.BigEndian, action)
+		binary.Write(out, binary.BigEndian, tid)
+	}
+	fail := func(msg string) []byte {
+		out.Reset()
+		reply(actionError)
+		out.WriteString(msg)
+		return out.Bytes()
+	}
+
+	if action == actionConnect {
+		if connId != udpProtocolId {
+			return nil
+		}
+		reply(actionConnect)
+		binary.Write(out, binary.BigEndian, u.connId(addr, time.Now().Unix()/60))
+		return out.Bytes()
+	}
+	if !u.validConnId(addr, connId) {
+		return fail("invalid connection id")
+	}
+	if u.Accounts != nil {
+		return fail("private tracker requires HTTP announce")
+	}
+
+	switch action {
+	case actionAnnounce:
+		if len(body) < 82 {
+			return fail("invalid announce request")
+		}
+		req := &torrent.GetStruct{
+			InfoHash:   string(body[0:20]),
+			PeerId:     string(body[20:40]),
+			Downloaded: int(binary.BigEndian.Uint64(body[40:])),
+			Left:       int(binary.BigEndian.Uint64(body[48:])),
+			Uploaded:   int(binary.BigEndian.Uint64(body[56:])),
+			NumWant:    int(int32(binary.BigEndian.Uint32(body[76:]))),
+			Port:       int(binary.BigEndian.Uint16(body[80:])),
+			Key:        fmt.Sprintf("%08x", binary.BigEndian.Uint32(body[72:])),
+		}
+		for name, ev := range udpEvents {
+			if ev == binary.BigEndian.Uint32(body[64:]) {
+				req.Event = name
+			}
+		}
+
+		peers, stats, err := u.Swarms.Announce(req, addr.IP, u.numWant(req.NumWant))
+		if err != nil {
+			return fail(err.Error())
+		}
+		reply(actionAnnounce)
+		binary.Write(out, binary.BigEndian, uint32(u.Interval/time.Second))
+		binary.Write(out, binary.BigEndian, uint32(stats.Incomplete))
+		binary.Write(out, binary.BigEndian, uint32(stats.Complete))
+		// 只返回与请求方相同地址族的peer
+		ipv6 := addr.IP.To4() == nil
+		for _, p := range peers {
+			if p.IsIPv6() == ipv6 {
+				out.Write(p.Compact())
+			}
+		}
+		return out.Bytes()
+
+	case actionScrape:
+		reply(actionScrape)
+		for i := 0; i+20 <= len(body) && i < udpMaxScrape*20; i += 20 {
+			stats, _ := u.Swarms.Scrape(string(body[i : i+20]))
+			binary.Write(out, binary.BigEndian, uint32(stats.Complete))
+			binary.Write(out, binary.BigEndian, uint32(stats.Downloaded))
+			binary.Write(out, binary.BigEndian, uint32(stats.Incomplete))
+		}
+		return out.Bytes()
+	}
+	return fail("unknown action")
+}
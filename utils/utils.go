@@ -1,11 +1,15 @@
 package utils
 
 import (
+	"crypto/rand"
 	"github.com/sirupsen/logrus"
 	"os"
 	"reflect"
 )
 
+// peer_id的客户端前缀，Azureus风格
+const PeerIdPrefix = "-WN0100-"
+
 var (
 	log *logrus.Logger = nil
 	LOG                = GetLogger()
@@ -85,3 +89,14 @@ func GetLogger() *logrus.Logger {
 	}
 	return log
 }
+
+// 生成随机的peer_id，共20字节
+func NewPeerId() string {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	b := make([]byte, 20-len(PeerIdPrefix))
+	rand.Read(b)
+	for i := range b {
+		b[i] = chars[int(b[i])%len(chars)]
+	}
+	return PeerIdPrefix + string(b)
+}
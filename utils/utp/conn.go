@@ -0,0 +1,571 @@
+package utp
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+const (
+	// LEDBAT参数
+	target          = 100000 // 目标排队延迟，微秒
+	maxCwndIncrease = 3000   // 每个RTT窗口最多增加的字节数
+	minWindow       = MaxPayload
+
+	recvWindow    = 1024 * 1024 // 接收缓冲大小
+	minRTO        = 500 * time.Millisecond
+	maxRTO        = 30 * time.Second
+	maxRetransmit = 8
+	tick          = 50 * time.Millisecond
+	finTimeout    = 30 * time.Second
+)
+
+// 已发送未确认的包
+type packet struct {
+	seq    uint16
+	typ    byte
+	data   []byte
+	sentAt time.Time
+	resent int
+	acked  bool
+}
+
+// 最近两分钟内的最小延迟，作为base delay
+type delayHistory struct {
+	mins  [2]uint32
+	valid [2]bool
+	idx   int
+	start time.Time
+}
+
+func (d *delayHistory) add(sample uint32, t time.Time) {
+	if t.Sub(d.start) >= time.Minute {
+		d.idx = (d.idx + 1) % len(d.mins)
+		d.mins[d.idx], d.valid[d.idx], d.start = sample, true, t
+	} else if sample < d.mins[d.idx] {
+		d.mins[d.idx] = sample
+	}
+}
+
+func (d *delayHistory) base() uint32 {
+	base := d.mins[d.idx]
+	for i, ok := range d.valid {
+		if ok && d.mins[i] < base {
+			base = d.mins[i]
+		}
+	}
+	return base
+}
+
+// uTP连接，满足net.Conn接口
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvId uint16
+	sendId uint16
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     int
+	err       error
+	connected chan struct{}
+	done      chan struct{}
+	closeAt   time.Time
+
+	// 发送
+	seq      uint16 // 下一个包的序号
+	outbuf   []*packet
+	inflight int
+	cwnd     float64
+	peerWnd  uint32
+	delays   delayHistory
+	rtt      time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+	synAt    time.Time
+	synTries int
+
+	// 接收
+	ack        uint16 // 按顺序收到的最后一个序号
+	replyMicro uint32
+	readBuf    []byte
+	reorder    map[uint16][]byte
+	reorderLen int // reorder中的字节数，和readBuf合计不超过recvWindow
+	finSeq     uint16
+	gotFin     bool
+	eof        bool
+
+	readDeadline, writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvId, sendId uint16) *Conn {
+	c := &Conn{
+		s:         s,
+		raddr:     raddr,
+		recvId:    recvId,
+		sendId:    sendId,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+		cwnd:      minWindow * 2,
+		peerWnd:   recvWindow,
+		rto:       time.Second,
+		reorder:   make(map[uint16][]byte),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func expired(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (c *Conn) error() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// 连接出错，唤醒所有等待者并从socket中移除
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	c.failLocked(err)
+	c.mu.Unlock()
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = stateClosed
+	close(c.done)
+	c.cond.Broadcast()
+	go c.s.remove(c)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if len(c.readBuf) > 0 {
+			wasFull := len(c.readBuf) >= recvWindow-MaxPayload
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			if wasFull {
+				c.sendState() // 通知对方窗口已打开
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.state == stateFinSent {
+			return 0, ErrClosed
+		}
+		if expired(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.state != stateConnected {
+			return written, ErrClosed
+		}
+		if expired(c.writeDeadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := len(b)
+		if n > MaxPayload {
+			n = MaxPayload
+		}
+		if c.inflight > 0 && c.inflight+n > c.window() {
+			c.cond.Wait()
+			continue
+		}
+		c.sendPacket(stData, append([]byte(nil), b[:n]...))
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// 发送窗口，取拥塞窗口和对方接收窗口中较小的
+func (c *Conn) window() int {
+	w := int(c.cwnd)
+	if int(c.peerWnd) < w {
+		w = int(c.peerWnd)
+	}
+	return w
+}
+
+// 发送FIN，不等待对方确认
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case stateClosed, stateFinSent:
+		return nil
+	case stateSynSent:
+		c.failLocked(ErrClosed)
+		return nil
+	}
+	c.state = stateFinSent
+	c.closeAt = time.Now()
+	c.sendPacket(stFin, nil)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) header(typ byte) *header {
+	wnd := recvWindow - len(c.readBuf)
+	if wnd < 0 {
+		wnd = 0
+	}
+	return &header{
+		typ:    typ,
+		connId: c.sendId,
+		ts:     now(),
+		tsDiff: c.replyMicro,
+		wnd:    uint32(wnd),
+		seq:    c.seq,
+		ack:    c.ack,
+	}
+}
+
+func (c *Conn) sendSyn() {
+	h := c.header(stSyn)
+	h.connId = c.recvId
+	h.seq = 1
+	c.seq = 2
+	c.synAt = time.Now()
+	c.synTries++
+	c.s.send(h.marshal(nil), c.raddr)
+}
+
+// 发送确认，有乱序的包时带上SACK
+func (c *Conn) sendState() {
+	h := c.header(stState)
+	if len(c.reorder) > 0 {
+		h.sack = c.sackBits()
+	}
+	c.s.send(h.marshal(nil), c.raddr)
+}
+
+func (c *Conn) sackBits() []byte {
+	max := 0
+	for seq := range c.reorder {
+		if i := int(seq - c.ack - 2); i >= 0 && i < 256 && i+1 > max {
+			max = i + 1
+		}
+	}
+	size := (max + 31) / 32 * 4
+	if size == 0 {
+		size = 4
+	}
+	bits := make([]byte, size)
+	for seq := range c.reorder {
+		if i := int(seq - c.ack - 2); i >= 0 && i < size*8 {
+			bits[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return bits
+}
+
+func (c *Conn) sendPacket(typ byte, data []byte) {
+	p := &packet{seq: c.seq, typ: typ, data: data}
+	c.seq++
+	c.outbuf = append(c.outbuf, p)
+	c.inflight += len(data)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *packet) {
+	h := c.header(p.typ)
+	h.seq = p.seq
+	p.sentAt = time.Now()
+	c.s.send(h.marshal(p.data), c.raddr)
+}
+
+// 处理收到的包，在socket的读取goroutine中调用
+func (c *Conn) handle(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	// 确认了还没有发送的包，不是这个连接的对方发来的
+	if seqLess(c.seq-1, h.ack) {
+		return
+	}
+	c.replyMicro = now() - h.ts
+	c.peerWnd = h.wnd
+
+	switch h.typ {
+	case stReset:
+		c.failLocked(ErrReset)
+		return
+	case stState:
+		if c.state == stateSynSent {
+			c.state = stateConnected
+			c.ack = h.seq - 1
+			close(c.connected)
+		}
+	}
+
+	c.processAck(h)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+		c.sendState()
+	}
+	c.checkFinished()
+	c.cond.Broadcast()
+}
+
+func (c *Conn) processAck(h *header) {
+	now := time.Now()
+	acked := 0
+	var kept []*packet
+	for _, p := range c.outbuf {
+		if !seqLess(h.ack, p.seq) {
+			acked += c.ackPacket(p, now)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) < len(c.outbuf) && c.rtt > 0 {
+		c.updateRTO() // 有进展时取消退避
+	}
+	c.outbuf = kept
+
+	// SACK：标记已收到的包，最早的包之后有3个以上被确认时快速重传
+	if h.sack != nil && len(c.outbuf) > 0 {
+		for _, p := range c.outbuf {
+			i := int(p.seq - h.ack - 2)
+			if i >= 0 && i < len(h.sack)*8 && h.sack[i/8]&(1<<uint(i%8)) != 0 && !p.acked {
+				acked += c.ackPacket(p, now)
+			}
+		}
+		var after int
+		for _, p := range c.outbuf[1:] {
+			if p.acked {
+				after++
+			}
+		}
+		if first := c.outbuf[0]; !first.acked && after >= 3 && first.resent == 0 {
+			first.resent++
+			c.cwnd /= 2
+			if c.cwnd < minWindow {
+				c.cwnd = minWindow
+			}
+			c.transmit(first)
+		}
+	}
+
+	if acked > 0 {
+		c.ledbat(h.tsDiff, acked, now)
+	}
+}
+
+// 确认一个包，返回确认的字节数
+func (c *Conn) ackPacket(p *packet, now time.Time) int {
+	if p.acked {
+		return 0
+	}
+	p.acked = true
+	c.inflight -= len(p.data)
+	if p.resent == 0 {
+		sample := now.Sub(p.sentAt)
+		if c.rtt == 0 {
+			c.rtt, c.rttVar = sample, sample/2
+		} else {
+			delta := c.rtt - sample
+			if delta < 0 {
+				delta = -delta
+			}
+			c.rttVar += (delta - c.rttVar) / 4
+			c.rtt += (sample - c.rtt) / 8
+		}
+		c.updateRTO()
+	}
+	return len(p.data)
+}
+
+func (c *Conn) updateRTO() {
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// LEDBAT：根据排队延迟与目标的差距调整窗口
+func (c *Conn) ledbat(delay uint32, acked int, now time.Time) {
+	if delay == 0 {
+		return
+	}
+	c.delays.add(delay, now)
+	ourDelay := float64(delay - c.delays.base())
+	offTarget := (target - ourDelay) / target
+	c.cwnd += maxCwndIncrease * offTarget * float64(acked) / c.cwnd
+	if c.cwnd < minWindow {
+		c.cwnd = minWindow
+	}
+}
+
+func (c *Conn) receive(h *header, payload []byte) {
+	if h.typ == stFin {
+		c.gotFin, c.finSeq = true, h.seq
+	}
+	next := c.ack + 1
+	switch {
+	case h.typ == stData && h.seq == next:
+		if len(c.readBuf)+len(payload) > recvWindow {
+			return // 缓冲已满，等对方重传
+		}
+		c.readBuf = append(c.readBuf, payload...)
+		c.ack = h.seq
+	case h.typ == stData && seqLess(next, h.seq):
+		// 超出通告的接收窗口的包丢弃
+		old := len(c.reorder[h.seq])
+		if len(c.readBuf)+c.reorderLen-old+len(payload) > recvWindow {
+			return
+		}
+		c.reorder[h.seq] = payload
+		c.reorderLen += len(payload) - old
+	}
+
+	// 按顺序取出缓存的包
+	for {
+		if data, ok := c.reorder[c.ack+1]; ok {
+			delete(c.reorder, c.ack+1)
+			c.reorderLen -= len(data)
+			c.readBuf = append(c.readBuf, data...)
+			c.ack++
+			continue
+		}
+		if c.gotFin && c.finSeq == c.ack+1 {
+			c.ack = c.finSeq
+			c.eof = true
+		}
+		break
+	}
+}
+
+// 双方都结束且FIN已被确认时关闭连接
+func (c *Conn) checkFinished() {
+	if c.state == stateFinSent && len(c.outbuf) == 0 {
+		c.failLocked(ErrClosed)
+	}
+}
+
+// 定时处理重传、超时和deadline
+func (c *Conn) timerLoop() {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		c.mu.Lock()
+		now := time.Now()
+		switch {
+		case c.state == stateSynSent:
+			if now.Sub(c.synAt) > c.rto {
+				if c.synTries >= 5 {
+					c.failLocked(ErrTimeout)
+				} else {
+					c.rto *= 2
+					c.sendSyn()
+				}
+			}
+		case len(c.outbuf) > 0:
+			var first *packet
+			for _, p := range c.outbuf {
+				if !p.acked {
+					first = p
+					break
+				}
+			}
+			if first != nil && now.Sub(first.sentAt) > c.rto {
+				if first.resent >= maxRetransmit {
+					c.failLocked(ErrTimeout)
+					break
+				}
+				first.resent++
+				c.rto *= 2
+				if c.rto > maxRTO {
+					c.rto = maxRTO
+				}
+				c.cwnd = minWindow
+				c.transmit(first)
+			}
+		}
+		if c.state == stateFinSent && now.Sub(c.closeAt) > finTimeout {
+			c.failLocked(ErrClosed)
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
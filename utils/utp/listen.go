@@ -0,0 +1,162 @@
+package utp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/openqt/whonet/utils/network"
+)
+
+// 主动连接时TCP和uTP的选择
+type Preference int
+
+const (
+	PreferUTP Preference = iota // 先尝试uTP，失败时使用TCP
+	PreferTCP                   // 先尝试TCP，失败时使用uTP
+	OnlyUTP
+	OnlyTCP
+)
+
+var preferenceNames = []string{"prefer-utp", "prefer-tcp", "utp", "tcp"}
+
+func (p Preference) String() string {
+	if p >= 0 && int(p) < len(preferenceNames) {
+		return preferenceNames[p]
+	}
+	return fmt.Sprintf("preference(%d)", int(p))
+}
+
+// 解析配置，为空时优先使用uTP
+func ParsePreference(s string) (Preference, error) {
+	if s == "" {
+		return PreferUTP, nil
+	}
+	for i, name := range preferenceNames {
+		if strings.EqualFold(s, name) {
+			return Preference(i), nil
+		}
+	}
+	return PreferUTP, fmt.Errorf("utp: unknown transport %q", s)
+}
+
+// 按偏好选择TCP或uTP的Dialer，满足network.Dialer接口
+type Dialer struct {
+	Socket     *Socket        // 为nil时只使用TCP
+	TCP        network.Dialer // 为nil时直接连接
+	Preference Preference
+}
+
+func (d *Dialer) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	tcp := d.TCP
+	if tcp == nil {
+		tcp = &net.Dialer{}
+	}
+	order := []network.Dialer{d.Socket, tcp}
+	switch d.Preference {
+	case PreferTCP:
+		order = []network.Dialer{tcp, d.Socket}
+	case OnlyUTP:
+		order = order[:1]
+	case OnlyTCP:
+		order = order[1:]
+	}
+
+	var err error
+	for _, dialer := range order {
+		if s, ok := dialer.(*Socket); ok && s == nil {
+			continue
+		}
+		var c net.Conn
+		if c, err = dialer.DialContext(ctx, "tcp", addr); err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("utp: no transport for %s", addr)
+	}
+	return nil, err
+}
+
+// 在同一个端口号上同时监听TCP和uTP
+type Listener struct {
+	TCP net.Listener
+	UTP *Socket
+
+	conns  chan net.Conn
+	errs   chan error
+	closed chan struct{}
+	once   sync.Once
+}
+
+// 端口为0时先选定TCP端口，再在同一端口上监听UDP
+func ListenBoth(addr string) (*Listener, error) {
+	tl, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	port := tl.Addr().(*net.TCPAddr).Port
+	s, err := Listen(net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		tl.Close()
+		return nil, err
+	}
+
+	l := &Listener{
+		TCP:    tl,
+		UTP:    s,
+		conns:  make(chan net.Conn),
+		errs:   make(chan error, 2),
+		closed: make(chan struct{}),
+	}
+	go l.accept(tl)
+	go l.accept(s)
+	return l, nil
+}
+
+func (l *Listener) accept(from net.Listener) {
+	for {
+		c, err := from.Accept()
+		if err != nil {
+			l.errs <- err
+			return
+		}
+		select {
+		case l.conns <- c:
+		case <-l.closed:
+			c.Close()
+			return
+		}
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.TCP.Close()
+		l.UTP.Close()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.TCP.Addr()
+}
@@ -0,0 +1,101 @@
+package utp
+
+//
+// uTP传输协议
+// 参考 http://www.bittorrent.org/beps/bep_0029.html
+//
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+
+	version    = 1
+	headerSize = 20
+	extSACK    = 1
+
+	// 每个UDP包的最大长度，避免IP分片
+	packetSize = 1400
+	MaxPayload = packetSize - headerSize
+)
+
+var errPacket = errors.New("utp: invalid packet")
+
+// 包头
+type header struct {
+	typ    byte
+	connId uint16
+	ts     uint32 // 发送时间，微秒
+	tsDiff uint32 // 收到对方上一个包的时间与其发送时间之差
+	wnd    uint32 // 接收窗口
+	seq    uint16
+	ack    uint16
+	sack   []byte // 选择确认的位图，bit i表示ack+2+i已收到
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+	b := make([]byte, size)
+	b[0] = h.typ<<4 | version
+	binary.BigEndian.PutUint16(b[2:], h.connId)
+	binary.BigEndian.PutUint32(b[4:], h.ts)
+	binary.BigEndian.PutUint32(b[8:], h.tsDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wnd)
+	binary.BigEndian.PutUint16(b[16:], h.seq)
+	binary.BigEndian.PutUint16(b[18:], h.ack)
+	n := headerSize
+	if h.sack != nil {
+		b[1] = extSACK
+		b[n] = 0 // 没有下一个扩展
+		b[n+1] = byte(len(h.sack))
+		copy(b[n+2:], h.sack)
+		n += 2 + len(h.sack)
+	}
+	copy(b[n:], payload)
+	return b
+}
+
+// 解析包，返回的负载指向b
+func parseHeader(b []byte) (*header, []byte, error) {
+	if len(b) < headerSize || b[0]&0x0f != version || b[0]>>4 > stSyn {
+		return nil, nil, errPacket
+	}
+	h := &header{
+		typ:    b[0] >> 4,
+		connId: binary.BigEndian.Uint16(b[2:]),
+		ts:     binary.BigEndian.Uint32(b[4:]),
+		tsDiff: binary.BigEndian.Uint32(b[8:]),
+		wnd:    binary.BigEndian.Uint32(b[12:]),
+		seq:    binary.BigEndian.Uint16(b[16:]),
+		ack:    binary.BigEndian.Uint16(b[18:]),
+	}
+
+	// 扩展链表：下一个扩展的类型、长度、内容
+	ext, n := b[1], headerSize
+	for ext != 0 {
+		if n+2 > len(b) || n+2+int(b[n+1]) > len(b) {
+			return nil, nil, errPacket
+		}
+		next, size := b[n], int(b[n+1])
+		if ext == extSACK {
+			h.sack = b[n+2 : n+2+size]
+		}
+		ext, n = next, n+2+size
+	}
+	return h, b[n:], nil
+}
+
+// 序号比较，处理16位回绕
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
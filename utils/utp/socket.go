@@ -0,0 +1,235 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed  = errors.New("utp: use of closed connection")
+	ErrReset   = errors.New("utp: connection reset by peer")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+const acceptBacklog = 64
+
+type connKey struct {
+	addr string
+	id   uint16 // 本地接收的connection_id
+}
+
+// 一个UDP端口上的所有uTP连接，同时作为net.Listener
+type Socket struct {
+	pc net.PacketConn
+
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	backlog chan *Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// 在UDP地址上监听
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:      pc,
+		conns:   make(map[connKey]*Conn),
+		backlog: make(chan *Conn, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// 等待对方发起的连接
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+// 关闭端口和所有连接
+func (s *Socket) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.mu.Lock()
+		conns := s.conns
+		s.conns = make(map[connKey]*Conn)
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(ErrClosed)
+		}
+	})
+	return err
+}
+
+// 满足network.Dialer接口，network参数被忽略
+func (s *Socket) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var id uint16
+	for {
+		id = uint16(rand.Intn(0x10000))
+		if _, ok := s.conns[connKey{raddr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = stateSynSent
+	c.seq = 1
+	c.sendSyn()
+	c.mu.Unlock()
+	go c.timerLoop()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, c.error()
+	case <-ctx.Done():
+		c.fail(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), "utp", addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) send(b []byte, addr net.Addr) error {
+	_, err := s.pc.WriteTo(b, addr)
+	return err
+}
+
+// 对未知连接回复reset，connection_id就是对方发送时使用的
+func (s *Socket) reset(h *header, addr net.Addr) {
+	r := &header{typ: stReset, connId: h.connId, ts: now(), seq: uint16(rand.Intn(0x10000)), ack: h.seq}
+	s.send(r.marshal(nil), addr)
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+		h, payload, err := parseHeader(buf[:n])
+		if err != nil {
+			continue // 不是uTP包
+		}
+		payload = append([]byte(nil), payload...)
+		if h.sack != nil {
+			h.sack = append([]byte(nil), h.sack...)
+		}
+		s.dispatch(h, payload, addr)
+	}
+}
+
+func (s *Socket) dispatch(h *header, payload []byte, addr net.Addr) {
+	if h.typ == stSyn {
+		s.accept(h, addr)
+		return
+	}
+
+	s.mu.Lock()
+	c := s.conns[connKey{addr.String(), h.connId}]
+	if h.typ == stReset {
+		// reset使用我们发送时的connection_id
+		c = nil
+		for key, conn := range s.conns {
+			if key.addr == addr.String() && conn.sendId == h.connId {
+				c = conn
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if c == nil {
+		if h.typ != stReset {
+			s.reset(h, addr)
+		}
+		return
+	}
+	c.handle(h, payload)
+}
+
+// 处理SYN，重复的SYN重发应答
+func (s *Socket) accept(h *header, addr net.Addr) {
+	key := connKey{addr.String(), h.connId + 1}
+	s.mu.Lock()
+	c := s.conns[key]
+	if c == nil {
+		c = newConn(s, addr, h.connId+1, h.connId)
+		s.conns[key] = c
+	} else {
+		s.mu.Unlock()
+		c.mu.Lock()
+		c.sendState()
+		c.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = stateConnected
+	c.seq = uint16(rand.Intn(0x10000))
+	c.ack = h.seq
+	c.peerWnd = h.wnd
+	c.replyMicro = now() - h.ts
+	close(c.connected)
+	c.sendState()
+	c.mu.Unlock()
+
+	select {
+	case s.backlog <- c:
+		go c.timerLoop()
+	default:
+		s.remove(c)
+		s.reset(&header{connId: h.connId + 1, seq: h.seq}, addr)
+	}
+}
+
+// 微秒时间戳
+func now() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
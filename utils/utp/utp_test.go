@@ -0,0 +1,256 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟丢包和延迟的UDP端口
+type lossyConn struct {
+	net.PacketConn
+	loss  float64
+	delay time.Duration
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := mrand.Float64() < c.loss
+	if drop {
+		c.dropped++
+	}
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	if c.delay == 0 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	b = append([]byte(nil), b...)
+	time.AfterFunc(c.delay, func() { c.PacketConn.WriteTo(b, addr) })
+	return len(b), nil
+}
+
+func (c *lossyConn) Dropped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+func socket(t *testing.T, loss float64, delay time.Duration) (*Socket, *lossyConn) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := &lossyConn{PacketConn: pc, loss: loss, delay: delay}
+	s := NewSocket(lc)
+	t.Cleanup(func() { s.Close() })
+	return s, lc
+}
+
+func TestPacket(t *testing.T) {
+	h := &header{typ: stState, connId: 1234, ts: 1, tsDiff: 2, wnd: 3, seq: 65535, ack: 7, sack: []byte{1, 0, 0, 0x80}}
+	got, payload, err := parseHeader(h.marshal([]byte("data")))
+	if err != nil || string(payload) != "data" {
+		t.Fatalf("%v %q", err, payload)
+	}
+	if got.typ != h.typ || got.connId != h.connId || got.seq != h.seq || got.ack != h.ack ||
+		got.wnd != h.wnd || !bytes.Equal(got.sack, h.sack) {
+		t.Errorf("header %+v", got)
+	}
+	if _, _, err := parseHeader([]byte("d1:ad2:id20:")); err == nil {
+		t.Error("non-utp packet accepted")
+	}
+	if !seqLess(65535, 1) || seqLess(1, 65535) {
+		t.Error("sequence wrap")
+	}
+}
+
+// 单向传输数据，校验内容并关闭
+func transfer(t *testing.T, a, b *Socket, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	errc := make(chan error, 1)
+	go func() {
+		c, err := b.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(30 * time.Second))
+		got, err := io.ReadAll(c)
+		if err == nil && !bytes.Equal(got, data) {
+			t.Errorf("received %d bytes, want %d", len(got), len(data))
+		}
+		c.Write([]byte("ok"))
+		errc <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := a.DialContext(ctx, "utp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// 半关闭：写完后发送FIN，但仍然读取应答
+	uc := c.(*Conn)
+	uc.mu.Lock()
+	uc.sendPacket(stFin, nil)
+	uc.mu.Unlock()
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil || string(reply) != "ok" {
+		t.Errorf("reply %q %v", reply, err)
+	}
+	c.Close()
+}
+
+func TestTransfer(t *testing.T) {
+	a, _ := socket(t, 0, 0)
+	b, _ := socket(t, 0, 0)
+	transfer(t, a, b, 4*1024*1024)
+}
+
+func TestLossAndDelay(t *testing.T) {
+	a, la := socket(t, 0.05, 5*time.Millisecond)
+	b, lb := socket(t, 0.05, 5*time.Millisecond)
+	transfer(t, a, b, 512*1024)
+	if la.Dropped() == 0 || lb.Dropped() == 0 {
+		t.Errorf("no packets dropped: %d %d", la.Dropped(), lb.Dropped())
+	}
+}
+
+func TestLedbat(t *testing.T) {
+	c := newConn(nil, nil, 1, 2)
+	start := time.Now()
+	c.cwnd = 100000
+	c.ledbat(1000, MaxPayload, start) // base delay
+	grown := c.cwnd
+	if grown <= 100000 {
+		t.Errorf("window not grown below target: %v", grown)
+	}
+	// 排队延迟超过目标时窗口缩小
+	c.ledbat(1000+2*target, MaxPayload, start.Add(time.Second))
+	if c.cwnd >= grown {
+		t.Errorf("window not shrunk above target: %v", c.cwnd)
+	}
+	for i := 0; i < 1000; i++ {
+		c.ledbat(1000+10*target, MaxPayload, start.Add(time.Second))
+	}
+	if c.cwnd < minWindow {
+		t.Errorf("window below minimum: %v", c.cwnd)
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	c := newConn(nil, nil, 1, 2)
+	c.state = stateConnected
+	c.ack = 100
+	payload := make([]byte, MaxPayload)
+	// 缺少101，后面的包都放在reorder中，超出窗口的丢弃
+	for seq := uint16(102); seq < 102+2*recvWindow/MaxPayload; seq++ {
+		c.receive(&header{typ: stData, seq: seq}, payload)
+	}
+	if c.reorderLen > recvWindow || len(c.reorder) != recvWindow/MaxPayload {
+		t.Errorf("reorder %d packets, %d bytes", len(c.reorder), c.reorderLen)
+	}
+	c.receive(&header{typ: stData, seq: 101}, payload)
+	if c.reorderLen != 0 || len(c.readBuf) != (1+recvWindow/MaxPayload)*MaxPayload {
+		t.Errorf("read buffer %d bytes, reorder %d bytes", len(c.readBuf), c.reorderLen)
+	}
+
+	// 确认还没有发送的包
+	c.seq = 10
+	c.outbuf = []*packet{{seq: 9, data: payload}}
+	c.inflight = len(payload)
+	c.handle(&header{typ: stState, ack: 20}, nil)
+	if len(c.outbuf) != 1 {
+		t.Error("ack ahead of sent packets accepted")
+	}
+	c.handle(&header{typ: stState, ack: 9}, nil)
+	if len(c.outbuf) != 0 || c.inflight != 0 {
+		t.Error("ack not processed")
+	}
+}
+
+func TestReset(t *testing.T) {
+	a, _ := socket(t, 0, 0)
+	b, _ := socket(t, 0, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := a.DialContext(ctx, "utp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, _ := b.Accept()
+
+	// 对方端口关闭后，数据包得到reset
+	sc.(*Conn).fail(ErrClosed)
+	time.Sleep(10 * time.Millisecond)
+	c.Write([]byte("hello"))
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != ErrReset {
+		t.Errorf("read after reset: %v", err)
+	}
+}
+
+func TestListenBoth(t *testing.T) {
+	l, err := ListenBoth("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.UTP.Addr().(*net.UDPAddr).Port != l.TCP.Addr().(*net.TCPAddr).Port {
+		t.Fatalf("ports differ: %v %v", l.UTP.Addr(), l.TCP.Addr())
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	s, _ := socket(t, 0, 0)
+	for _, pref := range []Preference{OnlyTCP, OnlyUTP, PreferUTP} {
+		d := &Dialer{Socket: s, Preference: pref}
+		c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%v: %v", pref, err)
+		}
+		_, isUTP := c.(*Conn)
+		if isUTP != (pref != OnlyTCP) {
+			t.Errorf("%v: connected with %T", pref, c)
+		}
+		c.Write([]byte("echo"))
+		got := make([]byte, 4)
+		c.SetDeadline(time.Now().Add(3 * time.Second))
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != "echo" {
+			t.Errorf("%v: %q %v", pref, got, err)
+		}
+		c.Close()
+	}
+}